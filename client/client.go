@@ -0,0 +1,530 @@
+// Package client is a Go client for the nagiosagg HTTP API. The client implements
+// svc.NagiosParserSvc, so the service middlewares can wrap remote calls as well
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/ratelimit"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// Client defaults
+const (
+	DefaultTimeout      = 30 * time.Second
+	DefaultBackoff      = 500 * time.Millisecond
+	DefaultPollInterval = time.Second
+)
+
+// Error is an error response of the server that doesn't map to one of the svc errors
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nagiosagg: %d %s", e.StatusCode, e.Message)
+}
+
+// knownErrors are the svc errors the server reports, mapped back so callers can compare against them
+var knownErrors = []error{
+	svc.ErrJSONUnMarshall,
+	svc.ErrInvalidQuery,
+	svc.ErrInvalidFilter,
+	svc.ErrInvalidCursor,
+	svc.ErrNotAcceptable,
+	svc.ErrSnapshotNotFound,
+	svc.ErrHostNotFound,
+	svc.ErrSummaryNotFound,
+	svc.ErrJobNotFound,
+	ratelimit.ErrLimited,
+}
+
+type config struct {
+	timeout      time.Duration
+	retries      int
+	backoff      time.Duration
+	pollInterval time.Duration
+	headers      http.Header
+	httpClient   *http.Client
+}
+
+// Option configures the client
+type Option func(*config)
+
+// WithTimeout limits the time of each request attempt, zero means no limit. The default is DefaultTimeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) { c.timeout = timeout }
+}
+
+// WithRetries retries GET requests failing with network errors or server errors up to retries times,
+// waiting backoff before the first retry and doubling it after every retry. Starting a refresh isn't
+// retried, the server may have started it before failing
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithHeader sets a header on every request, e.g. for an authenticating proxy in front of the service
+func WithHeader(key, value string) Option {
+	return func(c *config) { c.headers.Add(key, value) }
+}
+
+// WithBearerToken authenticates every request with the token
+func WithBearerToken(token string) Option {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithBasicAuth authenticates every request with the username and password
+func WithBasicAuth(username, password string) Option {
+	return func(c *config) {
+		r := http.Request{Header: http.Header{}}
+		r.SetBasicAuth(username, password)
+		c.headers.Set("Authorization", r.Header.Get("Authorization"))
+	}
+}
+
+// WithHTTPClient replaces the http.DefaultClient used for the requests
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) { c.httpClient = client }
+}
+
+// WithPollInterval sets how often RefreshNagiosData polls the refresh job, the default is DefaultPollInterval
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *config) { c.pollInterval = interval }
+}
+
+type client struct {
+	getParsedNagios endpoint.Endpoint
+	startRefresh    endpoint.Endpoint
+	getRefreshJob   endpoint.Endpoint
+	getEvents       endpoint.Endpoint
+	diffSnapshots   endpoint.Endpoint
+	availability    endpoint.Endpoint
+	getHosts        endpoint.Endpoint
+	getHost         endpoint.Endpoint
+	getService      endpoint.Endpoint
+	getSummary      endpoint.Endpoint
+	pollInterval    time.Duration
+}
+
+// request is the path and query of a call, relative to the instance URL
+type request struct {
+	path  string
+	query url.Values
+}
+
+// New returns a NagiosParserSvc calling the nagiosagg server at instance, e.g. http://nagiosagg:8080
+func New(instance string, options ...Option) (svc.NagiosParserSvc, error) {
+	if !strings.HasPrefix(instance, "http") {
+		instance = "http://" + instance
+	}
+	base, err := url.Parse(instance)
+	if err != nil {
+		return nil, err
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	c := config{
+		timeout:      DefaultTimeout,
+		backoff:      DefaultBackoff,
+		pollInterval: DefaultPollInterval,
+		headers:      http.Header{},
+		httpClient:   http.DefaultClient,
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	clientOptions := []httptransport.ClientOption{
+		httptransport.SetClient(c.httpClient),
+		httptransport.ClientBefore(func(ctx context.Context, r *http.Request) context.Context {
+			for key, values := range c.headers {
+				r.Header[key] = values
+			}
+			r.Header.Set("Accept", "application/json")
+			return ctx
+		}),
+	}
+	makeEndpoint := func(method string, dec httptransport.DecodeResponseFunc) endpoint.Endpoint {
+		e := httptransport.NewClient(method, base, encodeRequest, dec, clientOptions...).Endpoint()
+		e = timeout(c.timeout)(e)
+		if method != "GET" {
+			return e
+		}
+		return retry(c.retries, c.backoff)(e)
+	}
+	return &client{
+		getParsedNagios: makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &map[string][]svc.NagiosStatusResponse{} })),
+		startRefresh:    makeEndpoint("POST", decodeJSONResponse(func() interface{} { return &svc.RefreshJob{} })),
+		getRefreshJob:   makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &svc.RefreshJob{} })),
+		getEvents:       makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &[]svc.Event{} })),
+		diffSnapshots:   makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &svc.SnapshotDiff{} })),
+		availability:    makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &svc.AvailabilityReport{} })),
+		getHosts:        makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &[]svc.HostSummary{} })),
+		getHost:         makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &hostResponse{} })),
+		getService:      makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &map[string][]svc.NagiosStatusResponse{} })),
+		getSummary:      makeEndpoint("GET", decodeJSONResponse(func() interface{} { return &svc.Summary{} })),
+		pollInterval:    c.pollInterval,
+	}, nil
+}
+
+// timeout limits each attempt of a call
+func timeout(d time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if d <= 0 {
+			return next
+		}
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, request)
+		}
+	}
+}
+
+// retryable reports whether a failed call may succeed when repeated
+func retryable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode >= 500
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if _, ok := err.(*url.Error); ok {
+		return true
+	}
+	return false
+}
+
+// retry repeats calls failing with retryable errors, with an exponential backoff
+func retry(retries int, backoff time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			wait := backoff
+			for attempt := 0; ; attempt++ {
+				response, err := next(ctx, request)
+				if err == nil || attempt >= retries || !retryable(err) {
+					return response, err
+				}
+				select {
+				case <-ctx.Done():
+					return response, err
+				case <-time.After(wait):
+				}
+				wait *= 2
+			}
+		}
+	}
+}
+
+func encodeRequest(_ context.Context, r *http.Request, req interface{}) error {
+	call := req.(request)
+	// Set both so that escaped slashes in names (/services/Disk%20%2Fvar) stay escaped
+	rawPath := r.URL.EscapedPath() + call.path
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return err
+	}
+	r.URL.Path = path
+	r.URL.RawPath = rawPath
+	r.URL.RawQuery = call.query.Encode()
+	return nil
+}
+
+// decodeJSONResponse decodes successful responses into the value returned by newValue, and errors into svc errors
+func decodeJSONResponse(newValue func() interface{}) httptransport.DecodeResponseFunc {
+	return func(_ context.Context, r *http.Response) (interface{}, error) {
+		if r.StatusCode >= 300 {
+			return nil, decodeError(r)
+		}
+		v := newValue()
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+func decodeError(r *http.Response) error {
+	body, _ := ioutil.ReadAll(r.Body)
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error == "" {
+		resp.Error = strings.TrimSpace(string(body))
+		if resp.Error == "" {
+			resp.Error = http.StatusText(r.StatusCode)
+		}
+	}
+	for _, known := range knownErrors {
+		if resp.Error == known.Error() {
+			return known
+		}
+	}
+	return &Error{StatusCode: r.StatusCode, Message: resp.Error}
+}
+
+func filterQuery(filter svc.Filter) url.Values {
+	query := url.Values{}
+	if len(filter.States) > 0 {
+		query.Set("state", strings.Join(filter.States, ","))
+	}
+	if filter.Host != "" {
+		query.Set("host", filter.Host)
+	}
+	if filter.Service != "" {
+		query.Set("service", filter.Service)
+	}
+	if len(filter.Instances) > 0 {
+		query.Set("instance", strings.Join(filter.Instances, ","))
+	}
+	if len(filter.HostGroups) > 0 {
+		query.Set("hostgroup", strings.Join(filter.HostGroups, ","))
+	}
+	if len(filter.ServiceGroups) > 0 {
+		query.Set("servicegroup", strings.Join(filter.ServiceGroups, ","))
+	}
+	if len(filter.Contacts) > 0 {
+		query.Set("contact", strings.Join(filter.Contacts, ","))
+	}
+	for _, label := range filter.Labels {
+		query.Add("label", label)
+	}
+	if filter.Acknowledged != nil {
+		query.Set("acknowledged", strconv.FormatBool(*filter.Acknowledged))
+	}
+	if filter.InDowntime != nil {
+		query.Set("in_downtime", strconv.FormatBool(*filter.InDowntime))
+	}
+	if filter.Flapping != nil {
+		query.Set("flapping", strconv.FormatBool(*filter.Flapping))
+	}
+	if filter.Suppressed != nil {
+		query.Set("suppressed", strconv.FormatBool(*filter.Suppressed))
+	}
+	if filter.StateType != "" {
+		query.Set("state_type", filter.StateType)
+	}
+	if filter.MinDuration > 0 {
+		query.Set("min_duration", filter.MinDuration.String())
+	}
+	return query
+}
+
+func timeQuery(query url.Values, key string, t time.Time) {
+	if !t.IsZero() {
+		query.Set(key, t.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// stateCodes are the nagios current_state values of the state names
+var stateCodes = map[string]map[string]string{
+	"hoststatus":    {"OK": "0", "DOWN": "1", "UNREACHABLE": "2"},
+	"servicestatus": {"OK": "0", "WARNING": "1", "CRITICAL": "2", "UNKNOWN": "3"},
+}
+
+// toStatus rebuilds a nagios status from the fields the server returns. Only the values
+// the responses are made of are set, the other raw nagios values aren't available remotely
+func toStatus(hostname string, resp svc.NagiosStatusResponse) parser.NagiosStatus {
+	status := parser.NagiosStatus{
+		Hostname:   hostname,
+		Service:    resp.Service,
+		State:      resp.State,
+		Instance:   resp.Instance,
+		StatusType: "hoststatus",
+		// The response doesn't tell which detection flagged the issue, nagios' is restored below
+		Flapping:     resp.Flapping && !resp.NagiosFlapping,
+		FlapPercent:  resp.FlapPercent,
+		SuppressedBy: resp.SuppressedBy,
+		Metadata:     resp.Metadata,
+		Labels:       resp.Labels,
+		Values: map[string]string{
+			"host_name":     hostname,
+			"plugin_output": resp.Output,
+		},
+	}
+	if resp.Service != "" {
+		status.StatusType = "servicestatus"
+		status.Values["service_description"] = resp.Service
+	}
+	if resp.NagiosFlapping {
+		status.Values["is_flapping"] = "1"
+	}
+	if resp.PercentStateChange != 0 {
+		status.Values["percent_state_change"] = strconv.FormatFloat(resp.PercentStateChange, 'f', 2, 64)
+	}
+	if code, found := stateCodes[status.StatusType][resp.State]; found {
+		status.Values["current_state"] = code
+	}
+	if attempts := strings.SplitN(resp.Attempts, "/", 2); len(attempts) == 2 {
+		status.Values["current_attempt"] = attempts[0]
+		status.Values["max_attempts"] = attempts[1]
+	}
+	for key, t := range map[string]time.Time{
+		"last_check":        resp.LastCheck,
+		"next_check":        resp.NextCheck,
+		"last_state_change": resp.LastStateChanged,
+	} {
+		if !t.IsZero() {
+			status.Values[key] = strconv.FormatInt(t.Unix(), 10)
+		}
+	}
+	return status
+}
+
+func toStatuses(hostname string, resps []svc.NagiosStatusResponse) []parser.NagiosStatus {
+	statuses := []parser.NagiosStatus{}
+	for _, resp := range resps {
+		statuses = append(statuses, toStatus(hostname, resp))
+	}
+	return statuses
+}
+
+func toStatusMap(resp map[string][]svc.NagiosStatusResponse) map[string][]parser.NagiosStatus {
+	result := make(map[string][]parser.NagiosStatus, len(resp))
+	for hostname, statuses := range resp {
+		result[hostname] = toStatuses(hostname, statuses)
+	}
+	return result
+}
+
+type hostResponse struct {
+	Hostname     string                     `json:"hostname"`
+	HostStatuses []svc.NagiosStatusResponse `json:"host_statuses"`
+	Problems     []svc.NagiosStatusResponse `json:"problems"`
+	Comments     []svc.Comment              `json:"comments"`
+	Downtimes    []svc.Downtime             `json:"downtimes"`
+}
+
+// GetParsedNagios returns the issues matching the filter
+func (c *client) GetParsedNagios(ctx context.Context, filter svc.Filter) (map[string][]parser.NagiosStatus, error) {
+	query := filterQuery(filter)
+	// The service returns the problems suppressed by down hosts alongside the others
+	query.Set("flatten", "true")
+	resp, err := c.getParsedNagios(ctx, request{path: "/nagios", query: query})
+	if err != nil {
+		return nil, err
+	}
+	return toStatusMap(*resp.(*map[string][]svc.NagiosStatusResponse)), nil
+}
+
+// RefreshNagiosData starts a refresh job, or joins the running one, and waits for it to finish
+func (c *client) RefreshNagiosData(ctx context.Context) (svc.RefreshReport, error) {
+	resp, err := c.startRefresh(ctx, request{path: "/refresh"})
+	if err != nil {
+		return svc.RefreshReport{}, err
+	}
+	job := resp.(*svc.RefreshJob)
+	for job.Status == svc.JobRunning {
+		select {
+		case <-ctx.Done():
+			return svc.RefreshReport{}, ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+		resp, err := c.getRefreshJob(ctx, request{path: "/refresh/" + url.PathEscape(job.ID)})
+		if err != nil {
+			return svc.RefreshReport{}, err
+		}
+		job = resp.(*svc.RefreshJob)
+	}
+	if job.Status == svc.JobFailed {
+		return svc.RefreshReport{}, errors.New(job.Err)
+	}
+	if job.Report == nil {
+		return svc.RefreshReport{}, nil
+	}
+	return *job.Report, nil
+}
+
+// GetEvents returns the state transitions recorded after since
+func (c *client) GetEvents(ctx context.Context, since time.Time) ([]svc.Event, error) {
+	query := url.Values{}
+	timeQuery(query, "since", since)
+	resp, err := c.getEvents(ctx, request{path: "/events", query: query})
+	if err != nil {
+		return nil, err
+	}
+	return *resp.(*[]svc.Event), nil
+}
+
+// DiffSnapshots compares the snapshots taken at or before from and to
+func (c *client) DiffSnapshots(ctx context.Context, from, to time.Time) (svc.SnapshotDiff, error) {
+	query := url.Values{}
+	timeQuery(query, "from", from)
+	timeQuery(query, "to", to)
+	resp, err := c.diffSnapshots(ctx, request{path: "/diff", query: query})
+	if err != nil {
+		return svc.SnapshotDiff{}, err
+	}
+	return *resp.(*svc.SnapshotDiff), nil
+}
+
+// GetAvailabilityReport reports availability between from and to
+func (c *client) GetAvailabilityReport(ctx context.Context, from, to time.Time) (svc.AvailabilityReport, error) {
+	query := url.Values{}
+	timeQuery(query, "from", from)
+	timeQuery(query, "to", to)
+	resp, err := c.availability(ctx, request{path: "/reports/availability", query: query})
+	if err != nil {
+		return svc.AvailabilityReport{}, err
+	}
+	return *resp.(*svc.AvailabilityReport), nil
+}
+
+// GetHosts returns every known host
+func (c *client) GetHosts(ctx context.Context) ([]svc.HostSummary, error) {
+	resp, err := c.getHosts(ctx, request{path: "/hosts"})
+	if err != nil {
+		return nil, err
+	}
+	return *resp.(*[]svc.HostSummary), nil
+}
+
+// GetHost returns everything known about a host
+func (c *client) GetHost(ctx context.Context, hostname string) (svc.HostDetail, error) {
+	resp, err := c.getHost(ctx, request{path: "/hosts/" + url.PathEscape(hostname)})
+	if err != nil {
+		return svc.HostDetail{}, err
+	}
+	host := resp.(*hostResponse)
+	return svc.HostDetail{
+		Hostname:     host.Hostname,
+		HostStatuses: toStatuses(host.Hostname, host.HostStatuses),
+		Problems:     toStatuses(host.Hostname, host.Problems),
+		Comments:     host.Comments,
+		Downtimes:    host.Downtimes,
+	}, nil
+}
+
+// GetServiceProblems returns every host where the service is failing
+func (c *client) GetServiceProblems(ctx context.Context, service string) (map[string][]parser.NagiosStatus, error) {
+	resp, err := c.getService(ctx, request{path: "/services/" + url.PathEscape(service)})
+	if err != nil {
+		return nil, err
+	}
+	return toStatusMap(*resp.(*map[string][]svc.NagiosStatusResponse)), nil
+}
+
+// GetSummary returns the summary of the latest refresh with the top noisiest hosts
+func (c *client) GetSummary(ctx context.Context, top int) (svc.Summary, error) {
+	query := url.Values{"top": []string{strconv.Itoa(top)}}
+	resp, err := c.getSummary(ctx, request{path: "/summary", query: query})
+	if err != nil {
+		return svc.Summary{}, err
+	}
+	return *resp.(*svc.Summary), nil
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/tchaudhry91/nagiosagg/svc"
+	"golang.org/x/time/rate"
+)
+
+const statusDir = "../samples/public"
+
+var tempDB = filepath.Join(os.TempDir(), "client-test.db")
+
+func initServer(t *testing.T, wrap func(http.Handler) http.Handler) *httptest.Server {
+	os.Remove(tempDB)
+	service, err := svc.NewNagiosParserSvc(statusDir, tempDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacher := cache.New(time.Minute, time.Minute)
+	broker := svc.NewEventBroker(svc.DefaultReplaySize)
+	handler := svc.MakeHTTPHandler(service, cacher, svc.NewRefreshJobs(service, rate.NewLimiter(rate.Inf, 1)), broker, false)
+	srv := httptest.NewServer(wrap(handler))
+	t.Cleanup(func() {
+		srv.Close()
+		os.Remove(tempDB)
+	})
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	var authorized int32
+	srv := initServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "Bearer secret" {
+				atomic.AddInt32(&authorized, 1)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	c, err := New(srv.URL, WithBearerToken("secret"), WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client implements the service, so the middlewares wrap it as well
+	c = svc.LoggingMiddleware(log.NewNopLogger())(c)
+	ctx := context.Background()
+
+	report, err := c.RefreshNagiosData(ctx)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if report.Sources == 0 || report.Problems == 0 {
+		t.Errorf("Unexpected refresh report: %+v", report)
+	}
+
+	all, err := c.GetParsedNagios(ctx, svc.Filter{})
+	if err != nil {
+		t.Fatalf("GetParsedNagios failed: %v", err)
+	}
+	problems := 0
+	for _, statuses := range all {
+		problems += len(statuses)
+	}
+	if problems != report.Problems {
+		t.Errorf("Want %d problems, have %d", report.Problems, problems)
+	}
+
+	filter := svc.Filter{States: []string{"CRITICAL"}}
+	critical, err := c.GetParsedNagios(ctx, filter)
+	if err != nil {
+		t.Fatalf("GetParsedNagios failed: %v", err)
+	}
+	if len(critical) == 0 {
+		t.Error("Want CRITICAL problems")
+	}
+	for hostname, statuses := range critical {
+		for _, status := range statuses {
+			if status.State != "CRITICAL" || status.Hostname != hostname || status.StatusType != "servicestatus" {
+				t.Errorf("Unexpected status %+v", status)
+			}
+			// The rebuilt status still matches the filter locally
+			if !filter.Match(status, time.Now()) {
+				t.Errorf("Status doesn't match the filter: %+v", status)
+			}
+		}
+	}
+
+	if _, err := c.GetParsedNagios(ctx, svc.Filter{StateType: "firm"}); err != svc.ErrInvalidFilter && err != svc.ErrInvalidQuery {
+		t.Errorf("Want an invalid filter error, have %v", err)
+	}
+
+	hosts, err := c.GetHosts(ctx)
+	if err != nil || len(hosts) == 0 {
+		t.Fatalf("GetHosts failed: %v", err)
+	}
+	host, err := c.GetHost(ctx, hosts[0].Hostname)
+	if err != nil || host.Hostname != hosts[0].Hostname {
+		t.Errorf("GetHost failed: %v", err)
+	}
+	if _, err := c.GetHost(ctx, "no-such-host"); err != svc.ErrHostNotFound {
+		t.Errorf("Want %v, have %v", svc.ErrHostNotFound, err)
+	}
+
+	if _, err := c.GetServiceProblems(ctx, "Disk /var"); err != nil {
+		t.Errorf("GetServiceProblems failed: %v", err)
+	}
+	summary, err := c.GetSummary(ctx, 3)
+	if err != nil || len(summary.NoisiestHosts) > 3 {
+		t.Errorf("GetSummary failed: %v", err)
+	}
+	if _, err := c.GetEvents(ctx, time.Time{}); err != nil {
+		t.Errorf("GetEvents failed: %v", err)
+	}
+	if _, err := c.DiffSnapshots(ctx, time.Now(), time.Time{}); err != nil {
+		t.Errorf("DiffSnapshots failed: %v", err)
+	}
+	if _, err := c.GetAvailabilityReport(ctx, time.Now().Add(-time.Hour), time.Now()); err != nil {
+		t.Errorf("GetAvailabilityReport failed: %v", err)
+	}
+
+	if atomic.LoadInt32(&authorized) == 0 {
+		t.Error("The auth header wasn't sent")
+	}
+}
+
+func TestFilterQuery(t *testing.T) {
+	query := filterQuery(svc.Filter{States: []string{"CRITICAL", "WARNING"}, Labels: []string{"tag/prod", "os=linux"}})
+	if want, have := []string{"CRITICAL,WARNING"}, query["state"]; !reflect.DeepEqual(want, have) {
+		t.Errorf("Want states %v, have %v", want, have)
+	}
+	if want, have := []string{"tag/prod", "os=linux"}, query["label"]; !reflect.DeepEqual(want, have) {
+		t.Errorf("Want one label parameter per selector %v, have %v", want, have)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	srv := initServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Every other request fails
+			if atomic.AddInt32(&calls, 1)%2 == 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	ctx := context.Background()
+
+	c, _ := New(srv.URL)
+	_, err := c.GetHosts(ctx)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Want a 503 error without retries, have %v", err)
+	}
+
+	c, _ = New(srv.URL, WithRetries(2, time.Millisecond))
+	if _, err := c.GetHosts(ctx); err != nil {
+		t.Errorf("Want the retry to succeed, have %v", err)
+	}
+
+	// Client errors aren't retried
+	atomic.StoreInt32(&calls, 1)
+	if _, err := c.GetHost(ctx, "no-such-host"); err != svc.ErrHostNotFound {
+		t.Errorf("Want %v, have %v", svc.ErrHostNotFound, err)
+	}
+	if have := atomic.LoadInt32(&calls); have != 2 {
+		t.Errorf("Want 1 request, have %d", have-1)
+	}
+
+	// Neither is starting a refresh
+	atomic.StoreInt32(&calls, 0)
+	if _, err := c.RefreshNagiosData(ctx); err == nil {
+		t.Error("Want the refresh to fail without retries")
+	}
+	if have := atomic.LoadInt32(&calls); have != 1 {
+		t.Errorf("Want 1 refresh request, have %d", have)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL, WithTimeout(50*time.Millisecond))
+	start := time.Now()
+	if _, err := c.GetHosts(context.Background()); err == nil {
+		t.Error("Want a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("The request wasn't cut short, took %v", elapsed)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+// runDiff compares two nagios status files and prints the changes between them
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format, text or json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] before.dat after.dat\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	before, err := parser.ParseStatusFromFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	after, err := parser.ParseStatusFromFile(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse %s: %v\n", fs.Arg(1), err)
+		return 1
+	}
+	changes := parser.Diff(before, after)
+	switch *format {
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(changes)
+	case "text":
+		err = parser.WriteDiffText(os.Stdout, changes)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n", *format)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write diff: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -1,86 +1,53 @@
 package main
 
 import (
-	"flag"
-	"net/http"
+	"fmt"
 	"os"
-	"path/filepath"
-	"time"
-
-	"github.com/go-kit/kit/log"
-	kitprom "github.com/go-kit/kit/metrics/prometheus"
-	cache "github.com/patrickmn/go-cache"
-	stdprom "github.com/prometheus/client_golang/prometheus"
-	"github.com/tchaudhry91/nagiosagg/svc"
-	"golang.org/x/time/rate"
+	"strings"
 )
 
-func main() {
-	var (
-		httpAddr        = flag.String("http.addr", ":8080", "HTTP listen address")
-		nagiosStatusDir = flag.String("nagios_status_dir", "statuses", "Directory containing .dat files from nagios")
-		localDB         = flag.String("local_db", filepath.Join(os.TempDir(), "nagios.db"), "Filepath to store nagios status data in")
-		refreshTime     = flag.Int64("cache_expiration", 180, "Seconds to keep results cached")
-		rateLimiter     = flag.Int64("refresh_interval", 60, "Minimum seconds between processing refresh requests")
-	)
-	flag.Parse()
-	// Initialize Logger
-	var logger log.Logger
-	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		logger = log.With(logger, "caller", log.DefaultCaller)
-	}
+const usage = `Usage: %[1]s <command> [flags]
 
-	// Initialize in-mem cacher
-	cacher := cache.New(time.Duration(*refreshTime)*time.Second, time.Duration(*refreshTime)*time.Second)
+Commands:
+  serve     Run the aggregator server
+  issues    List the issues of a running aggregator
+  refresh   Refresh a running aggregator and print the report
+  hosts     List the hosts of a running aggregator, or show one host
+  watch     Keep the issue table of a running aggregator on screen
+  parse     Print the issues of local status files, exiting with the worst state
+  diff      Compare two nagios status files
 
-	// Initialize refresh rate limiter
-	limiter := rate.NewLimiter(rate.Every(time.Duration(*rateLimiter)*time.Second), 1)
+Run '%[1]s <command> -h' for the flags of a command.
+Without a command, or with flags only, the server is run as before.
+`
 
-	// Base Service
-	service, err := svc.NewNagiosParserSvc(*nagiosStatusDir, *localDB)
-	if err != nil {
-		logger.Log("err", err.Error())
-		panic("Failed to create service")
+func main() {
+	commands := map[string]func([]string) int{
+		"serve":   runServe,
+		"issues":  runIssues,
+		"refresh": runRefresh,
+		"hosts":   runHosts,
+		"watch":   runWatch,
+		"parse":   runParse,
+		"diff":    runDiff,
 	}
+	// Flags without a command keep starting the server, as deployments do
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") && !isHelp(os.Args[1]) {
+		os.Exit(runServe(os.Args[1:]))
+	}
+	if isHelp(os.Args[1]) || os.Args[1] == "help" {
+		fmt.Fprintf(os.Stdout, usage, os.Args[0])
+		os.Exit(0)
+	}
+	run, found := commands[os.Args[1]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	os.Exit(run(os.Args[2:]))
+}
 
-	// Initialize Prometheus Gatherers
-	fieldKeys := []string{"method", "err"}
-	requests := kitprom.NewCounterFrom(
-		stdprom.CounterOpts{
-			Namespace: "nagios_svc",
-			Name:      "requests_count",
-			Help:      "Total Endpoints Requested",
-		},
-		fieldKeys,
-	)
-	requestDuration := kitprom.NewSummaryFrom(
-		stdprom.SummaryOpts{
-			Namespace: "nagios_svc",
-			Name:      "request_duration",
-			Help:      "Time taken per request",
-		},
-		fieldKeys,
-	)
-	numHosts := kitprom.NewSummaryFrom(
-		stdprom.SummaryOpts{
-			Namespace: "nagios_svc",
-			Name:      "num_hosts",
-			Help:      "Number of hosts found with issues",
-		},
-		fieldKeys,
-	)
-
-	// Middlewares
-
-	service = svc.InstrumentingMiddleware(requests, requestDuration, numHosts)(service)
-	service = svc.CachingMiddleware(cacher)(service)
-	service = svc.LoggingMiddleware(logger)(service)
-
-	// Initialize router
-	r := svc.MakeHTTPHandler(service, cacher, limiter)
-
-	http.ListenAndServe(*httpAddr, r)
-
+func isHelp(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
 }
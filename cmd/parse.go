@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+const outputCSV = "csv"
+
+// Exit codes of parse, following the nagios plugin convention so that it can run as a check
+const (
+	exitOK       = 0
+	exitWarning  = 1
+	exitCritical = 2
+	exitUnknown  = 3
+)
+
+// stdinInstance is the instance name of statuses read from stdin
+const stdinInstance = "stdin"
+
+// parsedIssue is an issue of a status file, with the raw nagios values when asked for
+type parsedIssue struct {
+	svc.Issue
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// exitCode maps the worst state found to the exit code of a nagios check
+func exitCode(state string) int {
+	switch state {
+	case "OK":
+		return exitOK
+	case "WARNING":
+		return exitWarning
+	case "CRITICAL", "DOWN", "UNREACHABLE":
+		return exitCritical
+	default:
+		return exitUnknown
+	}
+}
+
+// worse reports whether state a is worse than state b. UNKNOWN ranks between WARNING and CRITICAL
+func worse(a, b string) bool {
+	rank := map[int]int{exitOK: 0, exitWarning: 1, exitUnknown: 2, exitCritical: 3}
+	return rank[exitCode(a)] > rank[exitCode(b)]
+}
+
+// readStatuses parses the host and service statuses of a file, "-" reads stdin. The instance is named after
+// the file and the statuses are enriched with the objects.cache next to it and the label rules, like the service does
+func readStatuses(name string, rules []svc.LabelRule) ([]parser.NagiosStatus, error) {
+	var raw []byte
+	var err error
+	instance, statusFile := stdinInstance, ""
+	if name == "-" {
+		raw, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		raw, err = ioutil.ReadFile(name)
+		instance = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		statusFile = name
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := string(raw)
+	blocks, err := parser.ParseBlocks(&data)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []parser.NagiosStatus{}
+	for _, block := range blocks {
+		if _, found := block.Values["current_state"]; !found {
+			// Comments, downtimes and program status
+			continue
+		}
+		block.Instance = instance
+		statuses = append(statuses, block)
+	}
+	if err := svc.EnrichStatuses(statusFile, statuses, rules); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func sortedValues(values map[string]string) string {
+	pairs := make([]string, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func writeParsed(w io.Writer, output string, issues []parsedIssue, values bool) error {
+	if output == outputJSON {
+		return writeJSON(w, issues)
+	}
+	header := []string{"hostname", "instance", "service", "state", "attempts", "last_check", "last_state_changed", "output"}
+	if values {
+		header = append(header, "values")
+	}
+	format := formatTime
+	if output == outputCSV {
+		format = func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.Format(time.RFC3339)
+		}
+	}
+	rows := [][]string{}
+	for _, issue := range issues {
+		row := []string{
+			issue.Hostname, issue.Instance, issue.Service, issue.State, issue.Attempts,
+			format(issue.LastCheck), format(issue.LastStateChanged), issue.Output,
+		}
+		if values {
+			row = append(row, sortedValues(issue.Values))
+		}
+		rows = append(rows, row)
+	}
+	if output == outputCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+	return writeTable(w, header, rows)
+}
+
+// runParse prints the issues of local status files without a running aggregator. Issues are enriched like
+// a refresh does, except for the flap detection of the aggregator which needs the states of past refreshes.
+// It exits with the nagios check code of the worst state printed, and 3 (UNKNOWN) on errors
+func runParse(args []string) int {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	filterFlags := addFilterFlags(fs)
+	output := fs.String("output", outputTable, "Output format, table, json or csv")
+	all := fs.Bool("all", false, "Include OK hosts and services")
+	values := fs.Bool("values", false, "Include the raw nagios values")
+	labelsConfig := fs.String("labels.config", "", "YAML file with the rules splitting custom variables into labels, empty to only label the variables")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s parse [flags] [status.dat ...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Reads stdin when no file, or -, is given. The <instance>.objects.cache next to a file is joined when there is one\n")
+		fmt.Fprintf(fs.Output(), "Exits with 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN) for the worst state printed\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUnknown
+	}
+	switch *output {
+	case outputTable, outputJSON, outputCSV:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format: %s\n", *output)
+		return exitUnknown
+	}
+	filter, err := filterFlags.filter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid filter: %v\n", err)
+		return exitUnknown
+	}
+	var rules []svc.LabelRule
+	if *labelsConfig != "" {
+		if rules, err = svc.LoadLabelRules(*labelsConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load the label rules: %v\n", err)
+			return exitUnknown
+		}
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	statuses := []parser.NagiosStatus{}
+	for _, file := range files {
+		fileStatuses, err := readStatuses(file, rules)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse %s: %v\n", file, err)
+			return exitUnknown
+		}
+		statuses = append(statuses, fileStatuses...)
+	}
+	// Problems are attributed to the down hosts of their instance, for the suppressed filter
+	svc.CorrelateHostDown(statuses)
+	now := time.Now()
+	issues := []parsedIssue{}
+	worst := "OK"
+	for _, status := range statuses {
+		if status.State == "OK" && !*all || !filter.Match(status, now) {
+			continue
+		}
+		issue := parsedIssue{Issue: svc.NewIssue(status)}
+		if *values {
+			issue.Values = status.Values
+		}
+		issues = append(issues, issue)
+		if worse(status.State, worst) {
+			worst = status.State
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool { return issueLess(issues[i].Issue, issues[j].Issue) })
+	if err := writeParsed(os.Stdout, *output, issues, *values); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write issues: %v\n", err)
+		return exitUnknown
+	}
+	return exitCode(worst)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tchaudhry91/nagiosagg/internal/testutil"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+const samplesDir = "../samples/public"
+
+func TestExitCode(t *testing.T) {
+	for state, want := range map[string]int{
+		"OK": exitOK, "WARNING": exitWarning, "CRITICAL": exitCritical, "DOWN": exitCritical,
+		"UNREACHABLE": exitCritical, "UNKNOWN": exitUnknown, "": exitUnknown,
+	} {
+		if have := exitCode(state); have != want {
+			t.Errorf("%s: want %d, have %d", state, want, have)
+		}
+	}
+}
+
+func TestWorse(t *testing.T) {
+	// From the best to the worst state
+	states := []string{"OK", "WARNING", "UNKNOWN", "CRITICAL"}
+	for i, a := range states {
+		for j, b := range states {
+			if have := worse(a, b); have != (i > j) {
+				t.Errorf("worse(%s, %s): want %v", a, b, i > j)
+			}
+		}
+	}
+	if worse("DOWN", "CRITICAL") || worse("CRITICAL", "UNREACHABLE") {
+		t.Error("Want host problems as bad as CRITICAL")
+	}
+}
+
+// parse runs the parse command and returns its exit code and the issues printed as JSON
+func parse(t *testing.T, args ...string) (int, []svc.Issue) {
+	out, err := ioutil.TempFile("", "parse-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code := runParse(append([]string{"-output", "json"}, args...))
+	os.Stdout = stdout
+	out.Seek(0, 0)
+	issues := []svc.Issue{}
+	if err := json.NewDecoder(out).Decode(&issues); err != nil && code != exitUnknown {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return code, issues
+}
+
+func TestRunParse(t *testing.T) {
+	random3 := filepath.Join(samplesDir, "random3.dat")
+	if code, issues := parse(t, random3); code != exitCritical || len(issues) != 2 || issues[0].Instance != "random3" {
+		t.Errorf("Want the 2 CRITICAL problems of random3, have %d: %+v", code, issues)
+	}
+	if code, issues := parse(t, filepath.Join(samplesDir, "random1.dat")); code != exitOK || len(issues) != 0 {
+		t.Errorf("Want no problems in random1, have %d: %+v", code, issues)
+	}
+	// The exit code is the one of the issues printed
+	if code, issues := parse(t, "-state", "WARNING", random3); code != exitOK || len(issues) != 0 {
+		t.Errorf("Want no WARNING problems, have %d: %+v", code, issues)
+	}
+	if code, _ := parse(t, filepath.Join(samplesDir, "missing.dat")); code != exitUnknown {
+		t.Errorf("Want UNKNOWN for a missing file, have %d", code)
+	}
+
+	// Groups, contacts and labels come from the objects.cache next to the file and the label rules
+	dir := testutil.TempDir(t)
+	statusFile := filepath.Join(dir, "nagios.dat")
+	testutil.CopyStatusFile(t, random3, statusFile)
+	objects := `define host {
+	host_name	localhost
+	hostgroups	linux
+	}
+
+define service {
+	host_name	localhost
+	service_description	SSH
+	contacts	alice
+	_TAGS	prod web
+	}
+`
+	ioutil.WriteFile(filepath.Join(dir, "nagios"+svc.ObjectsSuffix), []byte(objects), 0644)
+	labels := filepath.Join(dir, "labels.yaml")
+	ioutil.WriteFile(labels, []byte("rules:\n  - var: TAGS\n    prefix: tag/\n"), 0644)
+	for _, args := range [][]string{{"-hostgroup", "linux"}, {"-contact", "alice"}, {"-label", "tag/prod", "-labels.config", labels}} {
+		code, issues := parse(t, append(args, statusFile)...)
+		if code != exitCritical || len(issues) != 1 || issues[0].Hostname != "localhost" || issues[0].Service != "SSH" {
+			t.Errorf("%v: want the SSH problem of localhost, have %d: %+v", args, code, issues)
+		}
+	}
+
+	// Problems caused by a down host can be left out
+	down := filepath.Join(dir, "down.dat")
+	ioutil.WriteFile(down, []byte(`hoststatus {
+	host_name=router1
+	current_state=1
+	}
+
+servicestatus {
+	host_name=router1
+	service_description=HTTP
+	current_state=2
+	}
+`), 0644)
+	if code, issues := parse(t, "-suppressed=false", down); code != exitCritical || len(issues) != 1 || issues[0].Service != "" {
+		t.Errorf("Want the DOWN host only, have %d: %+v", code, issues)
+	}
+	if code, issues := parse(t, "-suppressed", down); code != exitCritical || len(issues) != 1 || issues[0].SuppressedBy != "router1" {
+		t.Errorf("Want the HTTP problem caused by the host, have %d: %+v", code, issues)
+	}
+}
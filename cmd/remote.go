@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/client"
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// Output formats of the client commands
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// remoteFlags are the flags of the commands talking to a running aggregator
+type remoteFlags struct {
+	addr    string
+	token   string
+	timeout time.Duration
+	retries int
+	output  string
+}
+
+func addRemoteFlags(fs *flag.FlagSet) *remoteFlags {
+	f := &remoteFlags{}
+	addr := os.Getenv("NAGIOSAGG_ADDR")
+	if addr == "" {
+		addr = "http://localhost:8080"
+	}
+	fs.StringVar(&f.addr, "addr", addr, "Address of the aggregator, defaults to $NAGIOSAGG_ADDR")
+	fs.StringVar(&f.token, "token", os.Getenv("NAGIOSAGG_TOKEN"), "Bearer token sent to the aggregator, defaults to $NAGIOSAGG_TOKEN")
+	fs.DurationVar(&f.timeout, "timeout", client.DefaultTimeout, "Timeout of each request")
+	fs.IntVar(&f.retries, "retries", 2, "Number of retries of requests failing with network or server errors")
+	fs.StringVar(&f.output, "output", outputTable, "Output format, table or json")
+	return f
+}
+
+func (f *remoteFlags) client() (svc.NagiosParserSvc, error) {
+	if f.output != outputTable && f.output != outputJSON {
+		return nil, fmt.Errorf("unknown output format: %s", f.output)
+	}
+	options := []client.Option{
+		client.WithTimeout(f.timeout),
+		client.WithRetries(f.retries, client.DefaultBackoff),
+	}
+	if f.token != "" {
+		options = append(options, client.WithBearerToken(f.token))
+	}
+	return client.New(f.addr, options...)
+}
+
+// optionalBool is a boolean flag that is unset unless given
+type optionalBool struct {
+	value *bool
+}
+
+func (b *optionalBool) String() string {
+	if b == nil || b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.value)
+}
+
+func (b *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value = &v
+	return nil
+}
+
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+// filterFlags are the issue filter flags, named like the query parameters of /nagios
+type filterFlags struct {
+	states        string
+	host          string
+	service       string
+	instances     string
+	hostGroups    string
+	serviceGroups string
+	contacts      string
+	labels        string
+	acknowledged  optionalBool
+	inDowntime    optionalBool
+	flapping      optionalBool
+	suppressed    optionalBool
+	stateType     string
+	minDuration   time.Duration
+}
+
+func addFilterFlags(fs *flag.FlagSet) *filterFlags {
+	f := &filterFlags{}
+	fs.StringVar(&f.states, "state", "", "Comma separated states to select, e.g. CRITICAL,WARNING")
+	fs.StringVar(&f.host, "host", "", "Hostname glob pattern, or a regular expression enclosed in slashes")
+	fs.StringVar(&f.service, "service", "", "Service glob pattern, or a regular expression enclosed in slashes")
+	fs.StringVar(&f.instances, "instance", "", "Comma separated nagios instances to select")
+	fs.StringVar(&f.hostGroups, "hostgroup", "", "Comma separated host groups to select")
+	fs.StringVar(&f.serviceGroups, "servicegroup", "", "Comma separated service groups to select")
+	fs.StringVar(&f.contacts, "contact", "", "Comma separated contacts to select")
+	fs.StringVar(&f.labels, "label", "", "Comma separated label selectors that must all match, key=value or key")
+	fs.Var(&f.acknowledged, "acknowledged", "Only acknowledged problems, or unacknowledged ones with -acknowledged=false")
+	fs.Var(&f.inDowntime, "in_downtime", "Only problems in downtime, or not in downtime with -in_downtime=false")
+	fs.Var(&f.flapping, "flapping", "Only flapping problems, or stable ones with -flapping=false")
+	fs.Var(&f.suppressed, "suppressed", "Only problems caused by a down host, or the others with -suppressed=false")
+	fs.StringVar(&f.stateType, "state_type", "", "hard or soft")
+	fs.DurationVar(&f.minDuration, "min_duration", 0, "Only problems in their state for at least this long")
+	return f
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (f *filterFlags) filter() (svc.Filter, error) {
+	filter := svc.Filter{
+		States:        splitList(f.states),
+		Host:          f.host,
+		Service:       f.service,
+		Instances:     splitList(f.instances),
+		HostGroups:    splitList(f.hostGroups),
+		ServiceGroups: splitList(f.serviceGroups),
+		Contacts:      splitList(f.contacts),
+		Labels:        splitList(f.labels),
+		Acknowledged:  f.acknowledged.value,
+		InDowntime:    f.inDowntime.value,
+		Flapping:      f.flapping.value,
+		Suppressed:    f.suppressed.value,
+		StateType:     f.stateType,
+		MinDuration:   f.minDuration,
+	}
+	return filter, filter.Compile()
+}
+
+// signalContext returns a context cancelled on interrupt
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeTable(w io.Writer, header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// issueLess orders issues by hostname, instance and service
+func issueLess(a, b svc.Issue) bool {
+	if a.Hostname != b.Hostname {
+		return a.Hostname < b.Hostname
+	}
+	if a.Instance != b.Instance {
+		return a.Instance < b.Instance
+	}
+	return a.Service < b.Service
+}
+
+func sortIssues(issues []svc.Issue) {
+	sort.SliceStable(issues, func(i, j int) bool { return issueLess(issues[i], issues[j]) })
+}
+
+// writeIssues renders the issues. Check times are left out of tables so that watch only redraws on changes
+func writeIssues(w io.Writer, output string, issues []svc.Issue) error {
+	if output == outputJSON {
+		return writeJSON(w, issues)
+	}
+	rows := [][]string{}
+	for _, issue := range issues {
+		rows = append(rows, []string{
+			issue.Hostname, issue.Instance, issue.Service, issue.State, issue.Attempts,
+			formatTime(issue.LastStateChanged), issue.Output,
+		})
+	}
+	return writeTable(w, []string{"hostname", "instance", "service", "state", "attempts", "since", "output"}, rows)
+}
+
+func fetchIssues(ctx context.Context, nagios svc.NagiosParserSvc, filter svc.Filter) ([]svc.Issue, error) {
+	data, err := nagios.GetParsedNagios(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	issues := svc.FlattenIssues(data)
+	sortIssues(issues)
+	return issues, nil
+}
+
+// runIssues lists the issues of a running aggregator matching the filter flags
+func runIssues(args []string) int {
+	fs := flag.NewFlagSet("issues", flag.ExitOnError)
+	remote := addRemoteFlags(fs)
+	filterFlags := addFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s issues [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	filter, err := filterFlags.filter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid filter: %v\n", err)
+		return 2
+	}
+	nagios, err := remote.client()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	issues, err := fetchIssues(ctx, nagios, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get issues: %v\n", err)
+		return 1
+	}
+	if err := writeIssues(os.Stdout, remote.output, issues); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write issues: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runRefresh refreshes a running aggregator and prints the report once the refresh has finished
+func runRefresh(args []string) int {
+	fs := flag.NewFlagSet("refresh", flag.ExitOnError)
+	remote := addRemoteFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s refresh [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	nagios, err := remote.client()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	report, err := nagios.RefreshNagiosData(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to refresh: %v\n", err)
+		return 1
+	}
+	if remote.output == outputJSON {
+		err = writeJSON(os.Stdout, report)
+	} else {
+		err = writeTable(os.Stdout, []string{"refreshed_at", "sources", "hosts", "problems", "events"}, [][]string{{
+			formatTime(report.RefreshedAt), strconv.Itoa(report.Sources), strconv.Itoa(report.Hosts),
+			strconv.Itoa(report.Problems), strconv.Itoa(report.NumEvents),
+		}})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write report: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// hostDetail is a host as returned by GET /hosts/{host}
+type hostDetail struct {
+	Hostname     string         `json:"hostname"`
+	HostStatuses []svc.Issue    `json:"host_statuses"`
+	Problems     []svc.Issue    `json:"problems"`
+	Comments     []svc.Comment  `json:"comments"`
+	Downtimes    []svc.Downtime `json:"downtimes"`
+}
+
+func writeHost(w io.Writer, output string, host svc.HostDetail) error {
+	detail := hostDetail{
+		Hostname:     host.Hostname,
+		HostStatuses: svc.FlattenIssues(map[string][]parser.NagiosStatus{host.Hostname: host.HostStatuses}),
+		Problems:     svc.FlattenIssues(map[string][]parser.NagiosStatus{host.Hostname: host.Problems}),
+		Comments:     host.Comments,
+		Downtimes:    host.Downtimes,
+	}
+	if output == outputJSON {
+		return writeJSON(w, detail)
+	}
+	fmt.Fprintf(w, "Host %s\n\n", host.Hostname)
+	rows := [][]string{}
+	for _, s := range detail.HostStatuses {
+		rows = append(rows, []string{s.Instance, s.State, s.Attempts, formatTime(s.LastCheck), s.Output})
+	}
+	if err := writeTable(w, []string{"instance", "state", "attempts", "last_check", "output"}, rows); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nProblems\n\n")
+	sortIssues(detail.Problems)
+	if err := writeIssues(w, outputTable, detail.Problems); err != nil {
+		return err
+	}
+	if len(host.Comments) > 0 {
+		fmt.Fprintf(w, "\nComments\n\n")
+		rows = [][]string{}
+		for _, c := range host.Comments {
+			rows = append(rows, []string{c.Instance, c.Service, c.Author, formatTime(c.EntryTime), c.Text})
+		}
+		if err := writeTable(w, []string{"instance", "service", "author", "entry_time", "text"}, rows); err != nil {
+			return err
+		}
+	}
+	if len(host.Downtimes) > 0 {
+		fmt.Fprintf(w, "\nDowntimes\n\n")
+		rows = [][]string{}
+		for _, d := range host.Downtimes {
+			rows = append(rows, []string{d.Instance, d.Service, d.Author, formatTime(d.StartTime), formatTime(d.EndTime), d.Comment})
+		}
+		if err := writeTable(w, []string{"instance", "service", "author", "start", "end", "comment"}, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHosts(w io.Writer, output string, hosts []svc.HostSummary) error {
+	if output == outputJSON {
+		return writeJSON(w, hosts)
+	}
+	rows := [][]string{}
+	for _, h := range hosts {
+		state := h.State
+		if state == "" {
+			state = "-"
+		}
+		rows = append(rows, []string{h.Hostname, state, strconv.Itoa(h.Problems), strings.Join(h.Instances, ",")})
+	}
+	return writeTable(w, []string{"hostname", "state", "problems", "instances"}, rows)
+}
+
+// runHosts lists the hosts of a running aggregator, or shows everything known about one host
+func runHosts(args []string) int {
+	fs := flag.NewFlagSet("hosts", flag.ExitOnError)
+	remote := addRemoteFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s hosts [flags] [hostname]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	nagios, err := remote.client()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	if fs.NArg() == 0 {
+		var hosts []svc.HostSummary
+		hosts, err = nagios.GetHosts(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get hosts: %v\n", err)
+			return 1
+		}
+		err = writeHosts(os.Stdout, remote.output, hosts)
+	} else {
+		var host svc.HostDetail
+		host, err = nagios.GetHost(ctx, fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get host %s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+		err = writeHost(os.Stdout, remote.output, host)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write hosts: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runWatch polls a running aggregator and redraws the issue table whenever it changes
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	remote := addRemoteFlags(fs)
+	filterFlags := addFilterFlags(fs)
+	interval := fs.Duration("interval", 10*time.Second, "Time between polls")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s watch [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *interval <= 0 {
+		fs.Usage()
+		return 2
+	}
+	filter, err := filterFlags.filter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid filter: %v\n", err)
+		return 2
+	}
+	nagios, err := remote.client()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		issues, err := fetchIssues(ctx, nagios, filter)
+		switch {
+		case ctx.Err() != nil:
+			return 0
+		case err != nil:
+			// Keep the last table on screen, the aggregator may be restarting
+			fmt.Fprintf(os.Stderr, "Failed to get issues: %v\n", err)
+		default:
+			var buf bytes.Buffer
+			writeIssues(&buf, remote.output, issues)
+			if !bytes.Equal(buf.Bytes(), last) {
+				last = buf.Bytes()
+				if remote.output == outputTable {
+					// Clear the terminal
+					fmt.Fprint(os.Stdout, "\033[H\033[2J")
+					fmt.Fprintf(os.Stdout, "%s  %d issues, updated %s\n\n", remote.addr, len(issues), formatTime(time.Now()))
+				}
+				os.Stdout.Write(last)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
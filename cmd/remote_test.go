@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"github.com/tchaudhry91/nagiosagg/internal/testutil"
+	"github.com/tchaudhry91/nagiosagg/svc"
+	"golang.org/x/time/rate"
+)
+
+// aggregator serves the CRITICAL problems of random3 and records the queries of the requests to /nagios
+type aggregator struct {
+	*httptest.Server
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+func (a *aggregator) lastQuery() url.Values {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.queries) == 0 {
+		return nil
+	}
+	return a.queries[len(a.queries)-1]
+}
+
+func newAggregator(t *testing.T) *aggregator {
+	dir := testutil.TempDir(t)
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random3.dat"), filepath.Join(dir, "nagios.dat"))
+	service, err := svc.NewNagiosParserSvc(dir, filepath.Join(dir, "nagios.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := svc.MakeHTTPHandler(service, cache.New(time.Minute, time.Minute), svc.NewRefreshJobs(service, rate.NewLimiter(rate.Inf, 1)),
+		svc.NewEventBroker(svc.DefaultReplaySize), false)
+	a := &aggregator{}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nagios" {
+			a.mu.Lock()
+			a.queries = append(a.queries, r.URL.Query())
+			a.mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(a.Close)
+	return a
+}
+
+// capture runs a command and returns its exit code and what it printed
+func capture(t *testing.T, run func([]string) int, args ...string) (int, string) {
+	out, err := ioutil.TempFile(testutil.TempDir(t), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code := run(args)
+	os.Stdout = stdout
+	printed, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, string(printed)
+}
+
+func TestOptionalBool(t *testing.T) {
+	var b optionalBool
+	if b.value != nil || b.String() != "" {
+		t.Errorf("Want an unset flag, have %q", b.String())
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(&b, "flapping", "")
+	if err := fs.Parse([]string{"-flapping"}); err != nil || b.value == nil || !*b.value {
+		t.Errorf("Want -flapping to be true, have %q (%v)", b.String(), err)
+	}
+	if err := fs.Parse([]string{"-flapping=false"}); err != nil || b.value == nil || *b.value {
+		t.Errorf("Want -flapping=false to be false, have %q (%v)", b.String(), err)
+	}
+	if err := fs.Parse([]string{"-flapping=maybe"}); err == nil {
+		t.Error("Want an error for an invalid boolean")
+	}
+}
+
+func TestFilterFlags(t *testing.T) {
+	parse := func(args ...string) (svc.Filter, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := addFilterFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return f.filter()
+	}
+	filter, err := parse("-state", "CRITICAL, WARNING", "-host", "web*", "-instance", "a,,b", "-label", "team=ops,tag/prod",
+		"-suppressed=false", "-min_duration", "5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filter.States, []string{"CRITICAL", "WARNING"}) || !reflect.DeepEqual(filter.Instances, []string{"a", "b"}) ||
+		!reflect.DeepEqual(filter.Labels, []string{"team=ops", "tag/prod"}) || filter.Host != "web*" || filter.MinDuration != 5*time.Minute {
+		t.Errorf("Unexpected filter: %+v", filter)
+	}
+	if filter.Suppressed == nil || *filter.Suppressed || filter.Acknowledged != nil || filter.Flapping != nil {
+		t.Errorf("Want only suppressed set, to false: %+v", filter)
+	}
+	if _, err := parse("-host", "/[/"); err == nil {
+		t.Error("Want an error for an invalid host pattern")
+	}
+}
+
+func TestRemoteCommands(t *testing.T) {
+	a := newAggregator(t)
+	remote := []string{"-addr", a.URL, "-retries", "0"}
+
+	code, out := capture(t, runRefresh, append(remote, "-output", "json")...)
+	var report svc.RefreshReport
+	if err := json.Unmarshal([]byte(out), &report); code != 0 || err != nil || report.Problems != 2 {
+		t.Fatalf("Want a report of the 2 problems, have %d: %s (%v)", code, out, err)
+	}
+
+	code, out = capture(t, runIssues, append(remote, "-output", "json")...)
+	issues := []svc.Issue{}
+	if err := json.Unmarshal([]byte(out), &issues); code != 0 || err != nil || len(issues) != 2 {
+		t.Errorf("Want the 2 issues, have %d: %s (%v)", code, out, err)
+	}
+	// The filter flags are sent as the query parameters of /nagios
+	code, out = capture(t, runIssues, append(remote, "-output", "json", "-host", "localhost", "-state", "CRITICAL", "-acknowledged=false")...)
+	issues = []svc.Issue{}
+	if err := json.Unmarshal([]byte(out), &issues); code != 0 || err != nil || len(issues) != 1 || issues[0].Hostname != "localhost" {
+		t.Errorf("Want the issue of localhost, have %d: %s (%v)", code, out, err)
+	}
+	query := a.lastQuery()
+	if query.Get("host") != "localhost" || query.Get("state") != "CRITICAL" || query.Get("acknowledged") != "false" {
+		t.Errorf("Unexpected query: %v", query)
+	}
+	code, out = capture(t, runIssues, remote...)
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); code != 0 || len(lines) != 3 || !strings.HasPrefix(lines[0], "HOSTNAME") {
+		t.Errorf("Want a table of the 2 issues, have %d:\n%s", code, out)
+	}
+	if code, _ := capture(t, runIssues, append(remote, "-host", "/[/")...); code != 2 {
+		t.Errorf("Want 2 for an invalid filter, have %d", code)
+	}
+	if code, _ := capture(t, runIssues, append(remote, "-output", "xml")...); code != 2 {
+		t.Errorf("Want 2 for an unknown output, have %d", code)
+	}
+
+	code, out = capture(t, runHosts, append(remote, "-output", "json")...)
+	hosts := []svc.HostSummary{}
+	if err := json.Unmarshal([]byte(out), &hosts); code != 0 || err != nil || len(hosts) == 0 {
+		t.Errorf("Want the hosts, have %d: %s (%v)", code, out, err)
+	}
+	code, out = capture(t, runHosts, append(remote, "-output", "json", "localhost")...)
+	var host hostDetail
+	if err := json.Unmarshal([]byte(out), &host); code != 0 || err != nil || host.Hostname != "localhost" || len(host.Problems) != 1 {
+		t.Errorf("Want the problem of localhost, have %d: %s (%v)", code, out, err)
+	}
+	if code, _ := capture(t, runHosts, append(remote, "missing")...); code != 1 {
+		t.Errorf("Want 1 for an unknown host, have %d", code)
+	}
+
+	// watch prints the issues until interrupted
+	watched, err := ioutil.TempFile(testutil.TempDir(t), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watched.Close()
+	stdout := os.Stdout
+	os.Stdout = watched
+	done := make(chan int)
+	go func() {
+		done <- runWatch(append(remote, "-output", "json", "-interval", "10ms"))
+	}()
+	testutil.WaitFor(t, "the issues to be watched", func() bool {
+		info, err := watched.Stat()
+		return err == nil && info.Size() > 0
+	})
+	p, _ := os.FindProcess(os.Getpid())
+	p.Signal(os.Interrupt)
+	code = <-done
+	os.Stdout = stdout
+	printed, _ := ioutil.ReadFile(watched.Name())
+	issues = []svc.Issue{}
+	// The issues don't change, so they are printed once
+	if err := json.Unmarshal(printed, &issues); code != 0 || err != nil || len(issues) != 2 {
+		t.Errorf("Want the 2 issues printed once, have %d: %s (%v)", code, printed, err)
+	}
+
+	a.Close()
+	if code, _ := capture(t, runRefresh, remote...); code != 1 {
+		t.Errorf("Want 1 without an aggregator, have %d", code)
+	}
+}
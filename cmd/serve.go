@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	kitprom "github.com/go-kit/kit/metrics/prometheus"
+	cache "github.com/patrickmn/go-cache"
+	stdprom "github.com/prometheus/client_golang/prometheus"
+	"github.com/tchaudhry91/nagiosagg/notify"
+	"github.com/tchaudhry91/nagiosagg/pb"
+	"github.com/tchaudhry91/nagiosagg/publish"
+	"github.com/tchaudhry91/nagiosagg/svc"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+)
+
+// runServe runs the aggregator server
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		httpAddr        = fs.String("http.addr", ":8080", "HTTP listen address")
+		grpcAddr        = fs.String("grpc.addr", ":8081", "gRPC listen address, empty to disable gRPC")
+		nagiosStatusDir = fs.String("nagios_status_dir", "statuses", "Directory containing .dat files from nagios")
+		localDB         = fs.String("local_db", filepath.Join(os.TempDir(), "nagios.db"), "Filepath to store nagios status data in")
+		refreshTime     = fs.Int64("cache_expiration", 180, "Seconds to keep results cached")
+		rateLimiter     = fs.Int64("refresh_interval", 60, "Minimum seconds between processing refresh requests")
+		legacyRefresh   = fs.Bool("legacy_refresh", false, "Also serve the deprecated synchronous GET /refresh")
+		streamReplay    = fs.Int("stream_replay", svc.DefaultReplaySize, "Number of recent events kept for resuming /stream clients")
+		streamHeartbeat = fs.Int64("stream_heartbeat", 15, "Seconds between heartbeats on idle /stream connections")
+		notifyConfig    = fs.String("notify.config", "", "YAML file configuring the notifications of issue transitions, empty to disable them")
+		flapWindow      = fs.Int("flap.window", svc.DefaultFlapWindow, "Number of refreshes flap detection looks back on")
+		flapStart       = fs.Float64("flap.start", svc.DefaultFlapStartThreshold, "Percentage of state changes within the window making an issue flap")
+		flapStop        = fs.Float64("flap.stop", svc.DefaultFlapStopThreshold, "Percentage of state changes within the window below which an issue stops flapping")
+		labelsConfig    = fs.String("labels.config", "", "YAML file with the rules splitting custom variables into labels, empty to only label the variables")
+		publishConfig   = fs.String("publish.config", "", "YAML file configuring the publishers of the refresh events, empty to disable them")
+	)
+	fs.Parse(args)
+	// Initialize Logger
+	var logger log.Logger
+	{
+		logger = log.NewLogfmtLogger(os.Stderr)
+		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(logger, "caller", log.DefaultCaller)
+	}
+
+	// Initialize in-mem cacher
+	cacher := cache.New(time.Duration(*refreshTime)*time.Second, time.Duration(*refreshTime)*time.Second)
+
+	// Initialize refresh rate limiter
+	limiter := rate.NewLimiter(rate.Every(time.Duration(*rateLimiter)*time.Second), 1)
+
+	// Base Service
+	flap := svc.FlapDetection{Window: *flapWindow, StartThreshold: *flapStart, StopThreshold: *flapStop}
+	var rules []svc.LabelRule
+	if *labelsConfig != "" {
+		var err error
+		if rules, err = svc.LoadLabelRules(*labelsConfig); err != nil {
+			logger.Log("component", "labels", "err", err.Error())
+			panic("Failed to load the label rules")
+		}
+	}
+	service, err := svc.NewNagiosParserSvc(*nagiosStatusDir, *localDB, svc.WithFlapDetection(flap), svc.WithLabelRules(rules))
+	if err != nil {
+		logger.Log("err", err.Error())
+		panic("Failed to create service")
+	}
+
+	// Initialize Prometheus Gatherers
+	fieldKeys := []string{"method", "err"}
+	requests := kitprom.NewCounterFrom(
+		stdprom.CounterOpts{
+			Namespace: "nagios_svc",
+			Name:      "requests_count",
+			Help:      "Total Endpoints Requested",
+		},
+		fieldKeys,
+	)
+	requestDuration := kitprom.NewSummaryFrom(
+		stdprom.SummaryOpts{
+			Namespace: "nagios_svc",
+			Name:      "request_duration",
+			Help:      "Time taken per request",
+		},
+		fieldKeys,
+	)
+	numHosts := kitprom.NewSummaryFrom(
+		stdprom.SummaryOpts{
+			Namespace: "nagios_svc",
+			Name:      "num_hosts",
+			Help:      "Number of hosts found with issues",
+		},
+		fieldKeys,
+	)
+
+	flapping := kitprom.NewGaugeFrom(
+		stdprom.GaugeOpts{
+			Namespace: "nagios_svc",
+			Name:      "flapping_issues",
+			Help:      "Number of flapping issues after the last refresh",
+		},
+		[]string{},
+	)
+
+	// Middlewares
+	broker := svc.NewEventBroker(*streamReplay)
+	svc.StreamHeartbeat = time.Duration(*streamHeartbeat) * time.Second
+	service = svc.InstrumentingMiddleware(requests, requestDuration, numHosts, flapping)(service)
+	service = svc.CachingMiddleware(cacher)(service)
+	// Refreshes are hooked outside of the cache, so that subscribers never read the views cached before the refresh
+	hooks := []svc.RefreshHook{broker.AfterRefresh}
+	if *notifyConfig != "" {
+		config, err := notify.LoadConfig(*notifyConfig)
+		if err != nil {
+			logger.Log("component", "notify", "err", err.Error())
+			panic("Failed to load the notification config")
+		}
+		dispatcher, err := notify.NewDispatcherFromConfig(config, *localDB, logger, notify.WithFlapWindow(flap.Window))
+		if err != nil {
+			logger.Log("component", "notify", "err", err.Error())
+			panic("Failed to create the notifiers")
+		}
+		go dispatcher.Run(context.Background())
+		hooks = append(hooks, dispatcher.AfterRefresh)
+	}
+	if *publishConfig != "" {
+		config, err := publish.LoadConfig(*publishConfig)
+		if err != nil {
+			logger.Log("component", "publish", "err", err.Error())
+			panic("Failed to load the publisher config")
+		}
+		bus, err := publish.NewBusFromConfig(config, logger)
+		if err != nil {
+			logger.Log("component", "publish", "err", err.Error())
+			panic("Failed to create the publishers")
+		}
+		go bus.Run(context.Background())
+		hooks = append(hooks, bus.AfterRefresh)
+	}
+	service = svc.AfterRefreshMiddleware(hooks...)(service)
+	service = svc.LoggingMiddleware(logger)(service)
+
+	// HTTP and gRPC share the refresh jobs, so that their refreshes are deduplicated and limited together
+	jobs := svc.NewRefreshJobs(service, limiter)
+
+	// Initialize gRPC server
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			logger.Log("transport", "gRPC", "err", err.Error())
+			panic("Failed to listen for gRPC")
+		}
+		server := grpc.NewServer()
+		pb.RegisterNagiosServer(server, svc.MakeGRPCServer(service, cacher, jobs, broker))
+		go func() {
+			logger.Log("transport", "gRPC", "err", server.Serve(lis))
+		}()
+	}
+
+	// Initialize router
+	r := svc.MakeHTTPHandler(service, cacher, jobs, broker, *legacyRefresh)
+
+	logger.Log("transport", "HTTP", "err", http.ListenAndServe(*httpAddr, r))
+	return 1
+}
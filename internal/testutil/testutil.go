@@ -0,0 +1,44 @@
+// Package testutil holds the helpers shared by the tests of the packages of nagiosagg
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// TempDir returns a temporary directory removed at the end of the test
+func TempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nagiosagg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// CopyStatusFile copies a status file, e.g. a sample, to the status dir of a test
+func CopyStatusFile(t *testing.T, from, to string) {
+	t.Helper()
+	raw, err := ioutil.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// WaitFor polls cond until it holds or the test times out
+func WaitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
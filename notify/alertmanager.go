@@ -0,0 +1,238 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// AlertmanagerConfig configures the forwarding of the issues to a Prometheus Alertmanager
+type AlertmanagerConfig struct {
+	// Name identifies the Alertmanager in the outbox
+	Name string `yaml:"name"`
+	// URL is the base URL of the Alertmanager, alerts are posted to URL/api/v2/alerts
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// Labels are added to every alert, e.g. to route them
+	Labels map[string]string `yaml:"labels"`
+	// GeneratorURL is the external URL of the aggregator, alerts link to its /hosts/{host} page
+	GeneratorURL string       `yaml:"generator_url"`
+	Filter       FilterConfig `yaml:"filter"`
+}
+
+// Alert is an alert of the Alertmanager v2 API
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     *time.Time        `json:"startsAt,omitempty"`
+	EndsAt       *time.Time        `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+type alertmanager struct {
+	config AlertmanagerConfig
+	filter svc.Filter
+	client *http.Client
+
+	mu sync.Mutex
+	// sent are the alerts sent as active by the previous refresh, by fingerprint
+	sent map[string]Alert
+}
+
+// NewAlertmanager returns a notifier posting every active issue as an alert to an Alertmanager after every refresh,
+// so that the alerts don't time out. Alerts of issues that are gone are sent once more with endsAt set
+func NewAlertmanager(config AlertmanagerConfig, opts ...Option) (Notifier, error) {
+	if config.Name == "" || config.URL == "" {
+		return nil, fmt.Errorf("alertmanager needs a name and a url")
+	}
+	filter, err := config.Filter.compile()
+	if err != nil {
+		return nil, fmt.Errorf("alertmanager %s: %v", config.Name, err)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	return withFlapDelay(config.Filter.DelayFlapping, opts, &alertmanager{
+		config: config,
+		filter: filter,
+		client: &http.Client{Timeout: config.Timeout},
+		sent:   make(map[string]Alert),
+	}), nil
+}
+
+func (a *alertmanager) Name() string {
+	return a.config.Name
+}
+
+// alertSeverity maps nagios states to the usual Alertmanager severities
+func alertSeverity(state string) string {
+	switch state {
+	case "CRITICAL", "DOWN", "UNREACHABLE":
+		return "critical"
+	case "WARNING":
+		return "warning"
+	default:
+		return strings.ToLower(state)
+	}
+}
+
+// alertName names host problems after their state, service problems after the service
+func alertName(status parser.NagiosStatus) string {
+	if status.Service != "" {
+		return status.Service
+	}
+	switch status.State {
+	case "DOWN":
+		return "HostDown"
+	case "UNREACHABLE":
+		return "HostUnreachable"
+	default:
+		return "Host"
+	}
+}
+
+// alert converts a nagios status to an active alert
+func (a *alertmanager) alert(status parser.NagiosStatus) Alert {
+	alert := Alert{
+		Labels:      make(map[string]string),
+		Annotations: make(map[string]string),
+	}
+	for key, value := range a.config.Labels {
+		alert.Labels[key] = value
+	}
+	alert.Labels["alertname"] = alertName(status)
+	alert.Labels["host"] = status.Hostname
+	alert.Labels["severity"] = alertSeverity(status.State)
+	if status.Instance != "" {
+		alert.Labels["instance"] = status.Instance
+	}
+	if output := status.Values["plugin_output"]; output != "" {
+		alert.Annotations["plugin_output"] = output
+	}
+	if output := status.Values["long_plugin_output"]; output != "" {
+		// status.dat escapes the line breaks of long outputs
+		alert.Annotations["long_plugin_output"] = strings.Replace(output, `\n`, "\n", -1)
+	}
+	if changed, err := strconv.ParseInt(status.Values["last_state_change"], 10, 64); err == nil && changed > 0 {
+		startsAt := time.Unix(changed, 0).UTC()
+		alert.StartsAt = &startsAt
+	}
+	if a.config.GeneratorURL != "" {
+		alert.GeneratorURL = strings.TrimSuffix(a.config.GeneratorURL, "/") + "/hosts/" + url.PathEscape(status.Hostname)
+	}
+	return alert
+}
+
+// fingerprint identifies an alert by its labels, like Alertmanager does
+func fingerprint(alert Alert) string {
+	pairs := make([]string, 0, len(alert.Labels))
+	for key, value := range alert.Labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
+
+// Messages returns a single message with every active alert and the alerts that ended since the previous refresh.
+// Alerts end when the issue resolves, or when it no longer matches the filter, e.g. after an acknowledgement
+// or a change of severity. After a restart the alerts sent before are only known from resolved events,
+// Alertmanager resolves the others once they are no longer sent. The message replaces the undelivered one
+// of a previous refresh, so that an outage of the Alertmanager doesn't replay stale alerts
+func (a *alertmanager) Messages(refresh Refresh) ([]Message, error) {
+	issues, err := refresh.Issues()
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]Alert)
+	for _, statuses := range issues {
+		for _, status := range statuses {
+			if a.filter.Match(status, refresh.Time) {
+				alert := a.alert(status)
+				active[fingerprint(alert)] = alert
+			}
+		}
+	}
+	endsAt := refresh.Time.UTC()
+	ended := make(map[string]Alert)
+	a.mu.Lock()
+	for fp, alert := range a.sent {
+		if _, found := active[fp]; !found {
+			alert.EndsAt = &endsAt
+			ended[fp] = alert
+		}
+	}
+	a.sent = active
+	a.mu.Unlock()
+	for _, e := range refresh.Events {
+		if e.Type != svc.EventResolved || !a.filter.MatchEvent(e, refresh.Time) {
+			continue
+		}
+		alert := a.alert(e.Status())
+		fp := fingerprint(alert)
+		if _, found := active[fp]; !found {
+			alert.EndsAt = &endsAt
+			ended[fp] = alert
+		}
+	}
+	if len(active)+len(ended) == 0 {
+		return nil, nil
+	}
+	alerts := make([]Alert, 0, len(active)+len(ended))
+	for _, group := range []map[string]Alert{active, ended} {
+		fps := make([]string, 0, len(group))
+		for fp := range group {
+			fps = append(fps, fp)
+		}
+		sort.Strings(fps)
+		for _, fp := range fps {
+			alerts = append(alerts, group[fp])
+		}
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return nil, err
+	}
+	return []Message{{Type: "alerts", Body: body, Replace: true}}, nil
+}
+
+// merge keeps the ended alerts of an undelivered message that the next one doesn't have, the active alerts
+// of the next message are current
+func (a *alertmanager) merge(queued, next Message) (Message, error) {
+	var old, alerts []Alert
+	if err := json.Unmarshal(queued.Body, &old); err != nil {
+		return next, err
+	}
+	if err := json.Unmarshal(next.Body, &alerts); err != nil {
+		return next, err
+	}
+	known := make(map[string]bool)
+	for _, alert := range alerts {
+		known[fingerprint(alert)] = true
+	}
+	for _, alert := range old {
+		if alert.EndsAt != nil && !known[fingerprint(alert)] {
+			alerts = append(alerts, alert)
+		}
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return next, err
+	}
+	next.Body = body
+	return next, nil
+}
+
+func (a *alertmanager) Deliver(ctx context.Context, msg Message) error {
+	return postJSON(ctx, a.client, strings.TrimSuffix(a.config.URL, "/")+"/api/v2/alerts", httpHeader(a.config.Headers), msg.Body)
+}
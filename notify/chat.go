@@ -0,0 +1,373 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// Chat message formats
+const (
+	FormatSlack = "slack"
+	FormatTeams = "teams"
+)
+
+// chatMaxGroups bounds the hosts rendered in a digest, chat services reject larger messages
+const chatMaxGroups = 40
+
+// chatMaxPending bounds the events kept for a digest, the oldest are dropped beyond it
+const chatMaxPending = 1000
+
+// DefaultImmediateStates are the states sent right away when a chat uses a digest
+var DefaultImmediateStates = []string{"CRITICAL", "DOWN"}
+
+// QuietHours is a daily time range without chat messages, e.g. 22:00 to 07:00
+type QuietHours struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Timezone is an IANA zone name, the local time zone by default
+	Timezone string `yaml:"timezone"`
+
+	start, end int
+	location   *time.Location
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *QuietHours) compile() error {
+	if q.Start == "" && q.End == "" {
+		return nil
+	}
+	var err error
+	if q.start, err = parseClock(q.Start); err != nil {
+		return err
+	}
+	if q.end, err = parseClock(q.End); err != nil {
+		return err
+	}
+	if q.start == q.end {
+		return fmt.Errorf("quiet hours start and end at %s", q.Start)
+	}
+	q.location = time.Local
+	if q.Timezone != "" {
+		if q.location, err = time.LoadLocation(q.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contains reports whether t falls into the quiet hours, ranges may wrap around midnight
+func (q QuietHours) contains(t time.Time) bool {
+	if q.location == nil {
+		return false
+	}
+	t = t.In(q.location)
+	minute := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// ChatConfig configures a Slack or Teams channel, through its incoming webhook URL
+type ChatConfig struct {
+	// Name identifies the channel in the outbox
+	Name    string        `yaml:"name"`
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Events are the event types to send, opened, escalated and resolved by default
+	Events []string `yaml:"events"`
+	// Filter selects the issues of the channel, e.g. with host and service patterns
+	Filter FilterConfig `yaml:"filter"`
+	// Digest batches the events into one message per interval. Events of the Immediate states,
+	// CRITICAL and DOWN by default, are still sent right away. Every event is sent right away without a digest
+	Digest    time.Duration `yaml:"digest"`
+	Immediate []string      `yaml:"immediate"`
+	// QuietHours hold back every message, the events are sent as a digest once they are over
+	QuietHours QuietHours `yaml:"quiet_hours"`
+}
+
+type chat struct {
+	config    ChatConfig
+	format    string
+	events    eventFilter
+	immediate map[string]bool
+	client    *http.Client
+
+	mu sync.Mutex
+	// pending are the events waiting for the next digest, dropped counts the older ones beyond chatMaxPending
+	pending    []svc.Event
+	dropped    int
+	lastDigest time.Time
+}
+
+// chatState is the state of a chat kept across restarts
+type chatState struct {
+	Pending    []svc.Event `json:"pending"`
+	Dropped    int         `json:"dropped,omitempty"`
+	LastDigest time.Time   `json:"last_digest"`
+}
+
+// NewChat returns a notifier posting the events to a Slack or Teams channel, rendered as
+// Block Kit or Adaptive Card messages
+func NewChat(format string, config ChatConfig, opts ...Option) (Notifier, error) {
+	if format != FormatSlack && format != FormatTeams {
+		return nil, fmt.Errorf("unknown chat format %q", format)
+	}
+	if config.Name == "" || config.URL == "" {
+		return nil, fmt.Errorf("%s needs a name and a url", format)
+	}
+	events, err := newEventFilter(config.Events, config.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", format, config.Name, err)
+	}
+	if err := config.QuietHours.compile(); err != nil {
+		return nil, fmt.Errorf("%s %s: %v", format, config.Name, err)
+	}
+	if config.Digest < 0 {
+		return nil, fmt.Errorf("%s %s: negative digest interval", format, config.Name)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	if len(config.Immediate) == 0 {
+		config.Immediate = DefaultImmediateStates
+	}
+	immediate := make(map[string]bool)
+	for _, state := range config.Immediate {
+		immediate[strings.ToUpper(state)] = true
+	}
+	return withFlapDelay(config.Filter.DelayFlapping, opts, &chat{
+		config:    config,
+		format:    format,
+		events:    events,
+		immediate: immediate,
+		client:    &http.Client{Timeout: config.Timeout},
+	}), nil
+}
+
+func (c *chat) Name() string {
+	return c.config.Name
+}
+
+// chatGroup are the lines about the issues of a host
+type chatGroup struct {
+	Title string
+	Lines []string
+}
+
+// eventLine describes an event in a line of a chat message
+func eventLine(e svc.Event) string {
+	subject := "host"
+	if e.Service != "" {
+		subject = e.Service
+	}
+	var line string
+	switch e.Type {
+	case svc.EventOpened:
+		line = fmt.Sprintf("%s is %s", subject, e.ToState)
+	case svc.EventResolved:
+		line = fmt.Sprintf("%s resolved, was %s", subject, e.FromState)
+	case svc.EventAcknowledged:
+		line = fmt.Sprintf("%s %s acknowledged", subject, e.ToState)
+	default:
+		line = fmt.Sprintf("%s %s -> %s", subject, e.FromState, e.ToState)
+	}
+	if e.Output != "" {
+		line += ": " + e.Output
+	}
+	return line
+}
+
+// groupEvents groups events by host, in host order and event order within a host
+func groupEvents(events []svc.Event) []chatGroup {
+	byHost := make(map[string]*chatGroup)
+	titles := []string{}
+	for _, e := range events {
+		title := e.Hostname
+		if e.Instance != "" {
+			title += " (" + e.Instance + ")"
+		}
+		group, found := byHost[title]
+		if !found {
+			group = &chatGroup{Title: title}
+			byHost[title] = group
+			titles = append(titles, title)
+		}
+		group.Lines = append(group.Lines, eventLine(e))
+	}
+	sort.Strings(titles)
+	groups := make([]chatGroup, 0, len(titles))
+	for _, title := range titles {
+		groups = append(groups, *byHost[title])
+	}
+	return groups
+}
+
+// Messages returns the immediate events as a message each, and a digest once its interval has passed.
+// Digests are only sent by refreshes, a digest is sent by the first refresh after its interval
+func (c *chat) Messages(refresh Refresh) ([]Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastDigest.IsZero() {
+		c.lastDigest = refresh.Time
+	}
+	quiet := c.config.QuietHours.contains(refresh.Time)
+	msgs := []Message{}
+	for _, e := range refresh.Events {
+		if !c.events.match(e, refresh.Time) {
+			continue
+		}
+		if quiet || (c.config.Digest > 0 && !c.immediate[e.Status().State]) {
+			if len(c.pending) >= chatMaxPending {
+				c.pending = c.pending[1:]
+				c.dropped++
+			}
+			c.pending = append(c.pending, e)
+			continue
+		}
+		msg, err := c.message("immediate", eventLine(e), groupEvents([]svc.Event{e}))
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if quiet || len(c.pending) == 0 || refresh.Time.Sub(c.lastDigest) < c.config.Digest {
+		return msgs, nil
+	}
+	title := fmt.Sprintf("%d nagios events since %s", len(c.pending)+c.dropped, c.lastDigest.In(refresh.Time.Location()).Format("15:04"))
+	if c.dropped > 0 {
+		title += fmt.Sprintf(", the oldest %d left out", c.dropped)
+	}
+	msg, err := c.message("digest", title, groupEvents(c.pending))
+	if err != nil {
+		return msgs, err
+	}
+	c.pending = nil
+	c.dropped = 0
+	c.lastDigest = refresh.Time
+	return append(msgs, msg), nil
+}
+
+func (c *chat) state() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(chatState{Pending: c.pending, Dropped: c.dropped, LastDigest: c.lastDigest})
+}
+
+func (c *chat) restore(state []byte) error {
+	var s chatState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending, c.dropped, c.lastDigest = s.Pending, s.Dropped, s.LastDigest
+	return nil
+}
+
+func (c *chat) message(msgType, title string, groups []chatGroup) (Message, error) {
+	var payload interface{}
+	if c.format == FormatSlack {
+		payload = slackPayload(title, groups)
+	} else {
+		payload = teamsPayload(title, groups)
+	}
+	body, err := json.Marshal(payload)
+	return Message{Type: msgType, Body: body}, err
+}
+
+// slackText is a text object of Block Kit
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+// slackPayload renders a Block Kit message with a section per host
+func slackPayload(title string, groups []chatGroup) interface{} {
+	blocks := []slackBlock{{Type: "header", Text: &slackText{Type: "plain_text", Text: truncate(title, 150)}}}
+	for i, group := range groups {
+		if i == chatMaxGroups {
+			more := fmt.Sprintf("and %d more hosts", len(groups)-i)
+			blocks = append(blocks, slackBlock{Type: "context", Elements: []slackText{{Type: "mrkdwn", Text: more}}})
+			break
+		}
+		text := "*" + group.Title + "*\n• " + strings.Join(group.Lines, "\n• ")
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: truncate(text, 3000)}})
+	}
+	return struct {
+		Text   string       `json:"text"`
+		Blocks []slackBlock `json:"blocks"`
+	}{title, blocks}
+}
+
+type teamsTextBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Weight string `json:"weight,omitempty"`
+	Size   string `json:"size,omitempty"`
+	Wrap   bool   `json:"wrap"`
+}
+
+type teamsAttachment struct {
+	ContentType string      `json:"contentType"`
+	Content     interface{} `json:"content"`
+}
+
+// teamsPayload renders an Adaptive Card message with a heading and a list per host
+func teamsPayload(title string, groups []chatGroup) interface{} {
+	body := []teamsTextBlock{{Type: "TextBlock", Text: title, Weight: "Bolder", Size: "Medium", Wrap: true}}
+	for i, group := range groups {
+		if i == chatMaxGroups {
+			body = append(body, teamsTextBlock{Type: "TextBlock", Text: fmt.Sprintf("and %d more hosts", len(groups)-i), Wrap: true})
+			break
+		}
+		body = append(body,
+			teamsTextBlock{Type: "TextBlock", Text: group.Title, Weight: "Bolder", Wrap: true},
+			teamsTextBlock{Type: "TextBlock", Text: "- " + strings.Join(group.Lines, "\n- "), Wrap: true},
+		)
+	}
+	card := struct {
+		Schema  string           `json:"$schema"`
+		Type    string           `json:"type"`
+		Version string           `json:"version"`
+		Body    []teamsTextBlock `json:"body"`
+	}{"http://adaptivecards.io/schemas/adaptive-card.json", "AdaptiveCard", "1.2", body}
+	return struct {
+		Type        string            `json:"type"`
+		Attachments []teamsAttachment `json:"attachments"`
+	}{"message", []teamsAttachment{{ContentType: "application/vnd.microsoft.card.adaptive", Content: card}}}
+}
+
+// truncate shortens s to at most n bytes, without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return cut(s, n-3) + "..."
+}
+
+func (c *chat) Deliver(ctx context.Context, msg Message) error {
+	return postJSON(ctx, c.client, c.config.URL, nil, msg.Body)
+}
@@ -0,0 +1,166 @@
+package notify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/tchaudhry91/nagiosagg/svc"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultEvents are the event types notified when a notifier doesn't list any
+var DefaultEvents = []string{svc.EventOpened, svc.EventEscalated, svc.EventResolved}
+
+// Config is the notification config file
+type Config struct {
+	Retry         RetryPolicy          `yaml:"retry"`
+	Webhooks      []WebhookConfig      `yaml:"webhooks"`
+	Alertmanagers []AlertmanagerConfig `yaml:"alertmanagers"`
+	PagerDuty     []PagerDutyConfig    `yaml:"pagerduty"`
+	Slack         []ChatConfig         `yaml:"slack"`
+	Teams         []ChatConfig         `yaml:"teams"`
+	Email         []EmailConfig        `yaml:"email"`
+}
+
+// FilterConfig selects the issues a notifier is told about, named like the query parameters of /nagios
+type FilterConfig struct {
+	States        []string      `yaml:"state"`
+	Host          string        `yaml:"host"`
+	Service       string        `yaml:"service"`
+	Instances     []string      `yaml:"instance"`
+	HostGroups    []string      `yaml:"hostgroup"`
+	ServiceGroups []string      `yaml:"servicegroup"`
+	Contacts      []string      `yaml:"contact"`
+	Labels        []string      `yaml:"label"`
+	Acknowledged  *bool         `yaml:"acknowledged"`
+	InDowntime    *bool         `yaml:"in_downtime"`
+	StateType     string        `yaml:"state_type"`
+	MinDuration   time.Duration `yaml:"min_duration"`
+	// Flapping false suppresses flapping issues, true only keeps them
+	Flapping *bool `yaml:"flapping"`
+	// Suppressed false leaves out the problems caused by a down host, so that only the host is notified about
+	Suppressed *bool `yaml:"suppressed"`
+	// DelayFlapping holds back the events of flapping issues until they stop flapping, and only sends the last one
+	DelayFlapping bool `yaml:"delay_flapping"`
+}
+
+func (c FilterConfig) compile() (svc.Filter, error) {
+	filter := svc.Filter{
+		States:        c.States,
+		Host:          c.Host,
+		Service:       c.Service,
+		Instances:     c.Instances,
+		HostGroups:    c.HostGroups,
+		ServiceGroups: c.ServiceGroups,
+		Contacts:      c.Contacts,
+		Labels:        c.Labels,
+		Acknowledged:  c.Acknowledged,
+		InDowntime:    c.InDowntime,
+		StateType:     c.StateType,
+		MinDuration:   c.MinDuration,
+		Flapping:      c.Flapping,
+		Suppressed:    c.Suppressed,
+	}
+	return filter, filter.Compile()
+}
+
+// eventFilter selects events by type and by the issue they are about
+type eventFilter struct {
+	types  map[string]bool
+	filter svc.Filter
+}
+
+func newEventFilter(types []string, config FilterConfig) (eventFilter, error) {
+	if len(types) == 0 {
+		types = DefaultEvents
+	}
+	f := eventFilter{types: make(map[string]bool)}
+	for _, t := range types {
+		switch t {
+		case svc.EventOpened, svc.EventEscalated, svc.EventDeEscalated, svc.EventResolved, svc.EventAcknowledged:
+			f.types[t] = true
+		default:
+			return f, fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	var err error
+	f.filter, err = config.compile()
+	return f, err
+}
+
+// match applies the filter to an event. Resolved events are matched against the state the issue was in
+func (f eventFilter) match(e svc.Event, now time.Time) bool {
+	return f.types[e.Type] && f.filter.MatchEvent(e, now)
+}
+
+// LoadConfig reads a YAML notification config file. Unknown fields are rejected to catch typos
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Notifiers returns the notifiers of the config
+func (c Config) Notifiers(opts ...Option) ([]Notifier, error) {
+	notifiers := []Notifier{}
+	names := make(map[string]bool)
+	add := func(n Notifier, err error) error {
+		if err != nil {
+			return err
+		}
+		if names[n.Name()] {
+			return fmt.Errorf("duplicate notifier name %q", n.Name())
+		}
+		names[n.Name()] = true
+		notifiers = append(notifiers, n)
+		return nil
+	}
+	for _, webhook := range c.Webhooks {
+		if err := add(NewWebhook(webhook, opts...)); err != nil {
+			return nil, err
+		}
+	}
+	for _, am := range c.Alertmanagers {
+		if err := add(NewAlertmanager(am, opts...)); err != nil {
+			return nil, err
+		}
+	}
+	for _, pd := range c.PagerDuty {
+		if err := add(NewPagerDuty(pd, opts...)); err != nil {
+			return nil, err
+		}
+	}
+	for _, slack := range c.Slack {
+		if err := add(NewChat(FormatSlack, slack, opts...)); err != nil {
+			return nil, err
+		}
+	}
+	for _, teams := range c.Teams {
+		if err := add(NewChat(FormatTeams, teams, opts...)); err != nil {
+			return nil, err
+		}
+	}
+	for _, email := range c.Email {
+		if err := add(NewEmail(email, opts...)); err != nil {
+			return nil, err
+		}
+	}
+	return notifiers, nil
+}
+
+// NewDispatcherFromConfig returns a dispatcher for the notifiers of the config, keeping its outbox in localDB
+func NewDispatcherFromConfig(config Config, localDB string, logger log.Logger, opts ...Option) (*Dispatcher, error) {
+	notifiers, err := config.Notifiers(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewDispatcher(localDB, config.Retry, logger, notifiers...), nil
+}
@@ -0,0 +1,660 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// Email TLS modes
+const (
+	TLSStartTLS = "starttls"
+	TLSNone     = "none"
+)
+
+// Digest schedules
+const (
+	ScheduleDaily  = "daily"
+	ScheduleWeekly = "weekly"
+)
+
+// DefaultSMTPPort is the submission port
+const DefaultSMTPPort = 587
+
+// digestMaxRows bounds every list of a digest email
+const digestMaxRows = 200
+
+// EmailRule sends the matching events to a list of recipients
+type EmailRule struct {
+	To []string `yaml:"to"`
+	// Events are the event types to send, opened, escalated and resolved by default
+	Events []string     `yaml:"events"`
+	Filter FilterConfig `yaml:"filter"`
+
+	events eventFilter
+}
+
+// EmailDigest is a scheduled email summarizing the problems of the last day or week
+type EmailDigest struct {
+	// Schedule is daily or weekly
+	Schedule string `yaml:"schedule"`
+	// At is the HH:MM time the digest is sent at, 08:00 by default
+	At string `yaml:"at"`
+	// Weekday is the day weekly digests are sent, monday by default
+	Weekday string `yaml:"weekday"`
+	// Timezone is an IANA zone name, the local time zone by default
+	Timezone string       `yaml:"timezone"`
+	To       []string     `yaml:"to"`
+	Filter   FilterConfig `yaml:"filter"`
+	// Top is the number of noisiest hosts listed, 10 by default
+	Top int `yaml:"top"`
+
+	filter   svc.Filter
+	at       int
+	weekday  time.Weekday
+	location *time.Location
+	// lastSent is the schedule time of the last digest
+	lastSent time.Time
+}
+
+// EmailConfig configures an SMTP server and the emails sent through it
+type EmailConfig struct {
+	// Name identifies the emails in the outbox
+	Name string `yaml:"name"`
+	Host string `yaml:"host"`
+	// Port defaults to DefaultSMTPPort
+	Port int `yaml:"port"`
+	// TLS is starttls, the default, or none
+	TLS                string        `yaml:"tls"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	From               string        `yaml:"from"`
+	Timeout            time.Duration `yaml:"timeout"`
+	// Rules select the recipients of the transition emails, a recipient of several matching rules gets one email
+	Rules   []EmailRule   `yaml:"rules"`
+	Digests []EmailDigest `yaml:"digests"`
+}
+
+// emailMessage is the body of a queued email, rendered as MIME on delivery
+type emailMessage struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Text    string   `json:"text"`
+	HTML    string   `json:"html"`
+}
+
+type email struct {
+	config EmailConfig
+
+	mu      sync.Mutex
+	digests []*EmailDigest
+}
+
+func (d *EmailDigest) compile() error {
+	switch d.Schedule {
+	case ScheduleDaily, ScheduleWeekly:
+	default:
+		return fmt.Errorf("unknown digest schedule %q, want daily or weekly", d.Schedule)
+	}
+	if len(d.To) == 0 {
+		return fmt.Errorf("digest needs recipients")
+	}
+	if d.At == "" {
+		d.At = "08:00"
+	}
+	var err error
+	if d.at, err = parseClock(d.At); err != nil {
+		return err
+	}
+	d.weekday = time.Monday
+	if d.Weekday != "" {
+		found := false
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if strings.EqualFold(d.Weekday, day.String()) {
+				d.weekday, found = day, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown weekday %q", d.Weekday)
+		}
+	}
+	d.location = time.Local
+	if d.Timezone != "" {
+		if d.location, err = time.LoadLocation(d.Timezone); err != nil {
+			return err
+		}
+	}
+	if d.Top <= 0 {
+		d.Top = 10
+	}
+	d.filter, err = d.Filter.compile()
+	return err
+}
+
+// due returns the last schedule time at or before now
+func (d *EmailDigest) due(now time.Time) time.Time {
+	t := now.In(d.location)
+	due := time.Date(t.Year(), t.Month(), t.Day(), d.at/60, d.at%60, 0, 0, d.location)
+	days := 1
+	if d.Schedule == ScheduleWeekly {
+		days = 7
+		due = due.AddDate(0, 0, -((int(due.Weekday()) - int(d.weekday) + 7) % 7))
+	}
+	if due.After(now) {
+		due = due.AddDate(0, 0, -days)
+	}
+	return due
+}
+
+// key identifies a digest in the stored state of the notifier
+func (d *EmailDigest) key() string {
+	return strings.Join([]string{d.Schedule, d.At, d.Weekday, d.Timezone, strings.Join(d.To, ",")}, "|")
+}
+
+// period returns the start of the period a digest due at a time reports on
+func (d *EmailDigest) period(due time.Time) time.Time {
+	if d.Schedule == ScheduleWeekly {
+		return due.AddDate(0, 0, -7)
+	}
+	return due.AddDate(0, 0, -1)
+}
+
+// NewEmail returns a notifier sending transition emails and scheduled digests through an SMTP server
+func NewEmail(config EmailConfig, opts ...Option) (Notifier, error) {
+	if config.Name == "" || config.Host == "" || config.From == "" {
+		return nil, fmt.Errorf("email needs a name, a host and a from address")
+	}
+	switch config.TLS {
+	case "":
+		config.TLS = TLSStartTLS
+	case TLSStartTLS, TLSNone:
+	default:
+		return nil, fmt.Errorf("email %s: unknown tls mode %q", config.Name, config.TLS)
+	}
+	if config.Port == 0 {
+		config.Port = DefaultSMTPPort
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	rules := make([]EmailRule, len(config.Rules))
+	for i, rule := range config.Rules {
+		if len(rule.To) == 0 {
+			return nil, fmt.Errorf("email %s: rule %d needs recipients", config.Name, i)
+		}
+		var err error
+		if rule.events, err = newEventFilter(rule.Events, rule.Filter); err != nil {
+			return nil, fmt.Errorf("email %s: rule %d: %v", config.Name, i, err)
+		}
+		rules[i] = rule
+	}
+	config.Rules = rules
+	// The events of the rules and the issues of the digests are delayed together, so they must agree
+	filters := []FilterConfig{}
+	for _, rule := range config.Rules {
+		filters = append(filters, rule.Filter)
+	}
+	for _, digest := range config.Digests {
+		filters = append(filters, digest.Filter)
+	}
+	delay := len(filters) > 0 && filters[0].DelayFlapping
+	for _, filter := range filters {
+		if filter.DelayFlapping != delay {
+			return nil, fmt.Errorf("email %s: delay_flapping must be set on every rule and digest or none", config.Name)
+		}
+	}
+	e := &email{config: config}
+	for i := range config.Digests {
+		digest := config.Digests[i]
+		if err := digest.compile(); err != nil {
+			return nil, fmt.Errorf("email %s: digest %d: %v", config.Name, i, err)
+		}
+		e.digests = append(e.digests, &digest)
+	}
+	return withFlapDelay(delay, opts, e), nil
+}
+
+func (e *email) Name() string {
+	return e.config.Name
+}
+
+// Messages returns an email per event with the recipients of every matching rule, and the digests that are due.
+// The schedule of the digests is stored by the dispatcher, a digest due while the service was down is sent
+// by the first refresh after the restart. Digests without a stored schedule are only scheduled by the first refresh
+func (e *email) Messages(refresh Refresh) ([]Message, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	msgs := []Message{}
+	for _, event := range refresh.Events {
+		to := []string{}
+		seen := make(map[string]bool)
+		for _, rule := range e.config.Rules {
+			if !rule.events.match(event, refresh.Time) {
+				continue
+			}
+			for _, address := range rule.To {
+				if !seen[address] {
+					seen[address] = true
+					to = append(to, address)
+				}
+			}
+		}
+		if len(to) == 0 {
+			continue
+		}
+		msg, err := alertEmail(to, event)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	for _, digest := range e.digests {
+		due := digest.due(refresh.Time)
+		if digest.lastSent.IsZero() {
+			digest.lastSent = due
+		}
+		if !due.After(digest.lastSent) {
+			continue
+		}
+		msg, err := digestEmail(digest, due, refresh)
+		if err != nil {
+			// The digest is retried by the next refresh
+			return msgs, err
+		}
+		digest.lastSent = due
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// state returns the schedule time of the last digest sent, by digest
+func (e *email) state() ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lastSent := make(map[string]time.Time)
+	for _, digest := range e.digests {
+		if !digest.lastSent.IsZero() {
+			lastSent[digest.key()] = digest.lastSent
+		}
+	}
+	return json.Marshal(lastSent)
+}
+
+func (e *email) restore(state []byte) error {
+	lastSent := make(map[string]time.Time)
+	if err := json.Unmarshal(state, &lastSent); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, digest := range e.digests {
+		digest.lastSent = lastSent[digest.key()]
+	}
+	return nil
+}
+
+// emailRow is a line of the emails, about an issue or an event
+type emailRow struct {
+	Hostname string
+	Service  string
+	Instance string
+	State    string
+	Time     string
+	Output   string
+}
+
+// formatEmailTime formats the times of the emails, empty when unknown
+func formatEmailTime(t time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(loc).Format("2006-01-02 15:04 MST")
+}
+
+func eventRow(e svc.Event, loc *time.Location) emailRow {
+	state := e.ToState
+	if e.FromState != "" && e.FromState != e.ToState {
+		state = e.FromState + " -> " + e.ToState
+	}
+	return emailRow{
+		Hostname: e.Hostname,
+		Service:  e.Service,
+		Instance: e.Instance,
+		State:    state,
+		Time:     formatEmailTime(e.Time, loc),
+		Output:   e.Output,
+	}
+}
+
+var alertText = template.Must(template.New("alert").Parse(`{{.Subject}}
+
+Host:     {{.Row.Hostname}}
+{{- if .Row.Service}}
+Service:  {{.Row.Service}}{{end}}
+{{- if .Row.Instance}}
+Instance: {{.Row.Instance}}{{end}}
+Event:    {{.Type}}
+State:    {{.Row.State}}
+Time:     {{.Row.Time}}
+{{- if .Row.Output}}
+Output:   {{.Row.Output}}{{end}}
+`))
+
+var alertHTML = htmltemplate.Must(htmltemplate.New("alert").Parse(`<html><body>
+<h2>{{.Subject}}</h2>
+<table>
+<tr><th align="left">Host</th><td>{{.Row.Hostname}}</td></tr>
+{{- if .Row.Service}}
+<tr><th align="left">Service</th><td>{{.Row.Service}}</td></tr>{{end}}
+{{- if .Row.Instance}}
+<tr><th align="left">Instance</th><td>{{.Row.Instance}}</td></tr>{{end}}
+<tr><th align="left">Event</th><td>{{.Type}}</td></tr>
+<tr><th align="left">State</th><td>{{.Row.State}}</td></tr>
+<tr><th align="left">Time</th><td>{{.Row.Time}}</td></tr>
+{{- if .Row.Output}}
+<tr><th align="left">Output</th><td><pre>{{.Row.Output}}</pre></td></tr>{{end}}
+</table>
+</body></html>
+`))
+
+// alertEmail renders the email about a transition
+func alertEmail(to []string, e svc.Event) (Message, error) {
+	summary := e
+	summary.Output = ""
+	data := struct {
+		Subject string
+		Type    string
+		Row     emailRow
+	}{
+		Subject: fmt.Sprintf("[nagiosagg] %s: %s", e.Hostname, eventLine(summary)),
+		Type:    e.Type,
+		Row:     eventRow(e, time.Local),
+	}
+	return renderEmail(e.Type, to, data.Subject, alertText, alertHTML, data)
+}
+
+// noisyHost is a host of a digest with the number of its events in the period
+type noisyHost struct {
+	Hostname string
+	Events   int
+}
+
+// digestReport is the content of a digest email
+type digestReport struct {
+	Subject  string
+	From, To string
+	Open     []emailRow
+	New      []emailRow
+	Resolved []emailRow
+	Noisiest []noisyHost
+	// More are the rows left out of each list
+	MoreOpen, MoreNew, MoreResolved int
+}
+
+var digestText = template.Must(template.New("digest").Parse(`{{.Subject}}
+{{.From}} - {{.To}}
+{{define "rows"}}{{range .}}
+- {{.Hostname}}{{if .Service}}/{{.Service}}{{end}}{{if .Instance}} ({{.Instance}}){{end}} {{.State}}{{if .Time}}, {{.Time}}{{end}}{{if .Output}}: {{.Output}}{{end}}{{end}}{{end}}
+Open problems ({{len .Open}}):{{template "rows" .Open}}{{if .MoreOpen}}
+  and {{.MoreOpen}} more{{end}}
+
+New problems ({{len .New}}):{{template "rows" .New}}{{if .MoreNew}}
+  and {{.MoreNew}} more{{end}}
+
+Resolved problems ({{len .Resolved}}):{{template "rows" .Resolved}}{{if .MoreResolved}}
+  and {{.MoreResolved}} more{{end}}
+
+Noisiest hosts:{{range .Noisiest}}
+- {{.Hostname}}: {{.Events}} events{{end}}
+`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest").Parse(`<html><body>
+<h2>{{.Subject}}</h2>
+<p>{{.From}} - {{.To}}</p>
+{{define "rows"}}<table border="1" cellspacing="0" cellpadding="4">
+<tr><th>Host</th><th>Service</th><th>Instance</th><th>State</th><th>Time</th><th>Output</th></tr>
+{{- range .}}
+<tr><td>{{.Hostname}}</td><td>{{.Service}}</td><td>{{.Instance}}</td><td>{{.State}}</td><td>{{.Time}}</td><td>{{.Output}}</td></tr>
+{{- end}}
+</table>{{end}}
+<h3>Open problems ({{len .Open}})</h3>
+{{template "rows" .Open}}{{if .MoreOpen}}<p>and {{.MoreOpen}} more</p>{{end}}
+<h3>New problems ({{len .New}})</h3>
+{{template "rows" .New}}{{if .MoreNew}}<p>and {{.MoreNew}} more</p>{{end}}
+<h3>Resolved problems ({{len .Resolved}})</h3>
+{{template "rows" .Resolved}}{{if .MoreResolved}}<p>and {{.MoreResolved}} more</p>{{end}}
+<h3>Noisiest hosts</h3>
+<ol>{{range .Noisiest}}
+<li>{{.Hostname}}: {{.Events}} events</li>{{end}}
+</ol>
+</body></html>
+`))
+
+// limitRows caps a list of rows, returning the number of rows left out
+func limitRows(rows []emailRow) ([]emailRow, int) {
+	if len(rows) <= digestMaxRows {
+		return rows, 0
+	}
+	return rows[:digestMaxRows], len(rows) - digestMaxRows
+}
+
+// digestEmail renders a digest from the current issues and the events of the digest period
+func digestEmail(d *EmailDigest, due time.Time, refresh Refresh) (Message, error) {
+	from := d.period(due)
+	issues, err := refresh.Issues()
+	if err != nil {
+		return Message{}, err
+	}
+	events, err := refresh.History(from)
+	if err != nil {
+		return Message{}, err
+	}
+	report := digestReport{
+		From:     formatEmailTime(from, d.location),
+		To:       formatEmailTime(due, d.location),
+		Open:     []emailRow{},
+		New:      []emailRow{},
+		Resolved: []emailRow{},
+	}
+	for _, statuses := range issues {
+		for _, status := range statuses {
+			if !d.filter.Match(status, refresh.Time) {
+				continue
+			}
+			issue := svc.NewIssue(status)
+			report.Open = append(report.Open, emailRow{
+				Hostname: issue.Hostname,
+				Service:  issue.Service,
+				Instance: issue.Instance,
+				State:    issue.State,
+				Time:     formatEmailTime(issue.LastStateChanged, d.location),
+				Output:   issue.Output,
+			})
+		}
+	}
+	sort.Slice(report.Open, func(i, j int) bool {
+		if report.Open[i].Hostname != report.Open[j].Hostname {
+			return report.Open[i].Hostname < report.Open[j].Hostname
+		}
+		return report.Open[i].Service < report.Open[j].Service
+	})
+	noise := make(map[string]int)
+	for _, e := range events {
+		if !d.filter.MatchEvent(e, refresh.Time) {
+			continue
+		}
+		noise[e.Hostname]++
+		switch e.Type {
+		case svc.EventOpened:
+			report.New = append(report.New, eventRow(e, d.location))
+		case svc.EventResolved:
+			report.Resolved = append(report.Resolved, eventRow(e, d.location))
+		}
+	}
+	for host, count := range noise {
+		report.Noisiest = append(report.Noisiest, noisyHost{Hostname: host, Events: count})
+	}
+	sort.Slice(report.Noisiest, func(i, j int) bool {
+		if report.Noisiest[i].Events != report.Noisiest[j].Events {
+			return report.Noisiest[i].Events > report.Noisiest[j].Events
+		}
+		return report.Noisiest[i].Hostname < report.Noisiest[j].Hostname
+	})
+	if len(report.Noisiest) > d.Top {
+		report.Noisiest = report.Noisiest[:d.Top]
+	}
+	report.Subject = fmt.Sprintf("[nagiosagg] %s%s digest: %d open, %d new, %d resolved problems",
+		strings.ToUpper(d.Schedule[:1]), d.Schedule[1:], len(report.Open), len(report.New), len(report.Resolved))
+	report.Open, report.MoreOpen = limitRows(report.Open)
+	report.New, report.MoreNew = limitRows(report.New)
+	report.Resolved, report.MoreResolved = limitRows(report.Resolved)
+	return renderEmail("digest", d.To, report.Subject, digestText, digestHTML, report)
+}
+
+// renderEmail executes the text and HTML templates of an email into a message
+func renderEmail(msgType string, to []string, subject string, text *template.Template, html *htmltemplate.Template, data interface{}) (Message, error) {
+	var textB, htmlB bytes.Buffer
+	if err := text.Execute(&textB, data); err != nil {
+		return Message{}, err
+	}
+	if err := html.Execute(&htmlB, data); err != nil {
+		return Message{}, err
+	}
+	body, err := json.Marshal(emailMessage{To: to, Subject: subject, Text: textB.String(), HTML: htmlB.String()})
+	return Message{Type: msgType, Body: body}, err
+}
+
+// mimeEmail builds a multipart/alternative email with a text and an HTML part
+func mimeEmail(from string, id string, m emailMessage, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+	headers := []string{
+		"From: " + from,
+		"To: " + strings.Join(m.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date: " + now.Format(time.RFC1123Z),
+		"Message-ID: <" + id + "@nagiosagg>",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + parts.Boundary(),
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// smtpError makes the rejections of the SMTP server permanent, 4xx replies are temporary
+func smtpError(err error) error {
+	if reply, ok := err.(*textproto.Error); ok && reply.Code >= 500 {
+		return Permanent(err)
+	}
+	return err
+}
+
+func (e *email) Deliver(ctx context.Context, msg Message) error {
+	var m emailMessage
+	if err := json.Unmarshal(msg.Body, &m); err != nil {
+		return Permanent(err)
+	}
+	data, err := mimeEmail(e.config.From, msg.ID, m, time.Now())
+	if err != nil {
+		return Permanent(err)
+	}
+	deadline := time.Now().Add(e.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(e.config.Host, strconv.Itoa(e.config.Port)))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, e.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if e.config.TLS == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return Permanent(fmt.Errorf("%s doesn't support STARTTLS", e.config.Host))
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: e.config.Host, InsecureSkipVerify: e.config.InsecureSkipVerify}); err != nil {
+			return err
+		}
+	}
+	if e.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host)); err != nil {
+			return smtpError(err)
+		}
+	}
+	if err := c.Mail(e.config.From); err != nil {
+		return smtpError(err)
+	}
+	// A rejected address doesn't keep the email from the others
+	accepted := 0
+	var rejected error
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			if err = smtpError(err); !IsPermanent(err) {
+				return err
+			}
+			rejected = err
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 && rejected != nil {
+		return rejected
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,212 @@
+package notify
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// Option configures a notifier
+type Option func(*options)
+
+type options struct {
+	flapWindow int
+}
+
+// WithFlapWindow sets the flap window of the service, see svc.WithFlapDetection. Notifiers delaying
+// flapping issues take a resolved issue as stable once it stayed resolved for a whole window
+func WithFlapWindow(window int) Option {
+	return func(o *options) {
+		o.flapWindow = window
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{flapWindow: svc.DefaultFlapWindow}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// flapDelay holds back the events of flapping issues until they stop flapping, then only sends
+// the last one if it still describes the issue. Resolved issues are taken as stable once they stayed
+// resolved for a whole flap window. Flapping issues are left out of the issues of the refreshes. The held
+// events are stored by the dispatcher along with the state of the wrapped notifier, to survive restarts
+type flapDelay struct {
+	Notifier
+	window int
+
+	mu sync.Mutex
+	// held is the last event of every flapping issue
+	held map[string]*heldEvent
+	// announced are the issues the notifier was told about and not yet told were resolved
+	announced map[string]bool
+}
+
+// withFlapDelay wraps a notifier to delay the events of flapping issues when delay is set
+func withFlapDelay(delay bool, opts []Option, n Notifier) Notifier {
+	if !delay {
+		return n
+	}
+	return &flapDelay{
+		Notifier:  n,
+		window:    newOptions(opts).flapWindow,
+		held:      make(map[string]*heldEvent),
+		announced: make(map[string]bool),
+	}
+}
+
+// heldEvent is an event of a flapping issue with the number of later refreshes the issue was resolved in
+type heldEvent struct {
+	svc.Event
+	resolved int
+}
+
+func issueKey(instance, hostname, service string) string {
+	return instance + "\x00" + hostname + "\x00" + service
+}
+
+func (n *flapDelay) Messages(refresh Refresh) ([]Message, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	events := []svc.Event{}
+	for _, e := range refresh.Events {
+		key := issueKey(e.Instance, e.Hostname, e.Service)
+		if e.Flapping {
+			n.held[key] = &heldEvent{Event: e, resolved: -1}
+			continue
+		}
+		// A stable event supersedes the held ones
+		delete(n.held, key)
+		events = append(events, e)
+	}
+	if len(n.held) > 0 {
+		issues, err := refresh.Issues()
+		if err != nil {
+			return nil, err
+		}
+		current := make(map[string]parser.NagiosStatus)
+		for _, statuses := range issues {
+			for _, status := range statuses {
+				current[issueKey(status.Instance, status.Hostname, status.Service)] = status
+			}
+		}
+		for key, e := range n.held {
+			status, found := current[key]
+			if found && status.IsFlapping() {
+				continue
+			}
+			if !found && e.Type == svc.EventResolved {
+				if e.resolved++; e.resolved < n.window-1 {
+					continue
+				}
+			}
+			delete(n.held, key)
+			switch {
+			case e.Type == svc.EventResolved && !found && n.announced[key]:
+			case e.Type != svc.EventResolved && found && status.State == e.ToState:
+			default:
+				// The issue moved on since, or was never announced
+				continue
+			}
+			events = append(events, e.Event)
+		}
+		// Released events are older than the ones of the refresh
+		sort.SliceStable(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	}
+	for _, e := range events {
+		key := issueKey(e.Instance, e.Hostname, e.Service)
+		if e.Type == svc.EventResolved {
+			delete(n.announced, key)
+		} else {
+			n.announced[key] = true
+		}
+	}
+	refresh.Events = events
+	issues := refresh.Issues
+	refresh.Issues = func() (map[string][]parser.NagiosStatus, error) {
+		all, err := issues()
+		if err != nil {
+			return nil, err
+		}
+		stable := make(map[string][]parser.NagiosStatus)
+		for host, statuses := range all {
+			for _, status := range statuses {
+				if !status.IsFlapping() {
+					stable[host] = append(stable[host], status)
+				}
+			}
+		}
+		return stable, nil
+	}
+	return n.Notifier.Messages(refresh)
+}
+
+// flapState is the persisted state of a flap delay, along with the state of the notifier it wraps
+type flapState struct {
+	Held      []heldState     `json:"held,omitempty"`
+	Announced []string        `json:"announced,omitempty"`
+	Notifier  json.RawMessage `json:"notifier,omitempty"`
+}
+
+type heldState struct {
+	Event    svc.Event `json:"event"`
+	Resolved int       `json:"resolved"`
+}
+
+func (n *flapDelay) state() ([]byte, error) {
+	var state flapState
+	if inner, ok := n.Notifier.(stateful); ok {
+		raw, err := inner.state()
+		if err != nil {
+			return nil, err
+		}
+		state.Notifier = raw
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range n.held {
+		state.Held = append(state.Held, heldState{Event: e.Event, Resolved: e.resolved})
+	}
+	sort.Slice(state.Held, func(i, j int) bool { return state.Held[i].Event.ID < state.Held[j].Event.ID })
+	for key := range n.announced {
+		state.Announced = append(state.Announced, key)
+	}
+	sort.Strings(state.Announced)
+	return json.Marshal(state)
+}
+
+func (n *flapDelay) restore(raw []byte) error {
+	var state flapState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return err
+	}
+	if inner, ok := n.Notifier.(stateful); ok && len(state.Notifier) > 0 {
+		if err := inner.restore(state.Notifier); err != nil {
+			return err
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.held = make(map[string]*heldEvent)
+	for _, e := range state.Held {
+		n.held[issueKey(e.Event.Instance, e.Event.Hostname, e.Event.Service)] = &heldEvent{Event: e.Event, resolved: e.Resolved}
+	}
+	n.announced = make(map[string]bool)
+	for _, key := range state.Announced {
+		n.announced[key] = true
+	}
+	return nil
+}
+
+// unwrap returns the notifier wrapped by a flap delay, for the optional interfaces of the notifiers
+func unwrap(n Notifier) Notifier {
+	if delay, ok := n.(*flapDelay); ok {
+		return delay.Notifier
+	}
+	return n
+}
@@ -0,0 +1,133 @@
+// Package notify delivers notifications for the issue transitions found by every refresh.
+// Messages are written to an outbox in the local DB before they are delivered, so that
+// deliveries are retried with an exponential backoff and survive restarts
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// Notifier turns the events of a refresh into messages and delivers them
+type Notifier interface {
+	// Name identifies the notifier in the outbox and the logs, it must be unique and stable across restarts
+	Name() string
+	// Messages returns the messages to deliver after a refresh
+	Messages(refresh Refresh) ([]Message, error)
+	// Deliver sends a message. Failures are retried unless they are permanent
+	Deliver(ctx context.Context, msg Message) error
+}
+
+// Refresh is what the notifiers are told after every successful refresh
+type Refresh struct {
+	Time time.Time
+	// Events are the transitions found by the refresh
+	Events []svc.Event
+	// Issues returns every issue after the refresh, it is only read by the notifiers that need it
+	Issues func() (map[string][]parser.NagiosStatus, error)
+	// History returns the events recorded since a time, as returned by /events
+	History func(since time.Time) ([]svc.Event, error)
+}
+
+// Message is a notification waiting in the outbox
+type Message struct {
+	// ID is set when the message is queued, it is kept across retries so that receivers can deduplicate
+	ID string `json:"id"`
+	// Type is the event type the message is about
+	Type string `json:"type,omitempty"`
+	Body []byte `json:"body"`
+	// Replace marks a message holding the whole state of the notifier. Queueing it drops the undelivered
+	// messages of the same type, merged into it when the notifier implements merger
+	Replace bool `json:"replace,omitempty"`
+}
+
+// merger is implemented by the notifiers of replacing messages that need to carry over parts of the replaced ones
+type merger interface {
+	// merge returns next with what it needs from queued, an undelivered message it replaces
+	merge(queued, next Message) (Message, error)
+}
+
+// stateful is implemented by the notifiers keeping state across refreshes, such as the events of the next digest.
+// The dispatcher stores the state along with the messages of every refresh and restores it after a restart
+type stateful interface {
+	state() ([]byte, error)
+	restore(state []byte) error
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks a delivery failure that retrying won't fix, e.g. a rejected payload
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// IsPermanent reports whether a delivery failure is permanent
+func IsPermanent(err error) bool {
+	_, permanent := err.(permanentError)
+	return permanent
+}
+
+// RetryPolicy controls the redelivery of failed messages
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts after which a message is dropped
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff is the wait after the first failure, doubled after every further failure
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// DefaultRetryPolicy retries for about a day
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    30,
+	InitialBackoff: 10 * time.Second,
+	MaxBackoff:     time.Hour,
+}
+
+// backoff returns the wait after the given number of failed attempts
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempts && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// AfterRefresh is the svc.RefreshHook of the dispatcher, it queues the notifications for the refresh.
+// Failing to queue them doesn't fail the refresh, the data was refreshed
+func (d *Dispatcher) AfterRefresh(ctx context.Context, service svc.NagiosParserSvc, report svc.RefreshReport) {
+	var (
+		once      sync.Once
+		issues    map[string][]parser.NagiosStatus
+		issuesErr error
+	)
+	refresh := Refresh{
+		Time:   report.RefreshedAt,
+		Events: report.Events,
+		Issues: func() (map[string][]parser.NagiosStatus, error) {
+			once.Do(func() {
+				issues, issuesErr = service.GetParsedNagios(ctx, svc.Filter{})
+			})
+			return issues, issuesErr
+		},
+		History: func(since time.Time) ([]svc.Event, error) {
+			return service.GetEvents(ctx, since)
+		},
+	}
+	if err := d.Enqueue(refresh); err != nil {
+		d.logger.Log("component", "notify", "err", err.Error())
+	}
+}
@@ -0,0 +1,1019 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/tchaudhry91/nagiosagg/internal/testutil"
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+const samplesDir = "../samples/public"
+
+// receiver records the webhook requests it gets, failing the first ones with status
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(r.status)
+		return
+	}
+	r.bodies = append(r.bodies, body)
+}
+
+func (r *receiver) delivered() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.bodies...)
+}
+
+func (r *receiver) attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func pendingMessages(t *testing.T, d *Dispatcher) int {
+	pending, err := d.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range pending {
+		total += n
+	}
+	return total
+}
+
+var fastRetries = RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+func TestWebhook(t *testing.T) {
+	dir := testutil.TempDir(t)
+	statusDir := filepath.Join(dir, "statuses")
+	os.Mkdir(statusDir, 0755)
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random3.dat"), filepath.Join(statusDir, "nagios.dat"))
+
+	recv := &receiver{status: http.StatusBadGateway, failures: 1}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+	webhook, err := NewWebhook(WebhookConfig{
+		Name:    "ops",
+		URL:     srv.URL,
+		Secret:  "s3cr3t",
+		Headers: map[string]string{"X-Team": "ops"},
+		Filter:  FilterConfig{States: []string{"CRITICAL"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := NewDispatcher(filepath.Join(dir, "nagios.db"), fastRetries, log.NewNopLogger(), webhook)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+
+	service, _ := svc.NewNagiosParserSvc(statusDir, filepath.Join(dir, "nagios.db"))
+	service = svc.AfterRefreshMiddleware(dispatcher.AfterRefresh)(service)
+
+	expected := func(events []svc.Event) int {
+		n := 0
+		for _, e := range events {
+			if e.Type != svc.EventDeEscalated && e.Type != svc.EventAcknowledged && e.Status().State == "CRITICAL" {
+				n++
+			}
+		}
+		return n
+	}
+	report, err := service.RefreshNagiosData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := expected(report.Events)
+	if want == 0 {
+		t.Fatal("Want CRITICAL issues in the sample")
+	}
+	testutil.WaitFor(t, "the opened events", func() bool { return len(recv.delivered()) == want })
+
+	// The resolved CRITICAL issues are notified as well
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random1.dat"), filepath.Join(statusDir, "nagios.dat"))
+	report, err = service.RefreshNagiosData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want += expected(report.Events)
+	testutil.WaitFor(t, "the resolved events", func() bool { return len(recv.delivered()) == want })
+	if pending := pendingMessages(t, dispatcher); pending != 0 {
+		t.Errorf("Want an empty outbox, have %d messages", pending)
+	}
+
+	types := make(map[string]int)
+	for _, body := range recv.delivered() {
+		var e svc.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatal(err)
+		}
+		types[e.Type]++
+		if e.Type == svc.EventResolved && e.FromState != "CRITICAL" || e.Type != svc.EventResolved && e.ToState != "CRITICAL" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	}
+	if types[svc.EventOpened] == 0 || types[svc.EventResolved] == 0 {
+		t.Errorf("Want opened and resolved events, have %v", types)
+	}
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	// The failed first attempt is retried with the same delivery ID
+	if want, have := recv.requests[0].Header.Get(HeaderDelivery), recv.requests[1].Header.Get(HeaderDelivery); want != have {
+		t.Errorf("Want the retry to keep delivery ID %s, have %s", want, have)
+	}
+	for i, req := range recv.requests[1:] {
+		if want, have := Sign("s3cr3t", recv.bodies[i]), req.Header.Get(HeaderSignature); want != have {
+			t.Errorf("Want signature %s, have %s", want, have)
+		}
+		if req.Header.Get("X-Team") != "ops" || req.Header.Get(HeaderEvent) == "" {
+			t.Errorf("Missing headers: %v", req.Header)
+		}
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := testutil.TempDir(t)
+	localDB := filepath.Join(dir, "nagios.db")
+	recv := &receiver{}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+	webhook, _ := NewWebhook(WebhookConfig{Name: "ops", URL: srv.URL})
+	events := []svc.Event{
+		{Type: svc.EventOpened, Hostname: "web1", Service: "HTTP", ToState: "CRITICAL"},
+		{Type: svc.EventDeEscalated, Hostname: "web2", Service: "HTTP", FromState: "CRITICAL", ToState: "WARNING"},
+		{Type: svc.EventResolved, Hostname: "web3", Service: "HTTP", FromState: "WARNING", ToState: "OK"},
+	}
+
+	// Queued, but the service stops before delivering
+	if err := NewDispatcher(localDB, fastRetries, log.NewNopLogger(), webhook).Enqueue(Refresh{Events: events}); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := NewDispatcher(localDB, fastRetries, log.NewNopLogger(), webhook)
+	if have := pendingMessages(t, dispatcher); have != 2 {
+		t.Fatalf("Want the 2 default event types queued, have %d", have)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+	testutil.WaitFor(t, "the queued messages", func() bool { return len(recv.delivered()) == 2 })
+	var first svc.Event
+	json.Unmarshal(recv.delivered()[0], &first)
+	if first.Hostname != "web1" {
+		t.Errorf("Want messages delivered in order, have %s first", first.Hostname)
+	}
+}
+
+func TestFlapDelaySurvivesRestart(t *testing.T) {
+	dir := testutil.TempDir(t)
+	localDB := filepath.Join(dir, "nagios.db")
+	recv := &receiver{}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+	config := WebhookConfig{Name: "ops", URL: srv.URL, Filter: FilterConfig{DelayFlapping: true}}
+	noIssues := func() (map[string][]parser.NagiosStatus, error) { return nil, nil }
+	opened := svc.Event{ID: 1, Type: svc.EventOpened, Hostname: "web1", Service: "HTTP", ToState: "CRITICAL"}
+	resolved := svc.Event{ID: 2, Type: svc.EventResolved, Hostname: "web1", Service: "HTTP", FromState: "CRITICAL", ToState: "OK", Flapping: true}
+
+	// The issue is announced, then its resolution is held back when the service stops
+	webhook, _ := NewWebhook(config, WithFlapWindow(2))
+	before := NewDispatcher(localDB, fastRetries, log.NewNopLogger(), webhook)
+	if err := before.Enqueue(Refresh{Events: []svc.Event{opened}, Issues: noIssues}); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Enqueue(Refresh{Events: []svc.Event{resolved}, Issues: noIssues}); err != nil {
+		t.Fatal(err)
+	}
+
+	webhook, _ = NewWebhook(config, WithFlapWindow(2))
+	dispatcher := NewDispatcher(localDB, fastRetries, log.NewNopLogger(), webhook)
+	if err := dispatcher.Enqueue(Refresh{Issues: noIssues}); err != nil {
+		t.Fatal(err)
+	}
+	if have := pendingMessages(t, dispatcher); have != 2 {
+		t.Fatalf("Want the held resolution released after the restart, have %d messages queued", have)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+	testutil.WaitFor(t, "the queued messages", func() bool { return len(recv.delivered()) == 2 })
+	var last svc.Event
+	json.Unmarshal(recv.delivered()[1], &last)
+	if last.Type != svc.EventResolved || last.Hostname != "web1" {
+		t.Errorf("Want the resolution of web1 delivered last, have %s of %s", last.Type, last.Hostname)
+	}
+}
+
+func TestDeliveryFailures(t *testing.T) {
+	events := []svc.Event{{Type: svc.EventOpened, Hostname: "web1", ToState: "DOWN"}}
+	for _, testcase := range []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{name: "permanent", status: http.StatusBadRequest, want: 1},
+		{name: "rate limited", status: http.StatusTooManyRequests, want: fastRetries.MaxAttempts},
+		{name: "server error", status: http.StatusInternalServerError, want: fastRetries.MaxAttempts},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			recv := &receiver{status: testcase.status, failures: 100}
+			srv := httptest.NewServer(recv)
+			defer srv.Close()
+			webhook, _ := NewWebhook(WebhookConfig{Name: "ops", URL: srv.URL})
+			dispatcher := NewDispatcher(filepath.Join(testutil.TempDir(t), "nagios.db"), fastRetries, log.NewNopLogger(), webhook)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go dispatcher.Run(ctx)
+			if err := dispatcher.Enqueue(Refresh{Events: events}); err != nil {
+				t.Fatal(err)
+			}
+			testutil.WaitFor(t, "the message to be dropped", func() bool { return pendingMessages(t, dispatcher) == 0 })
+			if have := recv.attempts(); have != testcase.want {
+				t.Errorf("Want %d attempts, have %d", testcase.want, have)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempts, want := range []time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 9: 5 * time.Second} {
+		if want == 0 {
+			continue
+		}
+		if have := policy.backoff(attempts); have != want {
+			t.Errorf("After %d attempts want %v, have %v", attempts, want, have)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := testutil.TempDir(t)
+	path := filepath.Join(dir, "notify.yaml")
+	ioutil.WriteFile(path, []byte(`
+retry:
+  max_attempts: 5
+  initial_backoff: 30s
+webhooks:
+  - name: ops
+    url: https://hooks.example.com/nagios
+    secret: s3cr3t
+    events: [opened, resolved]
+    filter:
+      state: [CRITICAL, DOWN]
+      acknowledged: false
+      min_duration: 5m
+`), 0644)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Retry.InitialBackoff != 30*time.Second || config.Webhooks[0].Filter.MinDuration != 5*time.Minute ||
+		config.Webhooks[0].Filter.Acknowledged == nil || *config.Webhooks[0].Filter.Acknowledged {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if _, err := NewDispatcherFromConfig(config, filepath.Join(dir, "nagios.db"), log.NewNopLogger()); err != nil {
+		t.Error(err)
+	}
+
+	for _, invalid := range []string{
+		"webhooks:\n  - name: ops\n    url: http://localhost\n    evnts: [opened]\n",
+		"webhooks:\n  - name: ops\n    url: http://localhost\n    events: [exploded]\n",
+		"webhooks:\n  - name: ops\n    url: http://localhost\n    filter:\n      host: /(/\n",
+		"webhooks:\n  - name: ops\n    url: http://a\n  - name: ops\n    url: http://b\n",
+		"pagerduty:\n  - name: pd\n",
+		"slack:\n  - name: ops\n    url: http://a\n    quiet_hours:\n      start: 22:00\n      end: 7am\n",
+		"pagerduty:\n  - name: pd\n    routes:\n      - host: web*\n",
+	} {
+		ioutil.WriteFile(path, []byte(invalid), 0644)
+		config, err := LoadConfig(path)
+		if err == nil {
+			_, err = config.Notifiers()
+		}
+		if err == nil {
+			t.Errorf("Want an error for config:\n%s", invalid)
+		}
+	}
+}
+
+// fakeAlertmanager records the alerts posted to its v2 API
+type fakeAlertmanager struct {
+	mu     sync.Mutex
+	posts  [][]Alert
+	header http.Header
+}
+
+func (am *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/api/v2/alerts" {
+		http.NotFound(w, r)
+		return
+	}
+	var alerts []Alert
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.posts = append(am.posts, alerts)
+	am.header = r.Header
+}
+
+func (am *fakeAlertmanager) received() [][]Alert {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	return append([][]Alert(nil), am.posts...)
+}
+
+func TestAlertmanager(t *testing.T) {
+	dir := testutil.TempDir(t)
+	statusDir := filepath.Join(dir, "statuses")
+	os.Mkdir(statusDir, 0755)
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random3.dat"), filepath.Join(statusDir, "nagios.dat"))
+
+	am := &fakeAlertmanager{}
+	srv := httptest.NewServer(am)
+	defer srv.Close()
+	notifier, err := NewAlertmanager(AlertmanagerConfig{
+		Name:         "am",
+		URL:          srv.URL + "/",
+		Headers:      map[string]string{"Authorization": "Bearer abc"},
+		Labels:       map[string]string{"env": "test"},
+		GeneratorURL: "http://nagiosagg:8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := NewDispatcher(filepath.Join(dir, "nagios.db"), fastRetries, log.NewNopLogger(), notifier)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+	service, _ := svc.NewNagiosParserSvc(statusDir, filepath.Join(dir, "nagios.db"))
+	service = svc.AfterRefreshMiddleware(dispatcher.AfterRefresh)(service)
+
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitFor(t, "the active alerts", func() bool { return len(am.received()) == 1 })
+	active := am.received()[0]
+	if len(active) == 0 {
+		t.Fatal("Want active alerts")
+	}
+	var ssh *Alert
+	for i, alert := range active {
+		if alert.EndsAt != nil || alert.StartsAt == nil || alert.Labels["env"] != "test" {
+			t.Errorf("Unexpected active alert %+v", alert)
+		}
+		if alert.Labels["alertname"] == "SSH" {
+			ssh = &active[i]
+		}
+	}
+	if ssh == nil {
+		t.Fatalf("Want an SSH alert, have %+v", active)
+	}
+	if ssh.Labels["host"] != "localhost" || ssh.Labels["instance"] != "nagios" || ssh.Labels["severity"] != "critical" ||
+		ssh.Annotations["plugin_output"] == "" || ssh.GeneratorURL != "http://nagiosagg:8080/hosts/localhost" {
+		t.Errorf("Unexpected SSH alert %+v", ssh)
+	}
+	if am.header.Get("Authorization") != "Bearer abc" {
+		t.Error("The configured headers weren't sent")
+	}
+
+	// Every alert is ended once its issue is gone
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random1.dat"), filepath.Join(statusDir, "nagios.dat"))
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitFor(t, "the resolved alerts", func() bool { return len(am.received()) == 2 })
+	resolved := am.received()[1]
+	if len(resolved) != len(active) {
+		t.Errorf("Want %d resolved alerts, have %d", len(active), len(resolved))
+	}
+	for _, alert := range resolved {
+		if alert.EndsAt == nil {
+			t.Errorf("Want endsAt set on %+v", alert)
+		}
+	}
+
+	// Nothing is posted when there is nothing active or resolved
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if have := len(am.received()); have != 2 {
+		t.Errorf("Want no more posts, have %d", have)
+	}
+
+	// After a restart, alerts sent before are ended from the resolved events
+	notifier, _ = NewAlertmanager(AlertmanagerConfig{Name: "am", URL: srv.URL})
+	msgs, err := notifier.Messages(Refresh{
+		Time:   time.Now(),
+		Events: []svc.Event{{Type: svc.EventResolved, Instance: "nagios", Hostname: "web1", FromState: "DOWN", ToState: "OK"}},
+		Issues: func() (map[string][]parser.NagiosStatus, error) { return nil, nil },
+	})
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Want a message, have %v %v", msgs, err)
+	}
+	var alerts []Alert
+	json.Unmarshal(msgs[0].Body, &alerts)
+	if len(alerts) != 1 || alerts[0].EndsAt == nil || alerts[0].Labels["alertname"] != "HostDown" || alerts[0].Labels["severity"] != "critical" {
+		t.Errorf("Unexpected alerts %+v", alerts)
+	}
+
+	// While the Alertmanager is unreachable, every refresh replaces the undelivered alerts and keeps the ended ones
+	notifier, _ = NewAlertmanager(AlertmanagerConfig{Name: "down", URL: srv.URL})
+	dispatcher = NewDispatcher(filepath.Join(dir, "outage.db"), fastRetries, log.NewNopLogger(), notifier)
+	problem := func(host string) map[string][]parser.NagiosStatus {
+		return map[string][]parser.NagiosStatus{host: {{StatusType: "hoststatus", Hostname: host, State: "DOWN"}}}
+	}
+	for _, issues := range []map[string][]parser.NagiosStatus{problem("web1"), problem("web2"), problem("web3")} {
+		issues := issues
+		refresh := Refresh{Time: time.Now(), Issues: func() (map[string][]parser.NagiosStatus, error) { return issues, nil }}
+		if err := dispatcher.Enqueue(refresh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, _ := dispatcher.Pending(); pending["down"] != 1 {
+		t.Errorf("Want a single queued message, have %v", pending)
+	}
+	_, entry, _, _ := dispatcher.head("down")
+	alerts = nil
+	json.Unmarshal(entry.Message.Body, &alerts)
+	state := make(map[string]bool)
+	for _, alert := range alerts {
+		state[alert.Labels["host"]] = alert.EndsAt == nil
+	}
+	if want := map[string]bool{"web1": false, "web2": false, "web3": true}; !reflect.DeepEqual(state, want) {
+		t.Errorf("Want %v active, have %v", want, state)
+	}
+}
+
+func TestPagerDuty(t *testing.T) {
+	dir := testutil.TempDir(t)
+	statusDir := filepath.Join(dir, "statuses")
+	os.Mkdir(statusDir, 0755)
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random3.dat"), filepath.Join(statusDir, "nagios.dat"))
+
+	var mu sync.Mutex
+	events := []PagerDutyEvent{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e PagerDutyEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	received := func() []PagerDutyEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]PagerDutyEvent(nil), events...)
+	}
+
+	unacknowledged := false
+	notifier, err := NewPagerDuty(PagerDutyConfig{
+		Name:       "pd",
+		URL:        srv.URL,
+		RoutingKey: "default-key",
+		Routes:     []PagerDutyRoute{{Host: "tama*", RoutingKey: "tama-key"}},
+		ClientURL:  "http://nagiosagg:8080/",
+		Filter:     FilterConfig{Acknowledged: &unacknowledged},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := NewDispatcher(filepath.Join(dir, "nagios.db"), fastRetries, log.NewNopLogger(), notifier)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+	service, _ := svc.NewNagiosParserSvc(statusDir, filepath.Join(dir, "nagios.db"))
+	service = svc.AfterRefreshMiddleware(dispatcher.AfterRefresh)(service)
+
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitFor(t, "the triggers", func() bool { return len(received()) == 2 })
+	triggers := map[string]PagerDutyEvent{}
+	for _, e := range received() {
+		triggers[e.DedupKey] = e
+	}
+	ssh, found := triggers["nagios/localhost/SSH"]
+	if !found {
+		t.Fatalf("Want a trigger for localhost/SSH, have %+v", triggers)
+	}
+	if ssh.EventAction != PagerDutyTrigger || ssh.RoutingKey != "default-key" || ssh.Payload == nil ||
+		ssh.Payload.Severity != "critical" || ssh.Payload.Source != "localhost" || ssh.Payload.Component != "SSH" ||
+		ssh.ClientURL != "http://nagiosagg:8080/hosts/localhost" {
+		t.Errorf("Unexpected trigger %+v", ssh)
+	}
+	// Host names are escaped in the link
+	if e, _ := notifier.(*pagerDuty).event(svc.Event{Type: svc.EventResolved, Hostname: "web 1/a"}, time.Now()); e.ClientURL != "http://nagiosagg:8080/hosts/web%201%2Fa" {
+		t.Errorf("Unexpected client_url %s", e.ClientURL)
+	}
+	// Long summaries are cut between characters
+	long := notifier.(*pagerDuty).payload(svc.Event{Hostname: "localhost", ToState: "CRITICAL", Output: strings.Repeat("é", 1024)}, parser.NagiosStatus{})
+	if len(long.Summary) > 1024 || !utf8.ValidString(long.Summary) {
+		t.Errorf("Want a valid summary of at most 1024 bytes, have %d bytes", len(long.Summary))
+	}
+	for key, e := range triggers {
+		if strings.HasPrefix(key, "nagios/tama/") && e.RoutingKey != "tama-key" {
+			t.Errorf("Want tama routed to its own key, have %+v", e)
+		}
+	}
+
+	// Acknowledging the SSH problem in nagios acknowledges the incident, despite the acknowledged filter
+	raw, _ := ioutil.ReadFile(filepath.Join(samplesDir, "random3.dat"))
+	status := string(raw)
+	critical := strings.Index(status, "current_state=2")
+	status = status[:critical] + strings.Replace(status[critical:], "problem_has_been_acknowledged=0", "problem_has_been_acknowledged=1", 1)
+	ioutil.WriteFile(filepath.Join(statusDir, "nagios.dat"), []byte(status), 0644)
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitFor(t, "the acknowledgement", func() bool { return len(received()) == 3 })
+	if ack := received()[2]; ack.EventAction != PagerDutyAcknowledge || ack.DedupKey != "nagios/localhost/SSH" ||
+		ack.RoutingKey != "default-key" || ack.Payload != nil {
+		t.Errorf("Unexpected acknowledgement %+v", ack)
+	}
+
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random1.dat"), filepath.Join(statusDir, "nagios.dat"))
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitFor(t, "the resolutions", func() bool { return len(received()) == 5 })
+	for _, e := range received()[3:] {
+		if e.EventAction != PagerDutyResolve || triggers[e.DedupKey].RoutingKey != e.RoutingKey {
+			t.Errorf("Unexpected resolution %+v", e)
+		}
+	}
+}
+
+func TestChatDigest(t *testing.T) {
+	notifier, err := NewChat(FormatSlack, ChatConfig{
+		Name:       "ops",
+		URL:        "http://localhost",
+		Filter:     FilterConfig{Host: "web*"},
+		Digest:     10 * time.Minute,
+		QuietHours: QuietHours{Start: "22:00", End: "07:00", Timezone: "UTC"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type slackMessage struct {
+		Text   string `json:"text"`
+		Blocks []struct {
+			Type string `json:"type"`
+			Text struct {
+				Text string `json:"text"`
+			} `json:"text"`
+		} `json:"blocks"`
+	}
+	messages := func(now time.Time, events ...svc.Event) []slackMessage {
+		msgs, err := notifier.Messages(Refresh{Time: now, Events: events})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := make([]slackMessage, len(msgs))
+		for i, msg := range msgs {
+			if err := json.Unmarshal(msg.Body, &decoded[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return decoded
+	}
+	opened := func(host, service, state string) svc.Event {
+		return svc.Event{Type: svc.EventOpened, Instance: "nagios", Hostname: host, Service: service, ToState: state, Output: state + " - check output"}
+	}
+	noon := time.Date(2018, 9, 26, 12, 0, 0, 0, time.UTC)
+
+	// CRITICAL is sent right away, other states wait for the digest and other hosts are filtered out
+	msgs := messages(noon, opened("web1", "HTTP", "CRITICAL"), opened("web2", "Disk", "WARNING"), opened("db1", "MySQL", "CRITICAL"))
+	if len(msgs) != 1 || msgs[0].Blocks[0].Type != "header" || !strings.Contains(msgs[0].Blocks[1].Text.Text, "HTTP is CRITICAL") {
+		t.Fatalf("Want the CRITICAL issue right away, have %+v", msgs)
+	}
+	if msgs := messages(noon.Add(5*time.Minute), opened("web1", "Load", "WARNING")); len(msgs) != 0 {
+		t.Fatalf("Want no digest before its interval, have %+v", msgs)
+	}
+	msgs = messages(noon.Add(10 * time.Minute))
+	if len(msgs) != 1 || len(msgs[0].Blocks) != 3 {
+		t.Fatalf("Want a digest with a section per host, have %+v", msgs)
+	}
+	if web1 := msgs[0].Blocks[1].Text.Text; !strings.HasPrefix(web1, "*web1 (nagios)*") || !strings.Contains(web1, "Load is WARNING") {
+		t.Errorf("Unexpected digest section %q", web1)
+	}
+	if msgs := messages(noon.Add(30 * time.Minute)); len(msgs) != 0 {
+		t.Errorf("Want no empty digest, have %+v", msgs)
+	}
+
+	// Quiet hours hold back everything until they are over
+	night := time.Date(2018, 9, 26, 23, 0, 0, 0, time.UTC)
+	if msgs := messages(night, opened("web3", "HTTP", "CRITICAL")); len(msgs) != 0 {
+		t.Fatalf("Want nothing during quiet hours, have %+v", msgs)
+	}
+	msgs = messages(night.Add(8 * time.Hour))
+	if len(msgs) != 1 || !strings.Contains(msgs[0].Blocks[1].Text.Text, "web3") {
+		t.Errorf("Want the held back events after the quiet hours, have %+v", msgs)
+	}
+
+	// Long quiet hours keep the latest events only
+	events := []svc.Event{}
+	for i := 0; i < chatMaxPending+5; i++ {
+		events = append(events, opened(fmt.Sprintf("web%d", i), "HTTP", "CRITICAL"))
+	}
+	messages(night.Add(24*time.Hour), events...)
+	msgs = messages(night.Add(32 * time.Hour))
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0].Text, fmt.Sprintf("%d nagios events", chatMaxPending+5)) || !strings.Contains(msgs[0].Text, "oldest 5 left out") {
+		t.Errorf("Want a digest of the latest events, have %+v", msgs)
+	}
+
+	// The events of the next digest survive a restart
+	localDB := filepath.Join(testutil.TempDir(t), "nagios.db")
+	restarted := func() *Dispatcher {
+		notifier, _ = NewChat(FormatSlack, ChatConfig{Name: "ops", URL: "http://localhost", Digest: 10 * time.Minute})
+		return NewDispatcher(localDB, fastRetries, log.NewNopLogger(), notifier)
+	}
+	restarted().Enqueue(Refresh{Time: noon, Events: []svc.Event{opened("web1", "Disk", "WARNING")}})
+	dispatcher := restarted()
+	if err := dispatcher.Enqueue(Refresh{Time: noon.Add(10 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	_, entry, found, _ := dispatcher.head("ops")
+	if !found || entry.Message.Type != "digest" || !strings.Contains(string(entry.Message.Body), "Disk is WARNING") {
+		t.Errorf("Want the digest after the restart, have %+v", entry)
+	}
+}
+
+func TestFlapDelay(t *testing.T) {
+	const window = 4
+	notifier, err := NewWebhook(WebhookConfig{Name: "hook", URL: "http://localhost", Filter: FilterConfig{DelayFlapping: true}}, WithFlapWindow(window))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := func(id uint64, eventType, state string, flapping bool) svc.Event {
+		return svc.Event{ID: id, Type: eventType, Instance: "nagios", Hostname: "web1", Service: "HTTP", ToState: state, Flapping: flapping}
+	}
+	issue := func(state string, flapping bool) map[string][]parser.NagiosStatus {
+		return map[string][]parser.NagiosStatus{"web1": {{Instance: "nagios", Hostname: "web1", Service: "HTTP", State: state, Flapping: flapping}}}
+	}
+	sent := func(events []svc.Event, issues map[string][]parser.NagiosStatus) []string {
+		msgs, err := notifier.Messages(Refresh{Events: events, Issues: func() (map[string][]parser.NagiosStatus, error) { return issues, nil }})
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := []string{}
+		for _, msg := range msgs {
+			types = append(types, msg.Type)
+		}
+		return types
+	}
+
+	if have := sent([]svc.Event{event(1, svc.EventOpened, "CRITICAL", false)}, issue("CRITICAL", false)); len(have) != 1 {
+		t.Fatalf("Want stable issues right away, have %v", have)
+	}
+	if have := sent([]svc.Event{event(2, svc.EventResolved, "OK", true)}, nil); len(have) != 0 {
+		t.Fatalf("Want the events of flapping issues held back, have %v", have)
+	}
+	if have := sent([]svc.Event{event(3, svc.EventOpened, "WARNING", true)}, issue("WARNING", true)); len(have) != 0 {
+		t.Fatalf("Want the events of flapping issues held back, have %v", have)
+	}
+	// The issue settles in the state of the last held event, which is sent
+	if have := sent(nil, issue("WARNING", false)); len(have) != 1 || have[0] != svc.EventOpened {
+		t.Fatalf("Want the last held event once the issue stops flapping, have %v", have)
+	}
+	// Held events the issue moved on from are dropped
+	sent([]svc.Event{event(4, svc.EventEscalated, "CRITICAL", true)}, issue("CRITICAL", true))
+	if have := sent(nil, issue("UNKNOWN", false)); len(have) != 0 {
+		t.Fatalf("Want outdated events dropped, have %v", have)
+	}
+	// Resolutions are sent once the issue stayed resolved for a flap window
+	sent([]svc.Event{event(5, svc.EventResolved, "OK", true)}, nil)
+	for i := 1; i < window-1; i++ {
+		if have := sent(nil, nil); len(have) != 0 {
+			t.Fatalf("Want the resolution held back within the flap window, have %v", have)
+		}
+	}
+	if have := sent(nil, nil); len(have) != 1 || have[0] != svc.EventResolved {
+		t.Errorf("Want the resolution of the issue, have %v", have)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if have := truncate("short", 150); have != "short" {
+		t.Errorf("Want short strings kept, have %q", have)
+	}
+	title := strings.Repeat("é", 100)
+	if have := truncate(title, 150); len(have) > 150 || !utf8.ValidString(have) || !strings.HasSuffix(have, "é...") {
+		t.Errorf("Want a valid title of at most 150 bytes, have %q", have)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer srv.Close()
+	notifier, err := NewChat(FormatTeams, ChatConfig{Name: "ops", URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := notifier.Messages(Refresh{Time: time.Now(), Events: []svc.Event{
+		{Type: svc.EventResolved, Hostname: "web1", Service: "HTTP", FromState: "WARNING", ToState: "OK"},
+	}})
+	if len(msgs) != 1 {
+		t.Fatalf("Want a message without a digest, have %d", len(msgs))
+	}
+	if err := notifier.Deliver(context.Background(), msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	attachments, _ := body["attachments"].([]interface{})
+	if len(attachments) != 1 || attachments[0].(map[string]interface{})["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Errorf("Want an adaptive card, have %v", body)
+	}
+}
+
+// fakeMail is an email received by the fake SMTP server
+type fakeMail struct {
+	TLS  bool
+	Auth string
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP runs an in-process SMTP server accepting every email, with STARTTLS unless tlsConfig is nil.
+// Recipients at unknown.example.com are rejected
+func fakeSMTP(t *testing.T, tlsConfig *tls.Config) (addr string, received func() []fakeMail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	mails := []fakeMail{}
+	serve := func(conn net.Conn) {
+		defer func() { conn.Close() }()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP fake")
+		mail := fakeMail{}
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO":
+				if tlsConfig != nil && !mail.TLS {
+					tp.PrintfLine("250-localhost\r\n250-8BITMIME\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+				} else {
+					tp.PrintfLine("250-localhost\r\n250-8BITMIME\r\n250 AUTH PLAIN")
+				}
+			case "STARTTLS":
+				if tlsConfig == nil {
+					tp.PrintfLine("502 Not supported")
+					continue
+				}
+				tp.PrintfLine("220 Ready to start TLS")
+				tlsConn := tls.Server(conn, tlsConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				conn = tlsConn
+				tp = textproto.NewConn(conn)
+				mail = fakeMail{TLS: true}
+			case "AUTH":
+				mail.Auth = line
+				tp.PrintfLine("235 Authenticated")
+			case "MAIL":
+				mail.From = line
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				if strings.Contains(line, "@unknown.example.com") {
+					tp.PrintfLine("550 No such user")
+					continue
+				}
+				mail.To = append(mail.To, line)
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				mail.Data = string(data)
+				mu.Lock()
+				mails = append(mails, mail)
+				mu.Unlock()
+				mail = fakeMail{TLS: mail.TLS}
+				tp.PrintfLine("250 Queued")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String(), func() []fakeMail {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]fakeMail(nil), mails...)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	// The certificate of a TLS test server is good enough for STARTTLS
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	addr, received := fakeSMTP(t, tlsServer.TLS)
+	host, port, _ := net.SplitHostPort(addr)
+	portN, _ := strconv.Atoi(port)
+	config := EmailConfig{
+		Name:               "mail",
+		Host:               host,
+		Port:               portN,
+		InsecureSkipVerify: true,
+		Username:           "nagios",
+		Password:           "s3cr3t",
+		From:               "nagios@example.com",
+		Rules: []EmailRule{
+			{To: []string{"ops@example.com", "oncall@example.com"}},
+			{To: []string{"ops@example.com", "web@example.com"}, Filter: FilterConfig{Host: "web*"}},
+		},
+		Digests: []EmailDigest{{Schedule: ScheduleDaily, At: "08:00", Timezone: "UTC", To: []string{"boss@example.com"}}},
+	}
+	notifier, err := NewEmail(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	morning := time.Date(2018, 9, 26, 7, 0, 0, 0, time.UTC)
+	issues := map[string][]parser.NagiosStatus{
+		"web1": {{Hostname: "web1", Service: "HTTP", Instance: "nagios", State: "CRITICAL", Values: map[string]string{"plugin_output": "HTTP timeout"}}},
+	}
+	history := []svc.Event{
+		{Type: svc.EventOpened, Time: morning.Add(-time.Hour), Instance: "nagios", Hostname: "web1", Service: "HTTP", ToState: "CRITICAL"},
+		{Type: svc.EventOpened, Time: morning.Add(-3 * time.Hour), Instance: "nagios", Hostname: "db1", Service: "MySQL", ToState: "WARNING"},
+		{Type: svc.EventResolved, Time: morning.Add(-2 * time.Hour), Instance: "nagios", Hostname: "db1", Service: "MySQL", FromState: "WARNING", ToState: "OK"},
+	}
+	var since time.Time
+	refresh := func(now time.Time, events ...svc.Event) []Message {
+		msgs, err := notifier.Messages(Refresh{
+			Time:   now,
+			Events: events,
+			Issues: func() (map[string][]parser.NagiosStatus, error) { return issues, nil },
+			History: func(from time.Time) ([]svc.Event, error) {
+				since = from
+				return history, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+
+	msgs := refresh(morning, history[0])
+	if len(msgs) != 1 {
+		t.Fatalf("Want an alert and no digest before 08:00, have %d messages", len(msgs))
+	}
+	msgs[0].ID = "mail-1"
+	if err := notifier.Deliver(context.Background(), msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	mails := received()
+	if len(mails) != 1 {
+		t.Fatalf("Want an email, have %d", len(mails))
+	}
+	alert := mails[0]
+	if !alert.TLS || len(alert.To) != 3 || !strings.Contains(alert.From, "nagios@example.com") || !strings.HasPrefix(alert.Auth, "AUTH PLAIN") {
+		t.Errorf("Unexpected envelope %+v", alert)
+	}
+	for _, want := range []string{"Subject: [nagiosagg] web1: HTTP is CRITICAL", "Message-ID: <mail-1@nagiosagg>", "multipart/alternative", "text/plain", "text/html"} {
+		if !strings.Contains(alert.Data, want) {
+			t.Errorf("Want %q in the email:\n%s", want, alert.Data)
+		}
+	}
+
+	msgs = refresh(morning.Add(90 * time.Minute))
+	if len(msgs) != 1 || msgs[0].Type != "digest" {
+		t.Fatalf("Want the digest after 08:00, have %+v", msgs)
+	}
+	if want := morning.Add(-23 * time.Hour); !since.Equal(want) {
+		t.Errorf("Want the events since %s, have %s", want, since)
+	}
+	var digest emailMessage
+	json.Unmarshal(msgs[0].Body, &digest)
+	if digest.Subject != "[nagiosagg] Daily digest: 1 open, 2 new, 1 resolved problems" || len(digest.To) != 1 {
+		t.Errorf("Unexpected digest %q to %v", digest.Subject, digest.To)
+	}
+	for _, want := range []string{"Open problems (1)", "web1/HTTP (nagios) CRITICAL: HTTP timeout", "Resolved problems (1)", "db1: 2 events", "web1: 1 events"} {
+		if !strings.Contains(digest.Text, want) {
+			t.Errorf("Want %q in the digest:\n%s", want, digest.Text)
+		}
+	}
+	if !strings.Contains(digest.HTML, "<td>HTTP timeout</td>") {
+		t.Errorf("Want the output in the HTML digest:\n%s", digest.HTML)
+	}
+	if msgs := refresh(morning.Add(3 * time.Hour)); len(msgs) != 0 {
+		t.Errorf("Want a single digest a day, have %d messages", len(msgs))
+	}
+
+	// Rejected recipients are skipped, the email is dropped when nobody is left
+	rejected := func(to ...string) error {
+		body, _ := json.Marshal(emailMessage{To: to, Subject: "test", Text: "test"})
+		return notifier.Deliver(context.Background(), Message{ID: "mail-2", Body: body})
+	}
+	if err := rejected("nobody@unknown.example.com", "ops@example.com"); err != nil || len(received()) != 2 || len(received()[1].To) != 1 {
+		t.Errorf("Want the email delivered to the known recipient, have %v", err)
+	}
+	if err := rejected("nobody@unknown.example.com"); !IsPermanent(err) {
+		t.Errorf("Want a permanent error without recipients, have %v", err)
+	}
+
+	// Servers without STARTTLS are refused unless tls is none
+	plainAddr, _ := fakeSMTP(t, nil)
+	_, port, _ = net.SplitHostPort(plainAddr)
+	config.Port, _ = strconv.Atoi(port)
+	plain, _ := NewEmail(config)
+	if err := plain.Deliver(context.Background(), msgs[0]); !IsPermanent(err) {
+		t.Errorf("Want a permanent error without STARTTLS, have %v", err)
+	}
+	config.TLS = TLSNone
+	plain, _ = NewEmail(config)
+	if err := plain.Deliver(context.Background(), msgs[0]); err != nil {
+		t.Errorf("Want the email sent without TLS, have %v", err)
+	}
+
+	// The rules and digests delay flapping issues together
+	delayed := config
+	delayed.Rules = []EmailRule{{To: []string{"ops@example.com"}, Filter: FilterConfig{DelayFlapping: true}}}
+	if _, err := NewEmail(delayed); err == nil {
+		t.Error("Want an error for a digest not delaying flapping issues like the rules")
+	}
+	delayed.Digests = []EmailDigest{{Schedule: ScheduleDaily, To: []string{"boss@example.com"}, Filter: FilterConfig{DelayFlapping: true}}}
+	if n, err := NewEmail(delayed, WithFlapWindow(3)); err != nil || n.(*flapDelay).window != 3 {
+		t.Errorf("Want the emails delayed over the flap window, have %v", err)
+	}
+
+	// The digest schedule survives a restart, a digest due in between is sent after it
+	localDB := filepath.Join(testutil.TempDir(t), "nagios.db")
+	restarted := func() *Dispatcher {
+		notifier, _ = NewEmail(config)
+		return NewDispatcher(localDB, fastRetries, log.NewNopLogger(), notifier)
+	}
+	noIssues := func() (map[string][]parser.NagiosStatus, error) { return nil, nil }
+	noHistory := func(time.Time) ([]svc.Event, error) { return nil, nil }
+	restarted().Enqueue(Refresh{Time: morning, Issues: noIssues, History: noHistory})
+	dispatcher := restarted()
+	dispatcher.Enqueue(Refresh{Time: morning.Add(2 * time.Hour), Issues: noIssues, History: noHistory})
+	if pending, _ := dispatcher.Pending(); pending["mail"] != 1 {
+		t.Errorf("Want the digest due during the restart, have %v", pending)
+	}
+}
@@ -0,0 +1,476 @@
+package notify
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// outboxBucket holds a bucket of queued messages per notifier, in delivery order
+var outboxBucket = []byte("NagiosOutbox")
+
+// stateBucket holds the state of the stateful notifiers, by name
+var stateBucket = []byte("NagiosNotifyState")
+
+// outboxEntry is a queued message and the state of its delivery
+type outboxEntry struct {
+	Message     Message   `json:"message"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type worker struct {
+	notifier Notifier
+	wake     chan struct{}
+}
+
+// Dispatcher queues the messages of the notifiers in the outbox and delivers them in order.
+// Every notifier has its own queue, a failing notifier doesn't hold back the others
+type Dispatcher struct {
+	localDB string
+	policy  RetryPolicy
+	logger  log.Logger
+	workers []worker
+
+	mu sync.Mutex
+	// restored is set once the state of the notifiers was read from the local DB
+	restored bool
+}
+
+// NewDispatcher returns a dispatcher keeping its outbox in localDB, the bolt DB of the service
+func NewDispatcher(localDB string, policy RetryPolicy, logger log.Logger, notifiers ...Notifier) *Dispatcher {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	d := &Dispatcher{localDB: localDB, policy: policy, logger: logger}
+	for _, n := range notifiers {
+		d.workers = append(d.workers, worker{notifier: n, wake: make(chan struct{}, 1)})
+	}
+	return d
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// restore reads the state the notifiers had before a restart
+func (d *Dispatcher) restore() error {
+	if d.restored {
+		return nil
+	}
+	localDB, err := bolt.Open(d.localDB, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		states := tx.Bucket(stateBucket)
+		if states == nil {
+			return nil
+		}
+		for _, w := range d.workers {
+			n, ok := w.notifier.(stateful)
+			if !ok {
+				continue
+			}
+			if state := states.Get([]byte(w.notifier.Name())); state != nil {
+				if err := n.restore(state); err != nil {
+					return fmt.Errorf("%s: %v", w.notifier.Name(), err)
+				}
+			}
+		}
+		return nil
+	})
+	localDB.Close()
+	if err == nil {
+		d.restored = true
+	}
+	return err
+}
+
+// Enqueue queues the messages of every notifier for a refresh and wakes up their delivery.
+// A notifier failing to build its messages doesn't keep the others from being queued,
+// the messages it built before failing are queued too. The state of the notifiers is stored with the messages
+func (d *Dispatcher) Enqueue(refresh Refresh) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.restore(); err != nil {
+		// The notifiers start over rather than hold back the notifications
+		d.logger.Log("component", "notify", "err", err.Error())
+		d.restored = true
+	}
+	now := time.Now()
+	if refresh.Time.IsZero() {
+		refresh.Time = now
+	}
+	if refresh.Issues == nil {
+		refresh.Issues = func() (map[string][]parser.NagiosStatus, error) {
+			return nil, fmt.Errorf("issues not available")
+		}
+	}
+	if refresh.History == nil {
+		refresh.History = func(time.Time) ([]svc.Event, error) {
+			return nil, fmt.Errorf("event history not available")
+		}
+	}
+	queued := make(map[string][]Message)
+	notifiers := make(map[string]Notifier)
+	states := make(map[string][]byte)
+	var firstErr error
+	for _, w := range d.workers {
+		notifiers[w.notifier.Name()] = w.notifier
+		msgs, err := w.notifier.Messages(refresh)
+		if err != nil {
+			d.logger.Log("component", "notify", "notifier", w.notifier.Name(), "err", err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if len(msgs) > 0 {
+			queued[w.notifier.Name()] = msgs
+		}
+		if n, ok := w.notifier.(stateful); ok {
+			state, err := n.state()
+			if err != nil {
+				d.logger.Log("component", "notify", "notifier", w.notifier.Name(), "err", err.Error())
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			states[w.notifier.Name()] = state
+		}
+	}
+	if len(queued) == 0 && len(states) == 0 {
+		return firstErr
+	}
+	localDB, err := bolt.Open(d.localDB, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = localDB.Update(func(tx *bolt.Tx) error {
+		outbox, err := tx.CreateBucketIfNotExists(outboxBucket)
+		if err != nil {
+			return err
+		}
+		for name, msgs := range queued {
+			b, err := outbox.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				if msg.Replace {
+					if msg, err = replace(b, unwrap(notifiers[name]), msg); err != nil {
+						return err
+					}
+				}
+				seq, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				msg.ID = fmt.Sprintf("%s-%d", name, seq)
+				entryB, err := json.Marshal(outboxEntry{Message: msg, QueuedAt: now, NextAttempt: now})
+				if err != nil {
+					return err
+				}
+				if err := b.Put(itob(seq), entryB); err != nil {
+					return err
+				}
+			}
+		}
+		if len(states) == 0 {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		for name, state := range states {
+			if err := b.Put([]byte(name), state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	localDB.Close()
+	if err != nil {
+		return err
+	}
+	for _, w := range d.workers {
+		if _, found := queued[w.notifier.Name()]; found {
+			select {
+			case w.wake <- struct{}{}:
+			default:
+				// A wake up is already pending
+			}
+		}
+	}
+	return firstErr
+}
+
+// replace drops the undelivered messages of the queue of n that msg replaces, merging them into msg
+func replace(b *bolt.Bucket, n Notifier, msg Message) (Message, error) {
+	replaced := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		var entry outboxEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		if !entry.Message.Replace || entry.Message.Type != msg.Type {
+			return nil
+		}
+		if m, ok := n.(merger); ok {
+			merged, err := m.merge(entry.Message, msg)
+			if err != nil {
+				return err
+			}
+			msg = merged
+		}
+		replaced = append(replaced, k)
+		return nil
+	})
+	if err != nil {
+		return msg, err
+	}
+	for _, k := range replaced {
+		if err := b.Delete(k); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// Pending returns the number of queued messages per notifier
+func (d *Dispatcher) Pending() (map[string]int, error) {
+	pending := make(map[string]int)
+	localDB, err := bolt.Open(d.localDB, 0600, nil)
+	if err != nil {
+		return pending, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return nil
+		}
+		return outbox.ForEach(func(name, _ []byte) error {
+			pending[string(name)] = outbox.Bucket(name).Stats().KeyN
+			return nil
+		})
+	})
+	localDB.Close()
+	return pending, err
+}
+
+// Run delivers the queued messages until ctx is cancelled. Messages and state left by notifiers
+// that are no longer configured are dropped
+func (d *Dispatcher) Run(ctx context.Context) {
+	if err := d.dropUnknown(); err != nil {
+		d.logger.Log("component", "notify", "err", err.Error())
+	}
+	var wg sync.WaitGroup
+	for _, w := range d.workers {
+		wg.Add(1)
+		go func(w worker) {
+			defer wg.Done()
+			d.work(ctx, w)
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) dropUnknown() error {
+	known := make(map[string]bool)
+	for _, w := range d.workers {
+		known[w.notifier.Name()] = true
+	}
+	localDB, err := bolt.Open(d.localDB, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = localDB.Update(func(tx *bolt.Tx) error {
+		if states := tx.Bucket(stateBucket); states != nil {
+			unknown := [][]byte{}
+			err := states.ForEach(func(name, _ []byte) error {
+				if !known[string(name)] {
+					unknown = append(unknown, name)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, name := range unknown {
+				if err := states.Delete(name); err != nil {
+					return err
+				}
+			}
+		}
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return nil
+		}
+		unknown := [][]byte{}
+		err := outbox.ForEach(func(name, _ []byte) error {
+			if !known[string(name)] {
+				unknown = append(unknown, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range unknown {
+			d.logger.Log("component", "notify", "notifier", string(name), "dropped", outbox.Bucket(name).Stats().KeyN, "reason", "notifier not configured")
+			if err := outbox.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	localDB.Close()
+	return err
+}
+
+// work delivers the queue of a notifier, sleeping until the next retry is due or new messages are queued
+func (d *Dispatcher) work(ctx context.Context, w worker) {
+	for {
+		next := d.deliver(ctx, w.notifier)
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			retry = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-w.wake:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// head returns the first queued message of a notifier
+func (d *Dispatcher) head(name string) (key []byte, entry outboxEntry, found bool, err error) {
+	localDB, err := bolt.Open(d.localDB, 0600, nil)
+	if err != nil {
+		return nil, entry, false, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return nil
+		}
+		b := outbox.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().First()
+		if k == nil {
+			return nil
+		}
+		found = true
+		key = append([]byte(nil), k...)
+		return json.Unmarshal(v, &entry)
+	})
+	localDB.Close()
+	return key, entry, found, err
+}
+
+// settle removes a delivered or dropped message from the queue, or stores the outcome of a failed attempt
+func (d *Dispatcher) settle(name string, key []byte, entry *outboxEntry) error {
+	localDB, err := bolt.Open(d.localDB, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = localDB.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		if outbox == nil {
+			return nil
+		}
+		b := outbox.Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		if entry == nil {
+			return b.Delete(key)
+		}
+		if b.Get(key) == nil {
+			// Replaced while it was being delivered
+			return nil
+		}
+		entryB, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, entryB)
+	})
+	localDB.Close()
+	return err
+}
+
+// deliver sends the queued messages of a notifier in order. It returns when the queue is empty,
+// or with the time the first message is due again after a failure
+func (d *Dispatcher) deliver(ctx context.Context, n Notifier) time.Time {
+	name := n.Name()
+	for ctx.Err() == nil {
+		key, entry, found, err := d.head(name)
+		if err != nil {
+			d.logger.Log("component", "notify", "notifier", name, "err", err.Error())
+			return time.Now().Add(d.policy.InitialBackoff)
+		}
+		if !found {
+			return time.Time{}
+		}
+		if entry.NextAttempt.After(time.Now()) {
+			return entry.NextAttempt
+		}
+		err = n.Deliver(ctx, entry.Message)
+		if ctx.Err() != nil {
+			// Shutting down, the attempt doesn't count
+			return time.Time{}
+		}
+		entry.Attempts++
+		var settled *outboxEntry
+		switch {
+		case err == nil:
+		case IsPermanent(err) || entry.Attempts >= d.policy.MaxAttempts:
+			d.logger.Log("component", "notify", "notifier", name, "msg_id", entry.Message.ID, "attempts", entry.Attempts, "dropped", err.Error())
+		default:
+			entry.LastError = err.Error()
+			entry.NextAttempt = time.Now().Add(d.policy.backoff(entry.Attempts))
+			d.logger.Log("component", "notify", "notifier", name, "msg_id", entry.Message.ID, "attempts", entry.Attempts, "retry_at", entry.NextAttempt, "err", err.Error())
+			settled = &entry
+		}
+		if err := d.settle(name, key, settled); err != nil {
+			d.logger.Log("component", "notify", "notifier", name, "err", err.Error())
+			return time.Now().Add(d.policy.InitialBackoff)
+		}
+		if settled != nil {
+			return settled.NextAttempt
+		}
+	}
+	return time.Time{}
+}
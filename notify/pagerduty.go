@@ -0,0 +1,262 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// DefaultPagerDutyURL is the endpoint of the PagerDuty Events API v2
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty event actions
+const (
+	PagerDutyTrigger     = "trigger"
+	PagerDutyAcknowledge = "acknowledge"
+	PagerDutyResolve     = "resolve"
+)
+
+// PagerDutyRoute sends the issues of matching hosts to a PagerDuty service
+type PagerDutyRoute struct {
+	// Host and Service are glob patterns, or regular expressions when enclosed in slashes, like the /nagios filters
+	Host       string `yaml:"host"`
+	Service    string `yaml:"service"`
+	RoutingKey string `yaml:"routing_key"`
+
+	filter svc.Filter
+}
+
+// PagerDutyConfig configures the paging of issues through the PagerDuty Events API v2
+type PagerDutyConfig struct {
+	// Name identifies the integration in the outbox
+	Name string `yaml:"name"`
+	// URL defaults to DefaultPagerDutyURL
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// RoutingKey is the integration key of the issues not matching any route, they aren't paged when empty
+	RoutingKey string `yaml:"routing_key"`
+	// Routes are tried in order, the first route matching an issue selects its routing key
+	Routes []PagerDutyRoute `yaml:"routes"`
+	// ClientURL is the external URL of the aggregator, incidents link to its /hosts/{host} page
+	ClientURL string       `yaml:"client_url"`
+	Filter    FilterConfig `yaml:"filter"`
+}
+
+// PagerDutyEvent is an event of the PagerDuty Events API v2
+type PagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *PagerDutyPayload `json:"payload,omitempty"`
+	Client      string            `json:"client,omitempty"`
+	ClientURL   string            `json:"client_url,omitempty"`
+}
+
+// PagerDutyPayload describes the issue of a trigger event
+type PagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Component     string            `json:"component,omitempty"`
+	Group         string            `json:"group,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type pagerDuty struct {
+	config PagerDutyConfig
+	filter svc.Filter
+	// scope only keeps the instances, hosts and services of the filter. Acknowledgements and resolutions
+	// must go through even when the issue no longer matches the states or the acknowledged condition
+	scope  svc.Filter
+	client *http.Client
+}
+
+// NewPagerDuty returns a notifier triggering a PagerDuty incident when an issue opens, updating it when
+// the issue changes state, and acknowledging and resolving it along with nagios
+func NewPagerDuty(config PagerDutyConfig, opts ...Option) (Notifier, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("pagerduty needs a name")
+	}
+	if config.RoutingKey == "" && len(config.Routes) == 0 {
+		return nil, fmt.Errorf("pagerduty %s needs a routing_key or routes", config.Name)
+	}
+	if config.URL == "" {
+		config.URL = DefaultPagerDutyURL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	routes := make([]PagerDutyRoute, len(config.Routes))
+	for i, route := range config.Routes {
+		if route.RoutingKey == "" {
+			return nil, fmt.Errorf("pagerduty %s: route %d needs a routing_key", config.Name, i)
+		}
+		route.filter = svc.Filter{Host: route.Host, Service: route.Service}
+		if err := route.filter.Compile(); err != nil {
+			return nil, fmt.Errorf("pagerduty %s: route %d: %v", config.Name, i, err)
+		}
+		routes[i] = route
+	}
+	config.Routes = routes
+	filter, err := config.Filter.compile()
+	if err != nil {
+		return nil, fmt.Errorf("pagerduty %s: %v", config.Name, err)
+	}
+	scope, _ := FilterConfig{Host: config.Filter.Host, Service: config.Filter.Service, Instances: config.Filter.Instances,
+		HostGroups: config.Filter.HostGroups, ServiceGroups: config.Filter.ServiceGroups, Contacts: config.Filter.Contacts, Labels: config.Filter.Labels}.compile()
+	return withFlapDelay(config.Filter.DelayFlapping, opts, &pagerDuty{
+		config: config,
+		filter: filter,
+		scope:  scope,
+		client: &http.Client{Timeout: config.Timeout},
+	}), nil
+}
+
+func (p *pagerDuty) Name() string {
+	return p.config.Name
+}
+
+// pagerDutySeverity maps nagios states to the PagerDuty severities
+func pagerDutySeverity(state string) string {
+	switch state {
+	case "CRITICAL", "DOWN":
+		return "critical"
+	case "WARNING":
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// DedupKey identifies the PagerDuty incident of an issue
+func DedupKey(instance, hostname, service string) string {
+	key := instance + "/" + hostname
+	if service != "" {
+		key += "/" + service
+	}
+	return key
+}
+
+// routingKey returns the routing key of an issue, empty when it isn't paged
+func (p *pagerDuty) routingKey(status parser.NagiosStatus) string {
+	for _, route := range p.config.Routes {
+		if route.filter.Match(status, time.Time{}) {
+			return route.RoutingKey
+		}
+	}
+	return p.config.RoutingKey
+}
+
+// event converts a nagios event to a PagerDuty event, it returns false for the events that aren't paged
+func (p *pagerDuty) event(e svc.Event, now time.Time) (PagerDutyEvent, bool) {
+	status := e.Status()
+	pd := PagerDutyEvent{
+		DedupKey: DedupKey(e.Instance, e.Hostname, e.Service),
+		Client:   "nagiosagg",
+	}
+	switch e.Type {
+	case svc.EventOpened, svc.EventEscalated, svc.EventDeEscalated:
+		// Triggering an open incident again updates its severity and summary
+		if !p.filter.Match(status, now) {
+			return pd, false
+		}
+		pd.EventAction = PagerDutyTrigger
+		pd.Payload = p.payload(e, status)
+	case svc.EventAcknowledged:
+		if !p.scope.Match(status, now) {
+			return pd, false
+		}
+		pd.EventAction = PagerDutyAcknowledge
+	case svc.EventResolved:
+		if !p.scope.Match(status, now) {
+			return pd, false
+		}
+		pd.EventAction = PagerDutyResolve
+	default:
+		return pd, false
+	}
+	pd.RoutingKey = p.routingKey(status)
+	if pd.RoutingKey == "" {
+		return pd, false
+	}
+	if p.config.ClientURL != "" {
+		pd.ClientURL = strings.TrimSuffix(p.config.ClientURL, "/") + "/hosts/" + url.PathEscape(e.Hostname)
+	}
+	return pd, true
+}
+
+// cut returns at most the first n bytes of s, without splitting a UTF-8 sequence
+func cut(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (p *pagerDuty) payload(e svc.Event, status parser.NagiosStatus) *PagerDutyPayload {
+	subject := e.Hostname
+	if e.Service != "" {
+		subject += "/" + e.Service
+	}
+	summary := fmt.Sprintf("%s is %s", subject, e.ToState)
+	if e.Output != "" {
+		summary += ": " + e.Output
+	}
+	// PagerDuty rejects longer summaries
+	summary = cut(summary, 1024)
+	details := map[string]string{
+		"instance":   e.Instance,
+		"from_state": e.FromState,
+		"to_state":   e.ToState,
+	}
+	for _, key := range []string{"plugin_output", "long_plugin_output", "current_attempt", "max_attempts"} {
+		if value := status.Values[key]; value != "" {
+			details[key] = value
+		}
+	}
+	return &PagerDutyPayload{
+		Summary:       summary,
+		Source:        e.Hostname,
+		Severity:      pagerDutySeverity(e.ToState),
+		Timestamp:     e.Time.UTC(),
+		Component:     e.Service,
+		Group:         e.Instance,
+		Class:         e.ToState,
+		CustomDetails: details,
+	}
+}
+
+// Messages returns a PagerDuty event per paged transition. Resolutions and acknowledgements only
+// check the instance, host and service of the filter, PagerDuty ignores those of unknown incidents
+func (p *pagerDuty) Messages(refresh Refresh) ([]Message, error) {
+	msgs := []Message{}
+	for _, e := range refresh.Events {
+		pd, paged := p.event(e, refresh.Time)
+		if !paged {
+			continue
+		}
+		body, err := json.Marshal(pd)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, Message{Type: pd.EventAction, Body: body})
+	}
+	return msgs, nil
+}
+
+func (p *pagerDuty) Deliver(ctx context.Context, msg Message) error {
+	return postJSON(ctx, p.client, p.config.URL, nil, msg.Body)
+}
@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Webhook request headers
+const (
+	HeaderEvent     = "X-Nagiosagg-Event"
+	HeaderDelivery  = "X-Nagiosagg-Delivery"
+	HeaderSignature = "X-Nagiosagg-Signature"
+)
+
+// DefaultWebhookTimeout limits each webhook request
+const DefaultWebhookTimeout = 10 * time.Second
+
+// WebhookConfig configures a webhook receiving a JSON POST per event
+type WebhookConfig struct {
+	// Name identifies the webhook in the outbox, renaming it drops its queued messages
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Secret signs the payloads, the HMAC-SHA256 of the body is sent as sha256=<hex> in X-Nagiosagg-Signature
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// Events are the event types to send, opened, escalated and resolved by default
+	Events []string     `yaml:"events"`
+	Filter FilterConfig `yaml:"filter"`
+}
+
+type webhook struct {
+	config WebhookConfig
+	events eventFilter
+	client *http.Client
+}
+
+// NewWebhook returns a notifier POSTing every matching event as JSON to a URL
+func NewWebhook(config WebhookConfig, opts ...Option) (Notifier, error) {
+	if config.Name == "" || config.URL == "" {
+		return nil, fmt.Errorf("webhook needs a name and a url")
+	}
+	events, err := newEventFilter(config.Events, config.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s: %v", config.Name, err)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	return withFlapDelay(config.Filter.DelayFlapping, opts, &webhook{
+		config: config,
+		events: events,
+		client: &http.Client{Timeout: config.Timeout},
+	}), nil
+}
+
+func (w *webhook) Name() string {
+	return w.config.Name
+}
+
+// Messages returns a message per matching event, the body is the event as returned by /events
+func (w *webhook) Messages(refresh Refresh) ([]Message, error) {
+	msgs := []Message{}
+	for _, e := range refresh.Events {
+		if !w.events.match(e, refresh.Time) {
+			continue
+		}
+		body, err := json.Marshal(e)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, Message{Type: e.Type, Body: body})
+	}
+	return msgs, nil
+}
+
+// Sign returns the signature of a webhook body, as sent in X-Nagiosagg-Signature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhook) Deliver(ctx context.Context, msg Message) error {
+	header := httpHeader(w.config.Headers)
+	header.Set(HeaderEvent, msg.Type)
+	header.Set(HeaderDelivery, msg.ID)
+	if w.config.Secret != "" {
+		header.Set(HeaderSignature, Sign(w.config.Secret, msg.Body))
+	}
+	return postJSON(ctx, w.client, w.config.URL, header, msg.Body)
+}
+
+// httpHeader converts the headers of a config
+func httpHeader(headers map[string]string) http.Header {
+	header := http.Header{}
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+	return header
+}
+
+// postJSON posts a JSON body with the given headers and checks the response
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nagiosagg")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	return checkStatus(resp)
+}
+
+// checkStatus turns unsuccessful responses into errors. Client errors are permanent,
+// except for timeouts and rate limiting
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("unexpected response %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
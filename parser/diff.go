@@ -0,0 +1,183 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Classifications of a StatusChange
+const (
+	ChangeNew      = "new"
+	ChangeResolved = "resolved"
+	ChangeChanged  = "changed"
+)
+
+// StatusChange describes how a single host or service differs between two parsed status maps
+type StatusChange struct {
+	Kind     string        `json:"kind"`
+	Instance string        `json:"instance,omitempty"`
+	Hostname string        `json:"hostname"`
+	Service  string        `json:"service,omitempty"`
+	Fields   []string      `json:"fields,omitempty"`
+	Before   *NagiosStatus `json:"before,omitempty"`
+	After    *NagiosStatus `json:"after,omitempty"`
+}
+
+// Attempts returns the current/max attempts of a status as shown by nagios
+func (s NagiosStatus) Attempts() string {
+	return fmt.Sprintf("%s/%s", s.Values["current_attempt"], s.Values["max_attempts"])
+}
+
+// Acknowledged returns whether the problem has been acknowledged in nagios
+func (s NagiosStatus) Acknowledged() bool {
+	return s.Values["problem_has_been_acknowledged"] == "1"
+}
+
+// NagiosFlapping returns whether nagios detected the host or service as flapping
+func (s NagiosStatus) NagiosFlapping() bool {
+	return s.Values["is_flapping"] == "1"
+}
+
+// NagiosPercentStateChange returns the state change rate nagios computed over the recent checks
+func (s NagiosStatus) NagiosPercentStateChange() float64 {
+	percent, _ := strconv.ParseFloat(s.Values["percent_state_change"], 64)
+	return percent
+}
+
+// IsFlapping returns whether the aggregator or nagios detected the host or service as flapping
+func (s NagiosStatus) IsFlapping() bool {
+	return s.Flapping || s.NagiosFlapping()
+}
+
+func statusKey(s NagiosStatus) string {
+	return s.Instance + "\x00" + s.Hostname + "\x00" + s.Service
+}
+
+func indexStatuses(data map[string][]NagiosStatus) map[string]NagiosStatus {
+	index := make(map[string]NagiosStatus)
+	for _, statuses := range data {
+		for _, s := range statuses {
+			index[statusKey(s)] = s
+		}
+	}
+	return index
+}
+
+// changedFields lists the fields that differ between two statuses of the same host/service
+func changedFields(before, after NagiosStatus) []string {
+	var fields []string
+	if before.State != after.State {
+		fields = append(fields, "state")
+	}
+	if before.Values["plugin_output"] != after.Values["plugin_output"] {
+		fields = append(fields, "output")
+	}
+	if before.Attempts() != after.Attempts() {
+		fields = append(fields, "attempts")
+	}
+	if before.Acknowledged() != after.Acknowledged() {
+		fields = append(fields, "acknowledged")
+	}
+	return fields
+}
+
+// Diff compares two parsed status maps and classifies every host/service as new, resolved or changed
+// Entries that are identical in both maps are left out
+func Diff(from, to map[string][]NagiosStatus) []StatusChange {
+	fromIndex := indexStatuses(from)
+	toIndex := indexStatuses(to)
+	changes := []StatusChange{}
+
+	for key, after := range toIndex {
+		after := after
+		before, found := fromIndex[key]
+		if !found {
+			changes = append(changes, StatusChange{
+				Kind:     ChangeNew,
+				Instance: after.Instance,
+				Hostname: after.Hostname,
+				Service:  after.Service,
+				After:    &after,
+			})
+			continue
+		}
+		if fields := changedFields(before, after); len(fields) > 0 {
+			changes = append(changes, StatusChange{
+				Kind:     ChangeChanged,
+				Instance: after.Instance,
+				Hostname: after.Hostname,
+				Service:  after.Service,
+				Fields:   fields,
+				Before:   &before,
+				After:    &after,
+			})
+		}
+	}
+	for key, before := range fromIndex {
+		before := before
+		if _, found := toIndex[key]; found {
+			continue
+		}
+		changes = append(changes, StatusChange{
+			Kind:     ChangeResolved,
+			Instance: before.Instance,
+			Hostname: before.Hostname,
+			Service:  before.Service,
+			Before:   &before,
+		})
+	}
+
+	// Map iteration is random, keep the output stable
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Hostname != changes[j].Hostname {
+			return changes[i].Hostname < changes[j].Hostname
+		}
+		if changes[i].Instance != changes[j].Instance {
+			return changes[i].Instance < changes[j].Instance
+		}
+		return changes[i].Service < changes[j].Service
+	})
+	return changes
+}
+
+// WriteDiffText writes a human readable representation of changes, one per line
+func WriteDiffText(w io.Writer, changes []StatusChange) error {
+	for _, c := range changes {
+		name := c.Hostname
+		if c.Service != "" {
+			name = name + "/" + c.Service
+		}
+		if c.Instance != "" {
+			name = fmt.Sprintf("%s [%s]", name, c.Instance)
+		}
+		var line string
+		switch c.Kind {
+		case ChangeNew:
+			line = fmt.Sprintf("+ %s %s (%s): %s", name, c.After.State, c.After.Attempts(), c.After.Values["plugin_output"])
+		case ChangeResolved:
+			line = fmt.Sprintf("- %s %s resolved", name, c.Before.State)
+		case ChangeChanged:
+			details := []string{}
+			for _, field := range c.Fields {
+				switch field {
+				case "state":
+					details = append(details, fmt.Sprintf("state %s -> %s", c.Before.State, c.After.State))
+				case "attempts":
+					details = append(details, fmt.Sprintf("attempts %s -> %s", c.Before.Attempts(), c.After.Attempts()))
+				case "acknowledged":
+					details = append(details, fmt.Sprintf("acknowledged %t -> %t", c.Before.Acknowledged(), c.After.Acknowledged()))
+				case "output":
+					details = append(details, fmt.Sprintf("output: %s", c.After.Values["plugin_output"]))
+				}
+			}
+			line = fmt.Sprintf("~ %s %s", name, strings.Join(details, ", "))
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package parser
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Metadata is the configuration of a host or service joined from the objects.cache of its nagios instance
+type Metadata struct {
+	Alias   string `json:"alias,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Parents are the parent hosts of a host
+	Parents       []string `json:"parents,omitempty"`
+	HostGroups    []string `json:"host_groups,omitempty"`
+	ServiceGroups []string `json:"service_groups,omitempty"`
+	// Contacts include the members of the contact groups
+	Contacts      []string `json:"contacts,omitempty"`
+	ContactGroups []string `json:"contact_groups,omitempty"`
+	// CustomVars are the custom variables (_VAR) without the underscore, upper cased like nagios does
+	CustomVars map[string]string `json:"custom_vars,omitempty"`
+}
+
+// Objects are the hosts and services defined in an objects.cache file
+type Objects struct {
+	Hosts map[string]*Metadata
+	// Services are keyed by host name, then service description
+	Services map[string]map[string]*Metadata
+}
+
+// objectDefinition is a define block of an object configuration file
+type objectDefinition struct {
+	kind   string
+	values map[string]string
+	vars   map[string]string
+}
+
+// splitList splits a comma separated directive, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// appendUnique adds the items that aren't in list yet
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if existing == item {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseDefinitions reads the define blocks of an object configuration file
+func parseDefinitions(data *string) []objectDefinition {
+	definitions := []objectDefinition{}
+	var cur *objectDefinition
+	for _, l := range strings.Split(*data, "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || l[0] == '#' || l[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(l, "define ") || strings.HasPrefix(l, "define\t") {
+			kind := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(l[len("define"):]), "{"))
+			cur = &objectDefinition{kind: kind, values: make(map[string]string), vars: make(map[string]string)}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if l == "}" {
+			definitions = append(definitions, *cur)
+			cur = nil
+			continue
+		}
+		fields := strings.SplitN(l, "\t", 2)
+		if len(fields) < 2 {
+			fields = strings.SplitN(l, " ", 2)
+		}
+		key, value := fields[0], ""
+		if len(fields) == 2 {
+			value = strings.TrimSpace(fields[1])
+		}
+		if strings.HasPrefix(key, "_") {
+			cur.vars[strings.ToUpper(key[1:])] = value
+		} else {
+			cur.values[key] = value
+		}
+	}
+	return definitions
+}
+
+// ParseObjectsFromFile reads the hosts and services of an objects.cache file
+func ParseObjectsFromFile(f string) (Objects, error) {
+	raw, err := ioutil.ReadFile(f)
+	if err != nil {
+		return Objects{}, err
+	}
+	data := string(raw)
+	return ParseObjects(&data)
+}
+
+// ParseObjects parses the hosts and services of an objects.cache file, with their groups and contacts.
+// Group memberships are read from both the members of the groups and the groups of the members
+func ParseObjects(data *string) (Objects, error) {
+	objects := Objects{Hosts: make(map[string]*Metadata), Services: make(map[string]map[string]*Metadata)}
+	definitions := parseDefinitions(data)
+	contactGroups := make(map[string][]string)
+	for _, def := range definitions {
+		if def.kind == "contactgroup" {
+			name := def.values["contactgroup_name"]
+			contactGroups[name] = appendUnique(contactGroups[name], splitList(def.values["members"])...)
+		}
+	}
+	newMetadata := func(def objectDefinition) *Metadata {
+		m := &Metadata{
+			Contacts:      splitList(def.values["contacts"]),
+			ContactGroups: splitList(def.values["contact_groups"]),
+		}
+		for _, group := range m.ContactGroups {
+			m.Contacts = appendUnique(m.Contacts, contactGroups[group]...)
+		}
+		if len(def.vars) > 0 {
+			m.CustomVars = def.vars
+		}
+		return m
+	}
+	service := func(host, description string) *Metadata {
+		if objects.Services[host] == nil {
+			objects.Services[host] = make(map[string]*Metadata)
+		}
+		if objects.Services[host][description] == nil {
+			objects.Services[host][description] = &Metadata{}
+		}
+		return objects.Services[host][description]
+	}
+	for _, def := range definitions {
+		switch def.kind {
+		case "host":
+			name := def.values["host_name"]
+			if name == "" {
+				continue
+			}
+			m := newMetadata(def)
+			m.Alias = def.values["alias"]
+			m.Address = def.values["address"]
+			m.Parents = splitList(def.values["parents"])
+			m.HostGroups = splitList(def.values["hostgroups"])
+			if existing := objects.Hosts[name]; existing != nil {
+				m.HostGroups = appendUnique(existing.HostGroups, m.HostGroups...)
+			}
+			objects.Hosts[name] = m
+		case "service":
+			host, description := def.values["host_name"], def.values["service_description"]
+			if host == "" || description == "" {
+				continue
+			}
+			m := newMetadata(def)
+			m.ServiceGroups = appendUnique(service(host, description).ServiceGroups, splitList(def.values["servicegroups"])...)
+			objects.Services[host][description] = m
+		}
+	}
+	for _, def := range definitions {
+		switch def.kind {
+		case "hostgroup":
+			group := def.values["hostgroup_name"]
+			for _, host := range splitList(def.values["members"]) {
+				if objects.Hosts[host] == nil {
+					objects.Hosts[host] = &Metadata{}
+				}
+				objects.Hosts[host].HostGroups = appendUnique(objects.Hosts[host].HostGroups, group)
+			}
+		case "servicegroup":
+			// Members are host,service pairs
+			group := def.values["servicegroup_name"]
+			members := splitList(def.values["members"])
+			for i := 0; i+1 < len(members); i += 2 {
+				m := service(members[i], members[i+1])
+				m.ServiceGroups = appendUnique(m.ServiceGroups, group)
+			}
+		}
+	}
+	for _, m := range objects.Hosts {
+		sort.Strings(m.HostGroups)
+	}
+	for _, services := range objects.Services {
+		for _, m := range services {
+			sort.Strings(m.ServiceGroups)
+		}
+	}
+	return objects, nil
+}
+
+// Join sets the metadata of the host and service statuses of blocks. Services also get the alias,
+// address and groups of their host. Custom variables of the status files take precedence, they are current
+func (o Objects) Join(blocks []NagiosStatus) {
+	for i := range blocks {
+		block := &blocks[i]
+		host := o.Hosts[block.Hostname]
+		var m Metadata
+		switch block.StatusType {
+		case "hoststatus", "host":
+			if host == nil {
+				continue
+			}
+			m = *host
+		case "servicestatus", "service":
+			if service := o.Services[block.Hostname][block.Service]; service != nil {
+				m = *service
+			}
+			if host != nil {
+				m.Alias, m.Address, m.HostGroups = host.Alias, host.Address, host.HostGroups
+			}
+		default:
+			continue
+		}
+		if len(m.CustomVars) > 0 {
+			vars := make(map[string]string)
+			for name, value := range m.CustomVars {
+				vars[name] = value
+			}
+			for name, value := range block.CustomVars {
+				vars[name] = value
+			}
+			m.CustomVars = vars
+		} else {
+			m.CustomVars = block.CustomVars
+		}
+		block.Metadata = m
+	}
+}
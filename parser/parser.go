@@ -9,10 +9,29 @@ import (
 // NagiosStatus is a status structure for nagios events
 type NagiosStatus struct {
 	StatusType string            `json:"status_type,omitempty"`
+	Instance   string            `json:"instance,omitempty"`
 	Hostname   string            `json:"hostname,omitempty"`
 	Service    string            `json:"service,omitempty"`
 	State      string            `json:"state,omitempty"`
 	Values     map[string]string `json:"values,omitempty"`
+	// Flapping and FlapPercent are computed by the aggregator from the states seen by its recent refreshes
+	Flapping    bool    `json:"flapping,omitempty"`
+	FlapPercent float64 `json:"flap_percent,omitempty"`
+	// SuppressedBy is the DOWN or UNREACHABLE host causing the problem, set by the aggregator
+	SuppressedBy string `json:"suppressed_by,omitempty"`
+	// Metadata is only set when the objects.cache of the instance is available, except for the custom
+	// variables which status files carry as well
+	Metadata
+	// Labels are derived from the custom variables by the aggregator
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// customVarValue strips the modified flag status files prefix custom variable values with, as in _TAGS=0;tcp
+func customVarValue(value string) string {
+	if len(value) > 1 && (value[0] == '0' || value[0] == '1') && value[1] == ';' {
+		return value[2:]
+	}
+	return value
 }
 
 func getRegExMap() (map[string]*regexp.Regexp, error) {
@@ -69,8 +88,28 @@ func ParseStatusFromFile(f string) (map[string][]NagiosStatus, error) {
 
 // ParseStatus parses status and returns a mapped list of issues per hostname
 func ParseStatus(data *string) (map[string][]NagiosStatus, error) {
+	blocks, err := ParseBlocks(data)
+	if err != nil {
+		return make(map[string][]NagiosStatus), err
+	}
+	return Problems(blocks), nil
+}
+
+// ParseBlocksFromFile reads every block of a nagios status file
+func ParseBlocksFromFile(f string) ([]NagiosStatus, error) {
+	raw, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	data := string(raw)
+	return ParseBlocks(&data)
+}
+
+// ParseBlocks parses every block of a status file, including OK statuses, comments and downtimes
+// State and Service are only set for host and service statuses
+func ParseBlocks(data *string) ([]NagiosStatus, error) {
 	mapping := getStateMapping()
-	result := make(map[string][]NagiosStatus)
+	result := []NagiosStatus{}
 	lines := strings.Split(*data, "\n")
 	reMap, err := getRegExMap()
 	if err != nil {
@@ -94,17 +133,17 @@ func ParseStatus(data *string) (map[string][]NagiosStatus, error) {
 			value := subMatch[2]
 			if key == "host_name" {
 				cur.Hostname = value
+			} else if strings.HasPrefix(key, "_") {
+				if cur.CustomVars == nil {
+					cur.CustomVars = make(map[string]string)
+				}
+				cur.CustomVars[strings.ToUpper(key[1:])] = customVarValue(value)
 			} else {
 				cur.Values[key] = value
 			}
 			continue
 		}
 		if matchID := reEnd.MatchString(l); matchID {
-			if _, found := cur.Values["current_state"]; !found {
-				// State not found = invalid alert, move on
-				cur = newNagiosStatus()
-				continue
-			}
 			if cur.StatusType == "hoststatus" {
 				cur.State = mapping["hosts"][cur.Values["current_state"]]
 			}
@@ -112,14 +151,26 @@ func ParseStatus(data *string) (map[string][]NagiosStatus, error) {
 				cur.State = mapping["services"][cur.Values["current_state"]]
 				cur.Service = cur.Values["service_description"]
 			}
-			// Skip if the service is OK
-			if cur.State == "OK" {
-				cur = newNagiosStatus()
-				continue
-			}
-			result[cur.Hostname] = append(result[cur.Hostname], cur)
+			result = append(result, cur)
 			cur = newNagiosStatus()
 		}
 	}
 	return result, err
 }
+
+// Problems returns the statuses that are not OK as a mapped list of issues per hostname
+func Problems(blocks []NagiosStatus) map[string][]NagiosStatus {
+	result := make(map[string][]NagiosStatus)
+	for _, block := range blocks {
+		if _, found := block.Values["current_state"]; !found {
+			// State not found = invalid alert, move on
+			continue
+		}
+		// Skip if the service is OK
+		if block.State == "OK" {
+			continue
+		}
+		result[block.Hostname] = append(result[block.Hostname], block)
+	}
+	return result
+}
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"flag"
+	"strings"
 	"testing"
 )
 
@@ -78,3 +79,135 @@ func TestParser(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestDiff(t *testing.T) {
+	before, err := ParseStatusFromFile("../samples/public/random3.dat")
+	if err != nil {
+		t.Errorf("Failed to parse nagios status:%v", err)
+		t.FailNow()
+	}
+	after, err := ParseStatusFromFile("../samples/public/random3.dat")
+	if err != nil {
+		t.Errorf("Failed to parse nagios status:%v", err)
+		t.FailNow()
+	}
+	if changes := Diff(before, after); len(changes) != 0 {
+		t.Errorf("Expected no changes between identical files, found %d", len(changes))
+	}
+
+	var host string
+	for host = range after {
+		break
+	}
+	resolved := after[host][0]
+	changed := after[host][0]
+	changed.Service = "changed-service"
+	changed.State = "CRITICAL"
+	before[host] = append(before[host], changed)
+	changed.Values = map[string]string{"plugin_output": "new output"}
+	changed.State = "WARNING"
+	after[host] = append(after[host][1:], changed)
+
+	kinds := map[string]int{}
+	for _, c := range Diff(before, after) {
+		kinds[c.Kind]++
+		if c.Kind == ChangeResolved && (c.Hostname != resolved.Hostname || c.Service != resolved.Service) {
+			t.Errorf("Wrong issue resolved: %s/%s", c.Hostname, c.Service)
+		}
+		if c.Kind == ChangeChanged && len(c.Fields) < 2 {
+			t.Errorf("Expected state and output to change, found %v", c.Fields)
+		}
+	}
+	if kinds[ChangeResolved] != 1 || kinds[ChangeChanged] != 1 || kinds[ChangeNew] != 0 {
+		t.Errorf("Unexpected classification: %v", kinds)
+	}
+}
+
+func TestParseObjects(t *testing.T) {
+	data := `# Nagios objects cache
+define contactgroup {
+	contactgroup_name	admins
+	members	alice,bob
+	}
+
+define hostgroup {
+	hostgroup_name	web-servers
+	members	web1
+	}
+
+define servicegroup {
+	servicegroup_name	frontends
+	members	web1,HTTP,web2,HTTP
+	}
+
+define host {
+	host_name	web1
+	alias	Web server
+	address	10.0.0.5
+	parents	switch1, router1
+	hostgroups	linux
+	contact_groups	admins
+	_TAGS	prod lan
+	}
+
+define service {
+	host_name	web1
+	service_description	HTTP
+	contacts	carol
+	contact_groups	admins
+	_runbook	https://wiki/http
+	}
+`
+	objects, err := ParseObjects(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := objects.Hosts["web1"]
+	if host == nil || host.Alias != "Web server" || host.Address != "10.0.0.5" || len(host.Parents) != 2 || host.Parents[1] != "router1" {
+		t.Fatalf("Unexpected host %+v", host)
+	}
+	if strings.Join(host.HostGroups, ",") != "linux,web-servers" || strings.Join(host.Contacts, ",") != "alice,bob" || host.CustomVars["TAGS"] != "prod lan" {
+		t.Errorf("Unexpected groups, contacts or variables %+v", host)
+	}
+	service := objects.Services["web1"]["HTTP"]
+	if service == nil || strings.Join(service.ServiceGroups, ",") != "frontends" || strings.Join(service.Contacts, ",") != "carol,alice,bob" || service.CustomVars["RUNBOOK"] != "https://wiki/http" {
+		t.Errorf("Unexpected service %+v", service)
+	}
+
+	blocks := []NagiosStatus{
+		{StatusType: "hoststatus", Hostname: "web1"},
+		{StatusType: "servicestatus", Hostname: "web1", Service: "HTTP"},
+		{StatusType: "servicestatus", Hostname: "db1", Service: "MySQL"},
+	}
+	objects.Join(blocks)
+	if blocks[0].Alias != "Web server" || len(blocks[0].Parents) != 2 {
+		t.Errorf("Want the host metadata on the host status, have %+v", blocks[0].Metadata)
+	}
+	if blocks[1].Address != "10.0.0.5" || len(blocks[1].HostGroups) != 2 || len(blocks[1].ServiceGroups) != 1 || blocks[1].Parents != nil {
+		t.Errorf("Want the service and host metadata on the service status, have %+v", blocks[1].Metadata)
+	}
+	if blocks[2].Alias != "" || blocks[2].CustomVars != nil {
+		t.Errorf("Want no metadata for unknown objects, have %+v", blocks[2].Metadata)
+	}
+}
+
+func TestCustomVars(t *testing.T) {
+	data := `hoststatus {
+	host_name=web1
+	current_state=1
+	_TAGS=0;cmk-agent prod lan tcp
+	_FILENAME=1;/wato/hosts.mk
+	}
+`
+	blocks, err := ParseBlocks(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := blocks[0].CustomVars
+	if len(vars) != 2 || vars["TAGS"] != "cmk-agent prod lan tcp" || vars["FILENAME"] != "/wato/hosts.mk" {
+		t.Errorf("Unexpected custom variables %v", vars)
+	}
+	if _, found := blocks[0].Values["_TAGS"]; found {
+		t.Errorf("Want custom variables out of the values")
+	}
+}
@@ -0,0 +1,256 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.21.12
+// source: nagiosagg.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Nagios_GetIssues_FullMethodName     = "/nagiosagg.Nagios/GetIssues"
+	Nagios_Refresh_FullMethodName       = "/nagiosagg.Nagios/Refresh"
+	Nagios_WatchIssues_FullMethodName   = "/nagiosagg.Nagios/WatchIssues"
+	Nagios_ListInstances_FullMethodName = "/nagiosagg.Nagios/ListInstances"
+)
+
+// NagiosClient is the client API for Nagios service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type NagiosClient interface {
+	// GetIssues returns the issues of the latest refresh matching the filter
+	GetIssues(ctx context.Context, in *GetIssuesRequest, opts ...grpc.CallOption) (*GetIssuesReply, error)
+	// Refresh parses the status files and reports on the outcome. It is rate limited like the HTTP refresh
+	Refresh(ctx context.Context, in *RefreshRequest, opts ...grpc.CallOption) (*RefreshReply, error)
+	// WatchIssues streams the state transitions of future refreshes matching the filter
+	WatchIssues(ctx context.Context, in *WatchIssuesRequest, opts ...grpc.CallOption) (Nagios_WatchIssuesClient, error)
+	// ListInstances returns the nagios instances of the latest refresh
+	ListInstances(ctx context.Context, in *ListInstancesRequest, opts ...grpc.CallOption) (*ListInstancesReply, error)
+}
+
+type nagiosClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewNagiosClient(cc grpc.ClientConnInterface) NagiosClient {
+	return &nagiosClient{cc}
+}
+
+func (c *nagiosClient) GetIssues(ctx context.Context, in *GetIssuesRequest, opts ...grpc.CallOption) (*GetIssuesReply, error) {
+	out := new(GetIssuesReply)
+	err := c.cc.Invoke(ctx, Nagios_GetIssues_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nagiosClient) Refresh(ctx context.Context, in *RefreshRequest, opts ...grpc.CallOption) (*RefreshReply, error) {
+	out := new(RefreshReply)
+	err := c.cc.Invoke(ctx, Nagios_Refresh_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nagiosClient) WatchIssues(ctx context.Context, in *WatchIssuesRequest, opts ...grpc.CallOption) (Nagios_WatchIssuesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Nagios_ServiceDesc.Streams[0], Nagios_WatchIssues_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &nagiosWatchIssuesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Nagios_WatchIssuesClient interface {
+	Recv() (*IssueEvent, error)
+	grpc.ClientStream
+}
+
+type nagiosWatchIssuesClient struct {
+	grpc.ClientStream
+}
+
+func (x *nagiosWatchIssuesClient) Recv() (*IssueEvent, error) {
+	m := new(IssueEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *nagiosClient) ListInstances(ctx context.Context, in *ListInstancesRequest, opts ...grpc.CallOption) (*ListInstancesReply, error) {
+	out := new(ListInstancesReply)
+	err := c.cc.Invoke(ctx, Nagios_ListInstances_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// NagiosServer is the server API for Nagios service.
+// All implementations must embed UnimplementedNagiosServer
+// for forward compatibility
+type NagiosServer interface {
+	// GetIssues returns the issues of the latest refresh matching the filter
+	GetIssues(context.Context, *GetIssuesRequest) (*GetIssuesReply, error)
+	// Refresh parses the status files and reports on the outcome. It is rate limited like the HTTP refresh
+	Refresh(context.Context, *RefreshRequest) (*RefreshReply, error)
+	// WatchIssues streams the state transitions of future refreshes matching the filter
+	WatchIssues(*WatchIssuesRequest, Nagios_WatchIssuesServer) error
+	// ListInstances returns the nagios instances of the latest refresh
+	ListInstances(context.Context, *ListInstancesRequest) (*ListInstancesReply, error)
+	mustEmbedUnimplementedNagiosServer()
+}
+
+// UnimplementedNagiosServer must be embedded to have forward compatible implementations.
+type UnimplementedNagiosServer struct {
+}
+
+func (UnimplementedNagiosServer) GetIssues(context.Context, *GetIssuesRequest) (*GetIssuesReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetIssues not implemented")
+}
+func (UnimplementedNagiosServer) Refresh(context.Context, *RefreshRequest) (*RefreshReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Refresh not implemented")
+}
+func (UnimplementedNagiosServer) WatchIssues(*WatchIssuesRequest, Nagios_WatchIssuesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchIssues not implemented")
+}
+func (UnimplementedNagiosServer) ListInstances(context.Context, *ListInstancesRequest) (*ListInstancesReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListInstances not implemented")
+}
+func (UnimplementedNagiosServer) mustEmbedUnimplementedNagiosServer() {}
+
+// UnsafeNagiosServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to NagiosServer will
+// result in compilation errors.
+type UnsafeNagiosServer interface {
+	mustEmbedUnimplementedNagiosServer()
+}
+
+func RegisterNagiosServer(s grpc.ServiceRegistrar, srv NagiosServer) {
+	s.RegisterService(&Nagios_ServiceDesc, srv)
+}
+
+func _Nagios_GetIssues_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIssuesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NagiosServer).GetIssues(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Nagios_GetIssues_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NagiosServer).GetIssues(ctx, req.(*GetIssuesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Nagios_Refresh_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NagiosServer).Refresh(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Nagios_Refresh_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NagiosServer).Refresh(ctx, req.(*RefreshRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Nagios_WatchIssues_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchIssuesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NagiosServer).WatchIssues(m, &nagiosWatchIssuesServer{stream})
+}
+
+type Nagios_WatchIssuesServer interface {
+	Send(*IssueEvent) error
+	grpc.ServerStream
+}
+
+type nagiosWatchIssuesServer struct {
+	grpc.ServerStream
+}
+
+func (x *nagiosWatchIssuesServer) Send(m *IssueEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Nagios_ListInstances_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListInstancesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NagiosServer).ListInstances(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Nagios_ListInstances_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NagiosServer).ListInstances(ctx, req.(*ListInstancesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Nagios_ServiceDesc is the grpc.ServiceDesc for Nagios service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Nagios_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nagiosagg.Nagios",
+	HandlerType: (*NagiosServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetIssues",
+			Handler:    _Nagios_GetIssues_Handler,
+		},
+		{
+			MethodName: "Refresh",
+			Handler:    _Nagios_Refresh_Handler,
+		},
+		{
+			MethodName: "ListInstances",
+			Handler:    _Nagios_ListInstances_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchIssues",
+			Handler:       _Nagios_WatchIssues_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "nagiosagg.proto",
+}
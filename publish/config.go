@@ -0,0 +1,80 @@
+package publish
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-kit/kit/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the publisher config file
+type Config struct {
+	NATS      []NATSConfig      `yaml:"nats"`
+	JSONLines []JSONLinesConfig `yaml:"jsonlines"`
+	Syslog    []SyslogConfig    `yaml:"syslog"`
+}
+
+// LoadConfig reads a YAML publisher config file. Unknown fields are rejected to catch typos
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return config, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Publishers returns the publishers of the config. On errors, the publishers already created are closed,
+// so that they don't hold on to their connections or listeners
+func (c Config) Publishers() (publishers []Publisher, err error) {
+	defer func() {
+		if err != nil {
+			for _, p := range publishers {
+				p.Close()
+			}
+			publishers = nil
+		}
+	}()
+	names := make(map[string]bool)
+	add := func(p Publisher, err error) error {
+		if err != nil {
+			return err
+		}
+		if names[p.Name()] {
+			p.Close()
+			return fmt.Errorf("duplicate publisher name %q", p.Name())
+		}
+		names[p.Name()] = true
+		publishers = append(publishers, p)
+		return nil
+	}
+	for _, nats := range c.NATS {
+		if err := add(NewNATS(nats)); err != nil {
+			return publishers, err
+		}
+	}
+	for _, jsonLines := range c.JSONLines {
+		if err := add(NewJSONLines(jsonLines)); err != nil {
+			return publishers, err
+		}
+	}
+	for _, syslog := range c.Syslog {
+		if err := add(NewSyslog(syslog)); err != nil {
+			return publishers, err
+		}
+	}
+	return publishers, nil
+}
+
+// NewBusFromConfig returns a bus for the publishers of the config
+func NewBusFromConfig(config Config, logger log.Logger) (*Bus, error) {
+	publishers, err := config.Publishers()
+	if err != nil {
+		return nil, err
+	}
+	return NewBus(logger, publishers...), nil
+}
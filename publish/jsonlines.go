@@ -0,0 +1,100 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONLinesConfig configures the publication of the messages as line-delimited JSON,
+// appended to a file or written to a unix stream socket
+type JSONLinesConfig struct {
+	Name   string `yaml:"name"`
+	Path   string `yaml:"path"`
+	Socket string `yaml:"socket"`
+	// Timeout limits connecting to and writing to the socket
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type jsonLinesPublisher struct {
+	config JSONLinesConfig
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewJSONLines returns a publisher writing every message as a line of JSON. Files are opened for appending
+// and sockets are reconnected after failures
+func NewJSONLines(config JSONLinesConfig) (Publisher, error) {
+	if config.Name == "" || (config.Path == "") == (config.Socket == "") {
+		return nil, fmt.Errorf("jsonlines needs a name and either a path or a socket")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &jsonLinesPublisher{config: config}, nil
+}
+
+func (p *jsonLinesPublisher) Name() string {
+	return p.config.Name
+}
+
+// open opens the file or connects to the socket. p.w is only set on success, a failed open
+// must not leave a typed nil behind
+func (p *jsonLinesPublisher) open(ctx context.Context) error {
+	var (
+		w   io.WriteCloser
+		err error
+	)
+	if p.config.Path != "" {
+		w, err = os.OpenFile(p.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	} else {
+		dialer := net.Dialer{Timeout: p.config.Timeout}
+		w, err = dialer.DialContext(ctx, "unix", p.config.Socket)
+	}
+	if err != nil {
+		return err
+	}
+	p.w = w
+	return nil
+}
+
+func (p *jsonLinesPublisher) Publish(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w == nil {
+		if err := p.open(ctx); err != nil {
+			return err
+		}
+	}
+	if conn, ok := p.w.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(p.config.Timeout))
+	}
+	if _, err := p.w.Write(line); err != nil {
+		p.w.Close()
+		p.w = nil
+		return err
+	}
+	return nil
+}
+
+func (p *jsonLinesPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w == nil {
+		return nil
+	}
+	err := p.w.Close()
+	p.w = nil
+	return err
+}
@@ -0,0 +1,206 @@
+package publish
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultTimeout limits connecting and every publication
+const DefaultTimeout = 10 * time.Second
+
+// NATSConfig configures the publication of the messages to a NATS server
+type NATSConfig struct {
+	Name string `yaml:"name"`
+	// URL is nats://[user:password@]host:port, or tls:// to require TLS, nats://localhost:4222 by default
+	URL string `yaml:"url"`
+	// Listen runs an embedded NATS server on this address, e.g. :4222, instead of connecting to URL.
+	// Subscribers connect to it with any NATS client, with the credentials of the config
+	Listen string `yaml:"listen"`
+	// Subject prefixes the message types, messages are published to e.g. nagiosagg.issue.opened
+	Subject  string        `yaml:"subject"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Token    string        `yaml:"token"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// CAFile verifies the certificate of the server. CertFile and KeyFile are the client certificate,
+	// or with Listen the certificate of the embedded server, which then only accepts TLS connections
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// natsPublisher publishes through a NATS client, publications are confirmed with a flush
+type natsPublisher struct {
+	config NATSConfig
+
+	mu   sync.Mutex
+	conn *nats.Conn
+
+	// server is the embedded server when the config listens, the client is connected to it in process
+	server *server.Server
+}
+
+// NewNATS returns a publisher sending the messages as JSON to a NATS server. It connects on the first message,
+// the client then reconnects by itself. With Listen, it starts an embedded server and publishes to its subscribers
+func NewNATS(config NATSConfig) (Publisher, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("nats needs a name")
+	}
+	if config.Subject == "" {
+		config.Subject = "nagiosagg"
+	}
+	if !server.IsValidLiteralSubject(config.Subject) {
+		return nil, fmt.Errorf("nats %s: invalid subject %q", config.Name, config.Subject)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("nats %s: cert_file and key_file go together", config.Name)
+	}
+	if config.Listen != "" {
+		if config.URL != "" {
+			return nil, fmt.Errorf("nats %s: url and listen are exclusive", config.Name)
+		}
+		s, err := newNATSServer(config)
+		if err != nil {
+			return nil, fmt.Errorf("nats %s: %v", config.Name, err)
+		}
+		return &natsPublisher{config: config, server: s}, nil
+	}
+	if config.URL == "" {
+		config.URL = "nats://localhost:4222"
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("nats %s: invalid url %q", config.Name, config.URL)
+	}
+	return &natsPublisher{config: config}, nil
+}
+
+// newNATSServer starts an embedded server listening on the address of the config
+func newNATSServer(config NATSConfig) (*server.Server, error) {
+	host, port, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		return nil, err
+	}
+	opts := &server.Options{
+		Host:          host,
+		Port:          server.RANDOM_PORT,
+		Username:      config.Username,
+		Password:      config.Password,
+		Authorization: config.Token,
+		NoLog:         true,
+		NoSigs:        true,
+	}
+	if opts.Host == "" {
+		opts.Host = "0.0.0.0"
+	}
+	if port != "0" {
+		if opts.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+	}
+	if config.CertFile != "" {
+		opts.TLSConfig, err = server.GenTLSConfig(&server.TLSConfigOpts{CertFile: config.CertFile, KeyFile: config.KeyFile, CaFile: config.CAFile})
+		if err != nil {
+			return nil, err
+		}
+		opts.TLS = true
+	}
+	s, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	go s.Start()
+	if !s.ReadyForConnections(config.Timeout) {
+		s.Shutdown()
+		return nil, fmt.Errorf("failed to listen on %s", config.Listen)
+	}
+	return s, nil
+}
+
+func (p *natsPublisher) Name() string {
+	return p.config.Name
+}
+
+// connect connects the client to the server of the URL, or to the embedded server
+func (p *natsPublisher) connect() (*nats.Conn, error) {
+	options := []nats.Option{
+		nats.Name("nagiosagg"),
+		nats.Timeout(p.config.Timeout),
+		// Keep reconnecting, publications are buffered until the client is back
+		nats.MaxReconnects(-1),
+	}
+	if p.config.Token != "" {
+		options = append(options, nats.Token(p.config.Token))
+	}
+	if p.config.Username != "" {
+		options = append(options, nats.UserInfo(p.config.Username, p.config.Password))
+	}
+	if p.server != nil {
+		options = append(options, nats.InProcessServer(p.server))
+		if p.config.CertFile != "" {
+			// The embedded server requires TLS from every client, this one is an in-process pipe to it
+			options = append(options, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+		}
+		return nats.Connect(p.server.ClientURL(), options...)
+	}
+	if p.config.CAFile != "" {
+		options = append(options, nats.RootCAs(p.config.CAFile))
+	}
+	if p.config.CertFile != "" {
+		options = append(options, nats.ClientCert(p.config.CertFile, p.config.KeyFile))
+	}
+	return nats.Connect(p.config.URL, options...)
+}
+
+// Publish publishes the message and waits for the server to confirm it. Messages published while the client
+// reconnects are buffered and sent once it is back, they aren't published again
+func (p *natsPublisher) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.conn == nil {
+		conn, err := p.connect()
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		p.conn = conn
+	}
+	conn := p.conn
+	p.mu.Unlock()
+	if err := conn.Publish(p.config.Subject+"."+msg.Type, body); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+	return conn.FlushWithContext(ctx)
+}
+
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	if p.server != nil {
+		p.server.Shutdown()
+		p.server.WaitForShutdown()
+	}
+	return nil
+}
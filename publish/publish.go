@@ -0,0 +1,115 @@
+// Package publish feeds the issue transitions and the completed snapshots of every refresh to downstream
+// systems, over NATS, line-delimited JSON or syslog. Unlike notifications, messages aren't persisted:
+// a publisher that is down or can't keep up loses them
+package publish
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// TypeSnapshotCompleted is the type of the message published after every refresh, following its events.
+// Events are published as issue.<event type>, e.g. issue.opened
+const TypeSnapshotCompleted = "snapshot.completed"
+
+// DefaultQueueSize is the number of messages a publisher may lag behind before messages are dropped
+const DefaultQueueSize = 1024
+
+// Message is published for every transition and every completed snapshot
+type Message struct {
+	Type     string             `json:"type"`
+	Time     time.Time          `json:"time"`
+	Event    *svc.Event         `json:"event,omitempty"`
+	Snapshot *svc.RefreshReport `json:"snapshot,omitempty"`
+}
+
+// Publisher sends messages to a downstream system
+type Publisher interface {
+	// Name identifies the publisher in the logs
+	Name() string
+	// Publish sends a message, failures are logged and the message is dropped
+	Publish(ctx context.Context, msg Message) error
+	// Close releases the connections of the publisher
+	Close() error
+}
+
+// Messages returns the messages of a refresh: an issue message per event, then the completed snapshot
+func Messages(report svc.RefreshReport) []Message {
+	msgs := make([]Message, 0, len(report.Events)+1)
+	for i := range report.Events {
+		e := report.Events[i]
+		msgs = append(msgs, Message{Type: "issue." + e.Type, Time: e.Time, Event: &e})
+	}
+	return append(msgs, Message{Type: TypeSnapshotCompleted, Time: report.RefreshedAt, Snapshot: &report})
+}
+
+type worker struct {
+	publisher Publisher
+	queue     chan Message
+}
+
+// Bus hands the messages of every refresh to the publishers. Every publisher has its own queue,
+// a slow publisher doesn't hold back the others
+type Bus struct {
+	logger  log.Logger
+	workers []worker
+}
+
+// NewBus returns a bus for the publishers, Run must be called to publish the messages
+func NewBus(logger log.Logger, publishers ...Publisher) *Bus {
+	b := &Bus{logger: logger}
+	for _, p := range publishers {
+		b.workers = append(b.workers, worker{publisher: p, queue: make(chan Message, DefaultQueueSize)})
+	}
+	return b
+}
+
+// Publish queues the messages of a refresh for every publisher. Messages are dropped for publishers with a full queue
+func (b *Bus) Publish(report svc.RefreshReport) {
+	msgs := Messages(report)
+	for _, w := range b.workers {
+		dropped := 0
+		for _, msg := range msgs {
+			select {
+			case w.queue <- msg:
+			default:
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			b.logger.Log("component", "publish", "publisher", w.publisher.Name(), "dropped", dropped, "reason", "queue full")
+		}
+	}
+}
+
+// Run publishes the queued messages until ctx is cancelled, then closes the publishers
+func (b *Bus) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, w := range b.workers {
+		wg.Add(1)
+		go func(w worker) {
+			defer wg.Done()
+			defer w.publisher.Close()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-w.queue:
+					if err := w.publisher.Publish(ctx, msg); err != nil && ctx.Err() == nil {
+						b.logger.Log("component", "publish", "publisher", w.publisher.Name(), "type", msg.Type, "err", err.Error())
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// AfterRefresh is the svc.RefreshHook of the bus, it publishes the events and the snapshot of the refresh
+func (b *Bus) AfterRefresh(ctx context.Context, service svc.NagiosParserSvc, report svc.RefreshReport) {
+	b.Publish(report)
+}
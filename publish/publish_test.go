@@ -0,0 +1,399 @@
+package publish
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/tchaudhry91/nagiosagg/internal/testutil"
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+const samplesDir = "../samples/public"
+
+// readMessages returns the messages of a JSON lines file
+func readMessages(t *testing.T, path string) []Message {
+	raw, _ := ioutil.ReadFile(path)
+	msgs := []Message{}
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		if line == "" {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("Invalid line %q: %v", line, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestPublishRefreshes(t *testing.T) {
+	dir := testutil.TempDir(t)
+	statusDir := filepath.Join(dir, "statuses")
+	os.Mkdir(statusDir, 0755)
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random3.dat"), filepath.Join(statusDir, "nagios.dat"))
+	path := filepath.Join(dir, "events.jsonl")
+
+	publisher, err := NewJSONLines(JSONLinesConfig{Name: "file", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewBus(log.NewNopLogger(), publisher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Run(ctx)
+	service, _ := svc.NewNagiosParserSvc(statusDir, filepath.Join(dir, "nagios.db"))
+	service = svc.AfterRefreshMiddleware(bus.AfterRefresh)(service)
+
+	report, err := service.RefreshNagiosData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := len(report.Events) + 1
+	testutil.WaitFor(t, "the first refresh", func() bool { return len(readMessages(t, path)) == first })
+	testutil.CopyStatusFile(t, filepath.Join(samplesDir, "random1.dat"), filepath.Join(statusDir, "nagios.dat"))
+	report, err = service.RefreshNagiosData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := first + len(report.Events) + 1
+	testutil.WaitFor(t, "the second refresh", func() bool { return len(readMessages(t, path)) == total })
+
+	msgs := readMessages(t, path)
+	for i, msg := range msgs {
+		last := i == first-1 || i == total-1
+		if last != (msg.Type == TypeSnapshotCompleted) {
+			t.Errorf("Want the snapshot after the events of each refresh, have %s at %d", msg.Type, i)
+		}
+		if !last && (msg.Event == nil || msg.Type != "issue."+msg.Event.Type) {
+			t.Errorf("Unexpected message %+v", msg)
+		}
+	}
+	if snapshot := msgs[first-1].Snapshot; snapshot == nil || snapshot.Problems != 2 || snapshot.NumEvents != first-1 {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+	if msg := msgs[first]; msg.Type != "issue.resolved" {
+		t.Errorf("Want the issues resolved by the second refresh, have %s", msg.Type)
+	}
+}
+
+func TestJSONLinesReopen(t *testing.T) {
+	dir := filepath.Join(testutil.TempDir(t), "events")
+	publisher, err := NewJSONLines(JSONLinesConfig{Name: "file", Path: filepath.Join(dir, "events.jsonl")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	msg := Message{Type: TypeSnapshotCompleted}
+	if err := publisher.Publish(context.Background(), msg); err == nil {
+		t.Error("Want an error without the directory")
+	}
+	// A failed open is retried by the next message
+	os.Mkdir(dir, 0755)
+	if err := publisher.Publish(context.Background(), msg); err != nil {
+		t.Errorf("Want the message written once the directory exists, have %v", err)
+	}
+}
+
+func TestJSONLinesSocket(t *testing.T) {
+	socket := filepath.Join(testutil.TempDir(t), "events.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			conn.Close()
+		}
+	}()
+	publisher, err := NewJSONLines(JSONLinesConfig{Name: "socket", Socket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	for _, msg := range Messages(svc.RefreshReport{Hosts: 3, Events: []svc.Event{{ID: 1, Type: svc.EventOpened, Hostname: "web1"}}}) {
+		if err := publisher.Publish(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{`"type":"issue.opened"`, `"type":"snapshot.completed"`} {
+		select {
+		case line := <-lines:
+			if !strings.Contains(line, want) {
+				t.Errorf("Want %s in %s", want, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the socket")
+		}
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	publisher, err := NewSyslog(SyslogConfig{Name: "syslog", Address: conn.LocalAddr().String(), Facility: "local0", Hostname: "agg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	e := svc.Event{ID: 7, Type: svc.EventEscalated, Time: time.Date(2018, 9, 26, 6, 0, 0, 0, time.UTC),
+		Instance: "nagios", Hostname: "web1", Service: "HTTP", FromState: "WARNING", ToState: "CRITICAL", Output: `timeout "10s"`}
+	if err := publisher.Publish(context.Background(), Message{Type: "issue." + e.Type, Time: e.Time, Event: &e}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`^<130>1 2018-09-26T06:00:00\.000000Z agg nagiosagg \d+ issue\.escalated ` +
+		regexp.QuoteMeta(`[nagiosagg@32473 id="7" instance="nagios" host="web1" service="HTTP" from_state="WARNING" to_state="CRITICAL"] web1/HTTP escalated WARNING -> CRITICAL: timeout "10s"`) + `$`)
+	if have := string(buf[:n]); !want.MatchString(have) {
+		t.Errorf("Unexpected syslog message %s", have)
+	}
+}
+
+// subscribe connects to a NATS server and returns the messages published to subject, sharing them with
+// the other members of the queue group if there is one
+func subscribe(t *testing.T, url, subject, queue string, options ...nats.Option) <-chan *nats.Msg {
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	msgs := make(chan *nats.Msg, 16)
+	if _, err := conn.ChanQueueSubscribe(subject, queue, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// receive returns the subjects of the next n messages of any of the subscriptions, and fails if more arrive
+func receive(t *testing.T, n int, subscriptions ...<-chan *nats.Msg) []string {
+	subjects := []string{}
+	timeout := time.After(5 * time.Second)
+	for len(subjects) <= n {
+		if len(subjects) == n {
+			timeout = time.After(100 * time.Millisecond)
+		}
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timeout)}}
+		for _, msgs := range subscriptions {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(msgs)})
+		}
+		chosen, msg, _ := reflect.Select(cases)
+		if chosen == 0 {
+			break
+		}
+		subjects = append(subjects, msg.Interface().(*nats.Msg).Subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// tlsFiles writes a self-signed certificate for 127.0.0.1 and its key
+func tlsFiles(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := testutil.TempDir(t)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	return certFile, keyFile
+}
+
+func TestNATS(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, Authorization: "s3cr3t", NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	url := s.ClientURL()
+	all := subscribe(t, url, "nagios.>", "", nats.Token("s3cr3t"))
+	// Members of a queue group share the messages
+	worker1 := subscribe(t, url, "nagios.issue.*", "workers", nats.Token("s3cr3t"))
+	worker2 := subscribe(t, url, "nagios.issue.*", "workers", nats.Token("s3cr3t"))
+
+	publisher, err := NewNATS(NATSConfig{Name: "nats", URL: url, Subject: "nagios", Token: "s3cr3t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	for _, msg := range Messages(svc.RefreshReport{Events: []svc.Event{{ID: 1, Type: svc.EventOpened, Hostname: "web1"}}}) {
+		if err := publisher.Publish(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if subjects := receive(t, 2, all); !reflect.DeepEqual(subjects, []string{"nagios.issue.opened", "nagios.snapshot.completed"}) {
+		t.Errorf("Unexpected messages %q", subjects)
+	}
+	if subjects := receive(t, 1, worker1, worker2); !reflect.DeepEqual(subjects, []string{"nagios.issue.opened"}) {
+		t.Errorf("Want the issue delivered once to the queue group, have %q", subjects)
+	}
+
+	rejected, _ := NewNATS(NATSConfig{Name: "nats", URL: url})
+	if err := rejected.Publish(context.Background(), Message{Type: TypeSnapshotCompleted}); err == nil || !strings.Contains(strings.ToLower(err.Error()), "authorization violation") {
+		t.Errorf("Want the server error, have %v", err)
+	}
+}
+
+func TestEmbeddedNATS(t *testing.T) {
+	if _, err := NewNATS(NATSConfig{Name: "nats", URL: "nats://localhost:4222", Listen: "127.0.0.1:0"}); err == nil {
+		t.Error("Want an error for both an url and an address to listen on")
+	}
+	certFile, keyFile := tlsFiles(t)
+	publisher, err := NewNATS(NATSConfig{Name: "nats", Listen: "127.0.0.1:0", Subject: "nagios", Token: "s3cr3t", CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	url := "tls://" + publisher.(*natsPublisher).server.Addr().String()
+	issues := subscribe(t, url, "nagios.issue.*", "", nats.Token("s3cr3t"), nats.RootCAs(certFile))
+	all := subscribe(t, url, "nagios.>", "", nats.Token("s3cr3t"), nats.RootCAs(certFile))
+	others := subscribe(t, url, "others.>", "", nats.Token("s3cr3t"), nats.RootCAs(certFile))
+
+	for _, msg := range Messages(svc.RefreshReport{Events: []svc.Event{{ID: 1, Type: svc.EventOpened, Hostname: "web1"}}}) {
+		if err := publisher.Publish(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if subjects := receive(t, 3, issues, all, others); !reflect.DeepEqual(subjects, []string{"nagios.issue.opened", "nagios.issue.opened", "nagios.snapshot.completed"}) {
+		t.Errorf("Unexpected messages %q", subjects)
+	}
+
+	// Other clients publish through the embedded server too
+	client, _ := NewNATS(NATSConfig{Name: "client", URL: url, Subject: "others", Token: "s3cr3t", CAFile: certFile})
+	defer client.Close()
+	if err := client.Publish(context.Background(), Message{Type: TypeSnapshotCompleted}); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := receive(t, 1, others); !reflect.DeepEqual(subjects, []string{"others.snapshot.completed"}) {
+		t.Errorf("Unexpected messages %q", subjects)
+	}
+
+	rejected, _ := NewNATS(NATSConfig{Name: "nats", URL: url, CAFile: certFile})
+	if err := rejected.Publish(context.Background(), Message{Type: TypeSnapshotCompleted}); err == nil || !strings.Contains(strings.ToLower(err.Error()), "authorization violation") {
+		t.Errorf("Want the server error, have %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(testutil.TempDir(t), "publish.yaml")
+	ioutil.WriteFile(path, []byte(`
+nats:
+  - name: nats
+    url: nats://nats.example.com:4222
+    subject: nagios
+jsonlines:
+  - name: file
+    path: /var/log/nagiosagg/events.jsonl
+syslog:
+  - name: syslog
+    network: tcp
+    address: syslog.example.com:601
+    facility: local3
+`), 0644)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishers, err := config.Publishers()
+	if err != nil || len(publishers) != 3 {
+		t.Errorf("Want 3 publishers, have %d: %v", len(publishers), err)
+	}
+
+	for _, invalid := range []string{
+		"nats:\n  - name: nats\n    urls: nats://localhost\n",
+		"nats:\n  - name: nats\n    url: http://localhost\n",
+		"jsonlines:\n  - name: file\n",
+		"jsonlines:\n  - name: file\n    path: a\n    socket: b\n",
+		"syslog:\n  - name: syslog\n    address: localhost:514\n    facility: local9\n",
+		"syslog:\n  - name: a\n    address: localhost:514\njsonlines:\n  - name: a\n    path: a\n",
+	} {
+		ioutil.WriteFile(path, []byte(invalid), 0644)
+		config, err := LoadConfig(path)
+		if err == nil {
+			_, err = config.Publishers()
+		}
+		if err == nil {
+			t.Errorf("Want an error for config:\n%s", invalid)
+		}
+	}
+
+	// The embedded server of a config failing later on stops listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	config = Config{NATS: []NATSConfig{{Name: "nats", Listen: addr}}, JSONLines: []JSONLinesConfig{{Name: "file"}}}
+	if _, err := config.Publishers(); err == nil {
+		t.Fatal("Want an error for the jsonlines publisher")
+	}
+	if l, err := net.Listen("tcp", addr); err != nil {
+		t.Errorf("Want the address of the embedded server released, have %v", err)
+	} else {
+		l.Close()
+	}
+}
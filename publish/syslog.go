@@ -0,0 +1,214 @@
+package publish
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/svc"
+)
+
+// syslogSDID is the ID of the structured data of the messages, under the example enterprise number of RFC 5612
+const syslogSDID = "nagiosagg@32473"
+
+// syslog severities
+const (
+	syslogCritical = 2
+	syslogError    = 3
+	syslogWarning  = 4
+	syslogNotice   = 5
+	syslogInfo     = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig configures the publication of the messages to a syslog server in the RFC 5424 format
+type SyslogConfig struct {
+	Name string `yaml:"name"`
+	// Network is udp, the default, or tcp. TCP messages are framed with octet counting (RFC 6587)
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	// Facility is a syslog facility name, daemon by default
+	Facility string `yaml:"facility"`
+	// AppName defaults to nagiosagg and Hostname to the name of the host
+	AppName  string        `yaml:"app_name"`
+	Hostname string        `yaml:"hostname"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+type syslogPublisher struct {
+	config   SyslogConfig
+	facility int
+	procID   string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslog returns a publisher sending every message to a syslog server, with the issue as structured data
+func NewSyslog(config SyslogConfig) (Publisher, error) {
+	if config.Name == "" || config.Address == "" {
+		return nil, fmt.Errorf("syslog needs a name and an address")
+	}
+	switch config.Network {
+	case "":
+		config.Network = "udp"
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("syslog %s: unknown network %q", config.Name, config.Network)
+	}
+	if config.Facility == "" {
+		config.Facility = "daemon"
+	}
+	facility, found := syslogFacilities[config.Facility]
+	if !found {
+		return nil, fmt.Errorf("syslog %s: unknown facility %q", config.Name, config.Facility)
+	}
+	if config.AppName == "" {
+		config.AppName = "nagiosagg"
+	}
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &syslogPublisher{
+		config:   config,
+		facility: facility,
+		procID:   strconv.Itoa(os.Getpid()),
+	}, nil
+}
+
+func (p *syslogPublisher) Name() string {
+	return p.config.Name
+}
+
+// syslogSeverity ranks the messages by the state of their issue
+func syslogSeverity(msg Message) int {
+	if msg.Event == nil {
+		return syslogInfo
+	}
+	if msg.Event.Type == svc.EventResolved {
+		return syslogNotice
+	}
+	switch msg.Event.ToState {
+	case "CRITICAL", "DOWN":
+		return syslogCritical
+	case "WARNING":
+		return syslogWarning
+	default:
+		return syslogError
+	}
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// structuredData renders the SD-ELEMENT of a message, empty parameters are left out
+func structuredData(params [][2]string) string {
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	for _, param := range params {
+		if param[1] != "" {
+			sd.WriteString(" " + param[0] + `="` + sdEscaper.Replace(param[1]) + `"`)
+		}
+	}
+	sd.WriteString("]")
+	return sd.String()
+}
+
+// header returns a header field, or the nil value for empty ones
+func header(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(value, " ", "_", -1)
+}
+
+// format renders a message in the RFC 5424 format
+func (p *syslogPublisher) format(msg Message) string {
+	var sd, text string
+	if e := msg.Event; e != nil {
+		sd = structuredData([][2]string{
+			{"id", strconv.FormatUint(e.ID, 10)},
+			{"instance", e.Instance},
+			{"host", e.Hostname},
+			{"service", e.Service},
+			{"from_state", e.FromState},
+			{"to_state", e.ToState},
+		})
+		subject := e.Hostname
+		if e.Service != "" {
+			subject += "/" + e.Service
+		}
+		text = fmt.Sprintf("%s %s %s -> %s", subject, e.Type, e.FromState, e.ToState)
+		if e.FromState == "" {
+			text = fmt.Sprintf("%s %s %s", subject, e.Type, e.ToState)
+		}
+		if e.Output != "" {
+			text += ": " + e.Output
+		}
+	} else if s := msg.Snapshot; s != nil {
+		sd = structuredData([][2]string{
+			{"sources", strconv.Itoa(s.Sources)},
+			{"hosts", strconv.Itoa(s.Hosts)},
+			{"problems", strconv.Itoa(s.Problems)},
+			{"events", strconv.Itoa(s.NumEvents)},
+		})
+		text = fmt.Sprintf("snapshot completed, %d hosts, %d problems, %d events", s.Hosts, s.Problems, s.NumEvents)
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s",
+		p.facility*8+syslogSeverity(msg),
+		msg.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		header(p.config.Hostname),
+		header(p.config.AppName),
+		p.procID,
+		header(msg.Type),
+		sd,
+		text,
+	)
+}
+
+func (p *syslogPublisher) Publish(ctx context.Context, msg Message) error {
+	line := p.format(msg)
+	if p.config.Network == "tcp" {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		dialer := net.Dialer{Timeout: p.config.Timeout}
+		conn, err := dialer.DialContext(ctx, p.config.Network, p.config.Address)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.config.Timeout))
+	if _, err := p.conn.Write([]byte(line)); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *syslogPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
@@ -2,6 +2,7 @@ package svc
 
 import (
 	"context"
+	"time"
 
 	cache "github.com/patrickmn/go-cache"
 	"github.com/tchaudhry91/nagiosagg/parser"
@@ -13,13 +14,23 @@ type cachingMiddleware struct {
 	next   NagiosParserSvc
 }
 
-// GetParsedNagios caches the values and proxies the request to the inner layer if not found
-func (mw *cachingMiddleware) GetParsedNagios(ctx context.Context) (output map[string][]parser.NagiosStatus, err error) {
+// maxCachedFilters bounds the number of filtered views kept between refreshes
+const maxCachedFilters = 100
+
+// GetParsedNagios caches the values per filter and proxies the request to the inner layer if not found.
+// Filters on a minimum duration match differently as time passes, they aren't cached, and neither are errors
+func (mw *cachingMiddleware) GetParsedNagios(ctx context.Context, filter Filter) (output map[string][]parser.NagiosStatus, err error) {
+	if filter.MinDuration > 0 {
+		return mw.next.GetParsedNagios(ctx, filter)
+	}
 	var f interface{}
 	var found bool
-	if f, found = mw.cacher.Get("nagios"); !found {
-		output, err = mw.next.GetParsedNagios(ctx)
-		mw.cacher.Set("nagios", output, cache.DefaultExpiration)
+	key := "nagios" + filter.Key()
+	if f, found = mw.cacher.Get(key); !found {
+		output, err = mw.next.GetParsedNagios(ctx, filter)
+		if err == nil && mw.cacher.ItemCount() < maxCachedFilters {
+			mw.cacher.Set(key, output, cache.DefaultExpiration)
+		}
 		return output, err
 	}
 	output = f.(map[string][]parser.NagiosStatus)
@@ -27,10 +38,46 @@ func (mw *cachingMiddleware) GetParsedNagios(ctx context.Context) (output map[st
 }
 
 // RefreshNagiosData clears the cache and proxies the request to the inner layer
-func (mw *cachingMiddleware) RefreshNagiosData(ctx context.Context) (err error) {
+func (mw *cachingMiddleware) RefreshNagiosData(ctx context.Context) (report RefreshReport, err error) {
 	defer func() {
-		mw.cacher.Delete("nagios")
+		// Every filtered view is stale now
+		mw.cacher.Flush()
 	}()
-	err = mw.next.RefreshNagiosData(ctx)
-	return err
+	report, err = mw.next.RefreshNagiosData(ctx)
+	return report, err
+}
+
+// GetEvents proxies the request to the inner layer, the event log changes on every refresh
+func (mw *cachingMiddleware) GetEvents(ctx context.Context, since time.Time) (events []Event, err error) {
+	return mw.next.GetEvents(ctx, since)
+}
+
+// DiffSnapshots proxies the request to the inner layer
+func (mw *cachingMiddleware) DiffSnapshots(ctx context.Context, from, to time.Time) (diff SnapshotDiff, err error) {
+	return mw.next.DiffSnapshots(ctx, from, to)
+}
+
+// GetAvailabilityReport proxies the request to the inner layer
+func (mw *cachingMiddleware) GetAvailabilityReport(ctx context.Context, from, to time.Time) (report AvailabilityReport, err error) {
+	return mw.next.GetAvailabilityReport(ctx, from, to)
+}
+
+// GetHosts proxies the request to the inner layer
+func (mw *cachingMiddleware) GetHosts(ctx context.Context) (hosts []HostSummary, err error) {
+	return mw.next.GetHosts(ctx)
+}
+
+// GetHost proxies the request to the inner layer
+func (mw *cachingMiddleware) GetHost(ctx context.Context, hostname string) (host HostDetail, err error) {
+	return mw.next.GetHost(ctx, hostname)
+}
+
+// GetServiceProblems proxies the request to the inner layer
+func (mw *cachingMiddleware) GetServiceProblems(ctx context.Context, service string) (output map[string][]parser.NagiosStatus, err error) {
+	return mw.next.GetServiceProblems(ctx, service)
+}
+
+// GetSummary proxies the request to the inner layer, summaries are precomputed on refresh
+func (mw *cachingMiddleware) GetSummary(ctx context.Context, top int) (summary Summary, err error) {
+	return mw.next.GetSummary(ctx, top)
 }
@@ -0,0 +1,136 @@
+package svc
+
+import (
+	"sort"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+func isHostStatus(status parser.NagiosStatus) bool {
+	return status.StatusType == "hoststatus" || status.StatusType == "host"
+}
+
+func isHostDown(status parser.NagiosStatus) bool {
+	return isHostStatus(status) && (status.State == "DOWN" || status.State == "UNREACHABLE")
+}
+
+func hostKey(instance, hostname string) string {
+	return instance + "\x00" + hostname
+}
+
+// correlateHostDown marks the problems caused by a DOWN or UNREACHABLE host with that host: the service problems
+// of the host, and when the parents are known from objects.cache, the hosts behind it and their services.
+// Problems are attributed to the topmost down host. It returns the number of problems suppressed
+func correlateHostDown(result map[string][]parser.NagiosStatus) int {
+	problems := []*parser.NagiosStatus{}
+	for host := range result {
+		for i := range result[host] {
+			problems = append(problems, &result[host][i])
+		}
+	}
+	return correlate(problems)
+}
+
+// CorrelateHostDown marks the problems among statuses parsed outside of the service that are caused by a DOWN
+// or UNREACHABLE host, like a refresh does. OK statuses are left alone. It returns the number of problems suppressed
+func CorrelateHostDown(statuses []parser.NagiosStatus) int {
+	problems := []*parser.NagiosStatus{}
+	for i := range statuses {
+		if statuses[i].State != "OK" {
+			problems = append(problems, &statuses[i])
+		}
+	}
+	return correlate(problems)
+}
+
+func correlate(problems []*parser.NagiosStatus) int {
+	down := make(map[string]bool)
+	parents := make(map[string][]string)
+	for _, status := range problems {
+		if isHostDown(*status) {
+			down[hostKey(status.Instance, status.Hostname)] = true
+			parents[hostKey(status.Instance, status.Hostname)] = status.Parents
+		}
+	}
+	// cause follows the down parents of a down host up to the topmost one
+	cause := func(instance, hostname string) string {
+		seen := map[string]bool{hostname: true}
+		for {
+			next := ""
+			for _, parent := range parents[hostKey(instance, hostname)] {
+				if down[hostKey(instance, parent)] && !seen[parent] {
+					next = parent
+					break
+				}
+			}
+			if next == "" {
+				return hostname
+			}
+			seen[next] = true
+			hostname = next
+		}
+	}
+	suppressed := 0
+	for _, status := range problems {
+		status.SuppressedBy = ""
+		if !down[hostKey(status.Instance, status.Hostname)] {
+			continue
+		}
+		by := cause(status.Instance, status.Hostname)
+		if isHostStatus(*status) && by == status.Hostname {
+			// The host is down by itself
+			continue
+		}
+		status.SuppressedBy = by
+		suppressed++
+	}
+	return suppressed
+}
+
+// groupSuppressed converts issues for /nagios, listing the problems suppressed by a down host under its host problem.
+// Suppressed problems whose host problem didn't pass the filter stay at the top level
+func groupSuppressed(issues map[string][]parser.NagiosStatus) getParsedNagiosResponse {
+	type position struct {
+		host  string
+		index int
+	}
+	grouped := getParsedNagiosResponse{}
+	hosts := make(map[string]position)
+	for host, statuses := range issues {
+		for _, status := range statuses {
+			if status.SuppressedBy != "" {
+				continue
+			}
+			if isHostStatus(status) {
+				hosts[hostKey(status.Instance, status.Hostname)] = position{host: host, index: len(grouped[host])}
+			}
+			resp, _ := newNagiosStatusResponse(status)
+			grouped[host] = append(grouped[host], resp)
+		}
+	}
+	for host, statuses := range issues {
+		for _, status := range statuses {
+			if status.SuppressedBy == "" {
+				continue
+			}
+			issue := NewIssue(status)
+			issue.Hostname = host
+			if at, found := hosts[hostKey(status.Instance, status.SuppressedBy)]; found {
+				cause := &grouped[at.host][at.index]
+				cause.Suppressed = append(cause.Suppressed, issue)
+				continue
+			}
+			grouped[host] = append(grouped[host], issue.NagiosStatusResponse)
+		}
+	}
+	for _, at := range hosts {
+		suppressed := grouped[at.host][at.index].Suppressed
+		sort.Slice(suppressed, func(i, j int) bool {
+			if suppressed[i].Hostname != suppressed[j].Hostname {
+				return suppressed[i].Hostname < suppressed[j].Hostname
+			}
+			return suppressed[i].Service < suppressed[j].Service
+		})
+	}
+	return grouped
+}
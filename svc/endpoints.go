@@ -2,17 +2,20 @@ package svc
 
 import (
 	"context"
-	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
-	"github.com/go-kit/kit/ratelimit"
 	cache "github.com/patrickmn/go-cache"
-	"golang.org/x/time/rate"
+	"github.com/tchaudhry91/nagiosagg/parser"
 )
 
-type getParsedNagiosRequest struct{}
+type getParsedNagiosRequest struct {
+	Filter Filter
+	// Flatten lists the problems suppressed by a down host alongside the others instead of under the host
+	Flatten bool
+}
 
 type getParsedNagiosResponse map[string][]NagiosStatusResponse
 
@@ -21,24 +24,150 @@ type refreshNagiosDataRequest struct{}
 type refreshNagiosDataResponse struct {
 	// Error doesn't JSON marshall, hence string
 	Err string `json:"err,omitempty"`
+	// The legacy JSON response doesn't include the report, the gRPC one does
+	report RefreshReport
+}
+
+type startRefreshRequest struct{}
+
+type getRefreshJobRequest struct {
+	ID string
+}
+
+type refreshJobResponse RefreshJob
+
+type getEventsRequest struct {
+	Since time.Time
+}
+
+type getEventsResponse []Event
+
+type diffSnapshotsRequest struct {
+	From time.Time
+	To   time.Time
+}
+
+type diffSnapshotsResponse struct {
+	SnapshotDiff
+}
+
+type getAvailabilityReportRequest struct {
+	From time.Time
+	To   time.Time
+}
+
+type getAvailabilityReportResponse struct {
+	AvailabilityReport
+}
+
+type listIssuesRequest struct {
+	Query IssueQuery
+}
+
+type listIssuesResponse IssuePage
+
+type getHostsRequest struct{}
+
+type getHostsResponse []HostSummary
+
+type getHostRequest struct {
+	Hostname string
+}
+
+type getHostResponse struct {
+	Hostname     string                 `json:"hostname"`
+	HostStatuses []NagiosStatusResponse `json:"host_statuses"`
+	Problems     []NagiosStatusResponse `json:"problems"`
+	Comments     []Comment              `json:"comments"`
+	Downtimes    []Downtime             `json:"downtimes"`
+}
+
+type getServiceRequest struct {
+	Service string
+}
+
+type streamRequest struct {
+	Filter      Filter
+	LastEventID uint64
+	Resume      bool
+}
+
+type streamResponse struct {
+	sub    *Subscription
+	broker *EventBroker
+}
+
+type listInstancesRequest struct{}
+
+type instanceResponse struct {
+	Name     string `json:"name"`
+	Hosts    int    `json:"hosts"`
+	Problems int    `json:"problems"`
+}
+
+type listInstancesResponse []instanceResponse
+
+type getSummaryRequest struct {
+	Top int
 }
 
 // Endpoints is a struct containing all the endpoints for the NagiosParserService
 type Endpoints struct {
 	refreshNagiosData endpoint.Endpoint
+	startRefresh      endpoint.Endpoint
+	getRefreshJob     endpoint.Endpoint
 	getParsedNagios   endpoint.Endpoint
+	getEvents         endpoint.Endpoint
+	diffSnapshots     endpoint.Endpoint
+	availability      endpoint.Endpoint
+	listIssues        endpoint.Endpoint
+	getHosts          endpoint.Endpoint
+	getHost           endpoint.Endpoint
+	getService        endpoint.Endpoint
+	getSummary        endpoint.Endpoint
+	stream            endpoint.Endpoint
+	listInstances     endpoint.Endpoint
 }
 
 // MakeServerEndpoints returns a struct with all the Endpoints for the NagiosParserService
-func MakeServerEndpoints(svc NagiosParserSvc, cacher *cache.Cache, limiter *rate.Limiter) Endpoints {
+func MakeServerEndpoints(svc NagiosParserSvc, cacher *cache.Cache, jobs *RefreshJobs, broker *EventBroker) Endpoints {
 	ee := Endpoints{}
 
 	//gerParsedNagios Endpoint
 	ee.getParsedNagios = MakeGetParsedNagiosEndpoint(svc)
 
-	//refreshNagiosData Endpoint
-	ee.refreshNagiosData = MakeRefreshNagiosDataEndpoint(svc)
-	ee.refreshNagiosData = ratelimit.NewErroringLimiter(limiter)(ee.refreshNagiosData)
+	//refreshNagiosData Endpoint, rate limited by the job runner so requests can join a running job
+	ee.refreshNagiosData = MakeRefreshNagiosDataEndpoint(jobs)
+
+	//asynchronous refresh Endpoints
+	ee.startRefresh = MakeStartRefreshEndpoint(jobs)
+	ee.getRefreshJob = MakeGetRefreshJobEndpoint(jobs)
+
+	//getEvents Endpoint
+	ee.getEvents = MakeGetEventsEndpoint(svc)
+
+	//diffSnapshots Endpoint
+	ee.diffSnapshots = MakeDiffSnapshotsEndpoint(svc)
+
+	//availability report Endpoint
+	ee.availability = MakeGetAvailabilityReportEndpoint(svc)
+
+	//listIssues Endpoint
+	ee.listIssues = MakeListIssuesEndpoint(svc)
+
+	//host and service Endpoints
+	ee.getHosts = MakeGetHostsEndpoint(svc)
+	ee.getHost = MakeGetHostEndpoint(svc)
+	ee.getService = MakeGetServiceEndpoint(svc)
+
+	//getSummary Endpoint
+	ee.getSummary = MakeGetSummaryEndpoint(svc)
+
+	//stream Endpoint
+	ee.stream = MakeStreamEndpoint(broker)
+
+	//listInstances Endpoint
+	ee.listInstances = MakeListInstancesEndpoint(svc)
 
 	return ee
 }
@@ -46,21 +175,80 @@ func MakeServerEndpoints(svc NagiosParserSvc, cacher *cache.Cache, limiter *rate
 // NagiosStatusResponse is a filtered structure for Nagios data to be returned to the client
 type NagiosStatusResponse struct {
 	State            string    `json:"state,omitempty"`
+	Instance         string    `json:"instance,omitempty"`
 	Output           string    `json:"output,omitempty"`
 	Service          string    `json:"service,omitempty"`
 	Attempts         string    `json:"attempts,omitempty"`
 	LastCheck        time.Time `json:"last_check,omitempty"`
 	NextCheck        time.Time `json:"next_check,omitempty"`
 	LastStateChanged time.Time `json:"last_state_changed,omitempty"`
+	// Flapping is set when the aggregator or nagios detected the issue as flapping
+	Flapping bool `json:"flapping,omitempty"`
+	// FlapPercent is the share of the aggregator's recent refreshes that changed the state
+	FlapPercent float64 `json:"flap_percent,omitempty"`
+	// NagiosFlapping and PercentStateChange are the flap detection of nagios, over its recent checks
+	NagiosFlapping     bool    `json:"nagios_flapping,omitempty"`
+	PercentStateChange float64 `json:"percent_state_change,omitempty"`
+	// SuppressedBy is the DOWN or UNREACHABLE host causing the problem
+	SuppressedBy string `json:"suppressed_by,omitempty"`
+	// Metadata is joined from the objects.cache of the instance, when available
+	parser.Metadata
+	Labels map[string]string `json:"labels,omitempty"`
+	// Suppressed are the problems a down host causes, listed under its host problem unless flattened
+	Suppressed []Issue `json:"suppressed,omitempty"`
 }
 
-// MakeRefreshNagiosDataEndpoint returns an endpoint to refresh nagios data from new status files
-func MakeRefreshNagiosDataEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+// newNagiosStatusResponse filters a parsed nagios status down to the fields returned to the client
+// Timestamps that fail to parse are left zero and the first failure is returned
+func newNagiosStatusResponse(problem parser.NagiosStatus) (NagiosStatusResponse, error) {
+	status := NagiosStatusResponse{}
+	status.State = problem.State
+	status.Instance = problem.Instance
+	status.Service = problem.Service
+	status.Output = problem.Values["plugin_output"]
+	status.Attempts = problem.Attempts()
+	status.Flapping = problem.IsFlapping()
+	status.FlapPercent = problem.FlapPercent
+	status.NagiosFlapping = problem.NagiosFlapping()
+	status.PercentStateChange = problem.NagiosPercentStateChange()
+	status.SuppressedBy = problem.SuppressedBy
+	status.Metadata = problem.Metadata
+	status.Labels = problem.Labels
+
+	var firstErr error
+	parseTS := func(key string) time.Time {
+		ts, err := strconv.ParseInt(problem.Values[key], 10, 64)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return time.Time{}
+		}
+		return time.Unix(ts, 0).UTC()
+	}
+	status.LastCheck = parseTS("last_check")
+	status.NextCheck = parseTS("next_check")
+	status.LastStateChanged = parseTS("last_state_change")
+	return status, firstErr
+}
+
+// statusResponses converts statuses for the client, unparseable timestamps are left zero
+func statusResponses(statuses []parser.NagiosStatus) []NagiosStatusResponse {
+	resp := []NagiosStatusResponse{}
+	for _, status := range statuses {
+		status, _ := newNagiosStatusResponse(status)
+		resp = append(resp, status)
+	}
+	return resp
+}
+
+// MakeRefreshNagiosDataEndpoint returns an endpoint to refresh nagios data from new status files, waiting for the refresh job
+func MakeRefreshNagiosDataEndpoint(jobs *RefreshJobs) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		// req := request.(refreshNagiosDataRequest)
 		// Skipped because empty request
-		err := svc.RefreshNagiosData(ctx)
-		resp := refreshNagiosDataResponse{}
+		report, err := jobs.Run(ctx)
+		resp := refreshNagiosDataResponse{report: report}
 		if err != nil {
 			resp.Err = err.Error()
 			return resp, err
@@ -69,47 +257,40 @@ func MakeRefreshNagiosDataEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
 	}
 }
 
+// MakeStartRefreshEndpoint returns an endpoint that starts a refresh job, or joins the running one
+func MakeStartRefreshEndpoint(jobs *RefreshJobs) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		job, err := jobs.Start()
+		return refreshJobResponse(job), err
+	}
+}
+
+// MakeGetRefreshJobEndpoint returns an endpoint to follow the progress of a refresh job
+func MakeGetRefreshJobEndpoint(jobs *RefreshJobs) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getRefreshJobRequest)
+		job, err := jobs.Get(req.ID)
+		return refreshJobResponse(job), err
+	}
+}
+
 // MakeGetParsedNagiosEndpoint returns an endpoint to get Parsed Nagios Data from multiple nagios instances
 func MakeGetParsedNagiosEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		// req := request.(getParsedNagiosRequest)
-		// Skipped because empty request
-		resp, err := svc.GetParsedNagios(ctx)
+		req := request.(getParsedNagiosRequest)
+		resp, err := svc.GetParsedNagios(ctx, req.Filter)
 		if err != nil {
 			var issues getParsedNagiosResponse
 			return issues, err
 		}
+		if !req.Flatten {
+			return groupSuppressed(resp), nil
+		}
 		issues := getParsedNagiosResponse{}
 		for host, problems := range resp {
 			respIssues := []NagiosStatusResponse{}
 			for _, problem := range problems {
-				status := NagiosStatusResponse{}
-				status.State = problem.State
-				status.Service = problem.Service
-				status.Output = problem.Values["plugin_output"]
-				status.Attempts = fmt.Sprintf("%s/%s", problem.Values["current_attempt"], problem.Values["max_attempts"])
-				loc, err := time.LoadLocation("UTC")
-				if err != nil {
-					return issues, nil
-				}
-
-				lastTS, err := strconv.ParseInt(problem.Values["last_check"], 10, 64)
-				if err != nil {
-					return issues, nil
-				}
-				status.LastCheck = time.Unix(lastTS, 0).In(loc)
-
-				nextTS, err := strconv.ParseInt(problem.Values["next_check"], 10, 64)
-				if err != nil {
-					return issues, nil
-				}
-				status.NextCheck = time.Unix(nextTS, 0).In(loc)
-
-				changeTS, err := strconv.ParseInt(problem.Values["last_state_change"], 10, 64)
-				if err != nil {
-					return issues, nil
-				}
-				status.LastStateChanged = time.Unix(changeTS, 0).In(loc)
+				status, _ := newNagiosStatusResponse(problem)
 				respIssues = append(respIssues, status)
 			}
 			issues[host] = respIssues
@@ -117,3 +298,144 @@ func MakeGetParsedNagiosEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
 		return issues, nil
 	}
 }
+
+// MakeGetEventsEndpoint returns an endpoint to get the state transitions recorded by refreshes
+func MakeGetEventsEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getEventsRequest)
+		events, err := svc.GetEvents(ctx, req.Since)
+		if err != nil {
+			var resp getEventsResponse
+			return resp, err
+		}
+		return getEventsResponse(events), nil
+	}
+}
+
+// MakeDiffSnapshotsEndpoint returns an endpoint to compare two stored snapshots
+func MakeDiffSnapshotsEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(diffSnapshotsRequest)
+		diff, err := svc.DiffSnapshots(ctx, req.From, req.To)
+		return diffSnapshotsResponse{SnapshotDiff: diff}, err
+	}
+}
+
+// MakeGetAvailabilityReportEndpoint returns an endpoint to report availability over a date range
+func MakeGetAvailabilityReportEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getAvailabilityReportRequest)
+		report, err := svc.GetAvailabilityReport(ctx, req.From, req.To)
+		return getAvailabilityReportResponse{AvailabilityReport: report}, err
+	}
+}
+
+// MakeListIssuesEndpoint returns an endpoint to page through a sorted, flat list of issues
+func MakeListIssuesEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listIssuesRequest)
+		resp, err := svc.GetParsedNagios(ctx, req.Query.Filter)
+		if err != nil {
+			return listIssuesResponse{Issues: []Issue{}}, err
+		}
+		page, err := pageIssues(FlattenIssues(resp), req.Query)
+		return listIssuesResponse(page), err
+	}
+}
+
+// MakeGetHostsEndpoint returns an endpoint to list every known host
+func MakeGetHostsEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		hosts, err := svc.GetHosts(ctx)
+		return getHostsResponse(hosts), err
+	}
+}
+
+// MakeGetHostEndpoint returns an endpoint to get the statuses, problems, comments and downtimes of a host
+func MakeGetHostEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getHostRequest)
+		host, err := svc.GetHost(ctx, req.Hostname)
+		if err != nil {
+			return getHostResponse{}, err
+		}
+		return getHostResponse{
+			Hostname:     host.Hostname,
+			HostStatuses: statusResponses(host.HostStatuses),
+			Problems:     statusResponses(host.Problems),
+			Comments:     host.Comments,
+			Downtimes:    host.Downtimes,
+		}, nil
+	}
+}
+
+// MakeGetServiceEndpoint returns an endpoint to get every host where a service is failing
+func MakeGetServiceEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getServiceRequest)
+		resp, err := svc.GetServiceProblems(ctx, req.Service)
+		issues := getParsedNagiosResponse{}
+		if err != nil {
+			return issues, err
+		}
+		for host, problems := range resp {
+			issues[host] = statusResponses(problems)
+		}
+		return issues, nil
+	}
+}
+
+// MakeGetSummaryEndpoint returns an endpoint to get the state counts of the latest refresh
+func MakeGetSummaryEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getSummaryRequest)
+		return svc.GetSummary(ctx, req.Top)
+	}
+}
+
+// MakeStreamEndpoint returns an endpoint subscribing to the events of future refreshes.
+// The response is written for as long as the client stays connected
+func MakeStreamEndpoint(broker *EventBroker) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(streamRequest)
+		sub := broker.Subscribe(req.Filter, req.LastEventID, req.Resume)
+		return streamResponse{sub: sub, broker: broker}, nil
+	}
+}
+
+// MakeListInstancesEndpoint returns an endpoint listing the nagios instances with their number of hosts and problems
+func MakeListInstancesEndpoint(svc NagiosParserSvc) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		hosts, err := svc.GetHosts(ctx)
+		if err != nil {
+			return listInstancesResponse{}, err
+		}
+		problems, err := svc.GetParsedNagios(ctx, Filter{})
+		if err != nil {
+			return listInstancesResponse{}, err
+		}
+		instances := make(map[string]*instanceResponse)
+		instance := func(name string) *instanceResponse {
+			if _, found := instances[name]; !found {
+				instances[name] = &instanceResponse{Name: name}
+			}
+			return instances[name]
+		}
+		for _, host := range hosts {
+			for _, name := range host.Instances {
+				instance(name).Hosts++
+			}
+		}
+		for _, statuses := range problems {
+			for _, status := range statuses {
+				instance(status.Instance).Problems++
+			}
+		}
+		resp := listInstancesResponse{}
+		for _, i := range instances {
+			resp = append(resp, *i)
+		}
+		sort.Slice(resp, func(i, j int) bool { return resp[i].Name < resp[j].Name })
+		return resp, nil
+	}
+}
@@ -0,0 +1,136 @@
+package svc
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+// Transition types recorded in the event log
+const (
+	EventOpened       = "opened"
+	EventEscalated    = "escalated"
+	EventDeEscalated  = "de-escalated"
+	EventResolved     = "resolved"
+	EventAcknowledged = "acknowledged"
+)
+
+// Event is a single state transition of a nagios issue observed between two refreshes
+type Event struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Instance  string    `json:"instance,omitempty"`
+	Hostname  string    `json:"hostname"`
+	Service   string    `json:"service,omitempty"`
+	FromState string    `json:"from_state,omitempty"`
+	ToState   string    `json:"to_state,omitempty"`
+	Output    string    `json:"output,omitempty"`
+	// Flapping is set when the issue was flapping, as detected by the aggregator or nagios
+	Flapping bool `json:"flapping,omitempty"`
+	// SuppressedBy is the DOWN or UNREACHABLE host that caused the issue
+	SuppressedBy string `json:"suppressed_by,omitempty"`
+	// HostGroups, ServiceGroups and Contacts are those of the issue, when objects.cache is available
+	HostGroups    []string `json:"host_groups,omitempty"`
+	ServiceGroups []string `json:"service_groups,omitempty"`
+	Contacts      []string `json:"contacts,omitempty"`
+	// Labels are those of the issue, derived from its custom variables
+	Labels map[string]string `json:"labels,omitempty"`
+	// status is the status the event was computed from, used to filter live streams
+	status *parser.NagiosStatus
+}
+
+// severity orders states so that escalations can be told apart from de-escalations
+func severity(state string) int {
+	switch state {
+	case "OK":
+		return 0
+	case "WARNING":
+		return 1
+	case "UNKNOWN":
+		return 2
+	case "CRITICAL", "UNREACHABLE":
+		return 3
+	case "DOWN":
+		return 4
+	default:
+		return -1
+	}
+}
+
+// Status returns the status the event was computed from, the status before the transition for resolved issues
+func (e Event) Status() parser.NagiosStatus {
+	if e.status != nil {
+		return *e.status
+	}
+	// Events read back from the event log only know their hostname, service and states
+	status := parser.NagiosStatus{Hostname: e.Hostname, Service: e.Service, Instance: e.Instance, State: e.ToState, Flapping: e.Flapping, SuppressedBy: e.SuppressedBy}
+	status.HostGroups, status.ServiceGroups, status.Contacts = e.HostGroups, e.ServiceGroups, e.Contacts
+	status.Labels = e.Labels
+	if e.Type == EventResolved {
+		status.State = e.FromState
+	}
+	return status
+}
+
+func newEvent(eventType string, status *parser.NagiosStatus, now time.Time) Event {
+	return Event{
+		Type:          eventType,
+		Time:          now,
+		Instance:      status.Instance,
+		Hostname:      status.Hostname,
+		Service:       status.Service,
+		Output:        status.Values["plugin_output"],
+		Flapping:      status.IsFlapping(),
+		SuppressedBy:  status.SuppressedBy,
+		HostGroups:    status.HostGroups,
+		ServiceGroups: status.ServiceGroups,
+		Contacts:      status.Contacts,
+		Labels:        status.Labels,
+		status:        status,
+	}
+}
+
+// computeEvents compares two consecutive sets of parsed nagios data and returns the transitions between them
+func computeEvents(prev, cur map[string][]parser.NagiosStatus, now time.Time) []Event {
+	events := []Event{}
+	for _, change := range parser.Diff(prev, cur) {
+		switch change.Kind {
+		case parser.ChangeNew:
+			e := newEvent(EventOpened, change.After, now)
+			e.ToState = change.After.State
+			events = append(events, e)
+		case parser.ChangeResolved:
+			e := newEvent(EventResolved, change.Before, now)
+			e.FromState = change.Before.State
+			e.ToState = "OK"
+			e.Output = ""
+			events = append(events, e)
+		case parser.ChangeChanged:
+			if change.Before.State != change.After.State {
+				eventType := EventEscalated
+				if severity(change.After.State) < severity(change.Before.State) {
+					eventType = EventDeEscalated
+				}
+				e := newEvent(eventType, change.After, now)
+				e.FromState = change.Before.State
+				e.ToState = change.After.State
+				events = append(events, e)
+			}
+			if !change.Before.Acknowledged() && change.After.Acknowledged() {
+				e := newEvent(EventAcknowledged, change.After, now)
+				e.FromState = change.After.State
+				e.ToState = change.After.State
+				events = append(events, e)
+			}
+		}
+	}
+	return events
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
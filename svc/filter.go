@@ -0,0 +1,216 @@
+package svc
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+var (
+	// ErrInvalidFilter indicates a filter with a bad pattern or value
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// Filter selects a subset of the nagios issues. The zero value matches everything
+// Host and Service are glob patterns, or regular expressions when enclosed in slashes (e.g. /^web-\d+$/)
+// HostGroups, ServiceGroups and Contacts match issues with any of them, they are read from objects.cache.
+// Labels are selectors that must all match, key=value or key for labels that are set
+type Filter struct {
+	States        []string      `json:"states,omitempty"`
+	Host          string        `json:"host,omitempty"`
+	Service       string        `json:"service,omitempty"`
+	Instances     []string      `json:"instances,omitempty"`
+	HostGroups    []string      `json:"host_groups,omitempty"`
+	ServiceGroups []string      `json:"service_groups,omitempty"`
+	Contacts      []string      `json:"contacts,omitempty"`
+	Labels        []string      `json:"labels,omitempty"`
+	Acknowledged  *bool         `json:"acknowledged,omitempty"`
+	InDowntime    *bool         `json:"in_downtime,omitempty"`
+	Flapping      *bool         `json:"flapping,omitempty"`
+	Suppressed    *bool         `json:"suppressed,omitempty"`
+	StateType     string        `json:"state_type,omitempty"`
+	MinDuration   time.Duration `json:"min_duration,omitempty"`
+
+	hostMatcher    func(string) bool
+	serviceMatcher func(string) bool
+	labels         []labelSelector
+}
+
+// labelSelector matches the issues having a label, with a value unless any is set
+type labelSelector struct {
+	key, value string
+	any        bool
+}
+
+// newPatternMatcher returns a matcher for a glob pattern or a /regex/
+func newPatternMatcher(pattern string) (func(string) bool, error) {
+	if pattern == "" {
+		return func(string) bool { return true }, nil
+	}
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, ErrInvalidFilter
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, ErrInvalidFilter
+	}
+	return func(s string) bool {
+		matched, _ := path.Match(pattern, s)
+		return matched
+	}, nil
+}
+
+// Compile validates the filter and prepares its patterns, it must be called before Match
+func (f *Filter) Compile() error {
+	var err error
+	if f.hostMatcher, err = newPatternMatcher(f.Host); err != nil {
+		return err
+	}
+	if f.serviceMatcher, err = newPatternMatcher(f.Service); err != nil {
+		return err
+	}
+	for i, state := range f.States {
+		f.States[i] = strings.ToUpper(state)
+	}
+	f.labels = nil
+	for _, selector := range f.Labels {
+		kv := strings.SplitN(selector, "=", 2)
+		if kv[0] == "" {
+			return ErrInvalidFilter
+		}
+		if len(kv) == 1 {
+			f.labels = append(f.labels, labelSelector{key: kv[0], any: true})
+		} else {
+			f.labels = append(f.labels, labelSelector{key: kv[0], value: kv[1]})
+		}
+	}
+	switch f.StateType {
+	case "", "hard", "soft":
+	default:
+		return ErrInvalidFilter
+	}
+	if f.MinDuration < 0 {
+		return ErrInvalidFilter
+	}
+	return nil
+}
+
+// Key returns a stable representation of the filter, suitable for caching. Lists are sorted,
+// their order doesn't change what the filter matches
+func (f Filter) Key() string {
+	for _, list := range []*[]string{&f.States, &f.Instances, &f.HostGroups, &f.ServiceGroups, &f.Contacts, &f.Labels} {
+		sorted := append([]string(nil), *list...)
+		sort.Strings(sorted)
+		*list = sorted
+	}
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, v := range wanted {
+		if contains(values, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchEvent applies the filter to the status an event was computed from
+func (f Filter) MatchEvent(e Event, now time.Time) bool {
+	return f.Match(e.Status(), now)
+}
+
+// Match reports whether a nagios status passes the filter at the given time
+func (f Filter) Match(status parser.NagiosStatus, now time.Time) bool {
+	if len(f.States) > 0 && !contains(f.States, status.State) {
+		return false
+	}
+	if len(f.Instances) > 0 && !contains(f.Instances, status.Instance) {
+		return false
+	}
+	if len(f.HostGroups) > 0 && !containsAny(status.HostGroups, f.HostGroups) {
+		return false
+	}
+	if len(f.ServiceGroups) > 0 && !containsAny(status.ServiceGroups, f.ServiceGroups) {
+		return false
+	}
+	if len(f.Contacts) > 0 && !containsAny(status.Contacts, f.Contacts) {
+		return false
+	}
+	for _, selector := range f.labels {
+		if value, found := status.Labels[selector.key]; !found || (!selector.any && value != selector.value) {
+			return false
+		}
+	}
+	if f.hostMatcher != nil && !f.hostMatcher(status.Hostname) {
+		return false
+	}
+	if f.serviceMatcher != nil && !f.serviceMatcher(status.Service) {
+		return false
+	}
+	if f.Acknowledged != nil && *f.Acknowledged != status.Acknowledged() {
+		return false
+	}
+	if f.InDowntime != nil {
+		depth, _ := strconv.Atoi(status.Values["scheduled_downtime_depth"])
+		if *f.InDowntime != (depth > 0) {
+			return false
+		}
+	}
+	if f.Suppressed != nil && *f.Suppressed != (status.SuppressedBy != "") {
+		return false
+	}
+	if f.Flapping != nil && *f.Flapping != status.IsFlapping() {
+		return false
+	}
+	switch f.StateType {
+	case "hard":
+		if status.Values["state_type"] != "1" {
+			return false
+		}
+	case "soft":
+		if status.Values["state_type"] != "0" {
+			return false
+		}
+	}
+	if f.MinDuration > 0 {
+		changed, err := strconv.ParseInt(status.Values["last_state_change"], 10, 64)
+		if err != nil || now.Sub(time.Unix(changed, 0)) < f.MinDuration {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns the statuses that pass the filter, hosts without any remaining status are left out
+func (f Filter) Apply(data map[string][]parser.NagiosStatus, now time.Time) map[string][]parser.NagiosStatus {
+	result := make(map[string][]parser.NagiosStatus)
+	for host, statuses := range data {
+		for _, status := range statuses {
+			if f.Match(status, now) {
+				result[host] = append(result[host], status)
+			}
+		}
+	}
+	return result
+}
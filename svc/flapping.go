@@ -0,0 +1,158 @@
+package svc
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+// Default flap detection settings of the service
+const (
+	DefaultFlapWindow         = 10
+	DefaultFlapStartThreshold = 50.0
+	DefaultFlapStopThreshold  = 25.0
+)
+
+// FlapDetection configures flap detection. An issue starts flapping when the share of refreshes that changed its
+// state within the last Window refreshes reaches StartThreshold percent, and stops when it drops below StopThreshold
+type FlapDetection struct {
+	Window         int
+	StartThreshold float64
+	StopThreshold  float64
+}
+
+// WithFlapDetection sets the flap detection of the service, it defaults to the DefaultFlap settings
+func WithFlapDetection(flap FlapDetection) Option {
+	return func(svc *nagiosParserSvc) {
+		svc.flap = flap
+	}
+}
+
+// flapHistory is the state of an issue at every refresh of the window, oldest first
+type flapHistory struct {
+	States   []string `json:"states"`
+	Flapping bool     `json:"flapping"`
+}
+
+// flapKey identifies a host or service across refreshes
+func flapKey(instance, hostname, service string) string {
+	return instance + "\x00" + hostname + "\x00" + service
+}
+
+// percent returns the share of the window's refreshes that changed the state. Histories shorter
+// than the window count as stable for the missing refreshes, so new issues don't flap right away
+func (h flapHistory) percent(window int) float64 {
+	if window < 2 {
+		return 0
+	}
+	changes := 0
+	for i := 1; i < len(h.States); i++ {
+		if h.States[i] != h.States[i-1] {
+			changes++
+		}
+	}
+	return float64(changes) * 100 / float64(window-1)
+}
+
+// stable reports whether every state of the window is OK, the history is dropped then
+func (h flapHistory) stable() bool {
+	for _, state := range h.States {
+		if state != "OK" {
+			return false
+		}
+	}
+	return true
+}
+
+// trackFlapping adds the states of a refresh to the flap histories and marks the flapping issues of result.
+// Issues missing from result are OK. It returns the flapping state of every tracked issue, including resolved ones
+func trackFlapping(tx *bolt.Tx, result map[string][]parser.NagiosStatus, flap FlapDetection) (map[string]bool, error) {
+	flapping := make(map[string]bool)
+	// Issues seen by the first refresh may have been problems for a long time, later ones were OK before
+	first := tx.Bucket([]byte("NagiosFlapping")) == nil
+	b, err := tx.CreateBucketIfNotExists([]byte("NagiosFlapping"))
+	if err != nil {
+		return flapping, err
+	}
+	current := make(map[string]*parser.NagiosStatus)
+	for host := range result {
+		for i := range result[host] {
+			status := &result[host][i]
+			current[flapKey(status.Instance, status.Hostname, status.Service)] = status
+		}
+	}
+	histories := make(map[string]flapHistory)
+	err = b.ForEach(func(k, v []byte) error {
+		var h flapHistory
+		if err := json.Unmarshal(v, &h); err != nil {
+			return err
+		}
+		histories[string(k)] = h
+		return nil
+	})
+	if err != nil {
+		return flapping, err
+	}
+	for key := range current {
+		if _, found := histories[key]; !found {
+			h := flapHistory{}
+			if !first {
+				h.States = []string{"OK"}
+			}
+			histories[key] = h
+		}
+	}
+	for key, h := range histories {
+		state := "OK"
+		if status, found := current[key]; found {
+			state = status.State
+		}
+		h.States = append(h.States, state)
+		if excess := len(h.States) - flap.Window; excess > 0 {
+			h.States = h.States[excess:]
+		}
+		percent := h.percent(flap.Window)
+		if !h.Flapping && percent >= flap.StartThreshold {
+			h.Flapping = true
+		} else if h.Flapping && percent < flap.StopThreshold {
+			h.Flapping = false
+		}
+		if status, found := current[key]; found {
+			status.Flapping = h.Flapping
+			status.FlapPercent = percent
+		}
+		flapping[key] = h.Flapping
+		if !h.Flapping && h.stable() {
+			if err := b.Delete([]byte(key)); err != nil {
+				return flapping, err
+			}
+			continue
+		}
+		hB, err := json.Marshal(h)
+		if err != nil {
+			return flapping, err
+		}
+		if err := b.Put([]byte(key), hB); err != nil {
+			return flapping, err
+		}
+	}
+	return flapping, nil
+}
+
+// markResolvedFlapping sets the current flapping state on resolved events, their status is the one
+// of the previous refresh
+func markResolvedFlapping(events []Event, flapping map[string]bool) {
+	for i := range events {
+		e := &events[i]
+		if e.Type != EventResolved {
+			continue
+		}
+		aggregator := flapping[flapKey(e.Instance, e.Hostname, e.Service)]
+		e.Flapping = aggregator
+		if e.status != nil {
+			e.status.Flapping = aggregator
+			e.Flapping = e.status.IsFlapping()
+		}
+	}
+}
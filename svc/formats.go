@@ -0,0 +1,290 @@
+package svc
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/tchaudhry91/nagiosagg/parser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Response formats supported by the listing endpoints
+const (
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+	FormatYAML  = "yaml"
+	FormatTable = "table"
+)
+
+var (
+	// ErrNotAcceptable indicates that none of the requested response formats is supported
+	ErrNotAcceptable = errors.New("no acceptable response format")
+)
+
+var mediaTypeFormats = map[string]string{
+	"application/json":   FormatJSON,
+	"text/csv":           FormatCSV,
+	"application/yaml":   FormatYAML,
+	"application/x-yaml": FormatYAML,
+	"text/yaml":          FormatYAML,
+	"text/plain":         FormatTable,
+	"*/*":                FormatJSON,
+	"application/*":      FormatJSON,
+	"text/*":             FormatTable,
+}
+
+var formatContentTypes = map[string]string{
+	FormatJSON:  "application/json; charset=utf-8",
+	FormatCSV:   "text/csv; charset=utf-8",
+	FormatYAML:  "application/yaml; charset=utf-8",
+	FormatTable: "text/plain; charset=utf-8",
+}
+
+type formatKey struct{}
+
+// tabular responses can be rendered as CSV and text tables
+type tabular interface {
+	table() (header []string, rows [][]string)
+}
+
+// texter responses have their own plain text rendering instead of a table
+type texter interface {
+	writeText(w io.Writer) error
+}
+
+// formatFromRequest picks the response format from ?format= or else the Accept header.
+// An empty format means nothing acceptable was requested
+func formatFromRequest(r *http.Request) string {
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case FormatJSON, FormatCSV, FormatYAML, FormatTable:
+		return format
+	case "text":
+		return FormatTable
+	default:
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return FormatJSON
+	}
+	type candidate struct {
+		format string
+		q      float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, found := mediaTypeFormats[mediaType]
+		if !found {
+			continue
+		}
+		q := 1.0
+		if value, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{format: format, q: q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].format
+}
+
+// negotiateFormat stores the negotiated response format in the request context
+func negotiateFormat(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, formatKey{}, formatFromRequest(r))
+}
+
+func formatFrom(ctx context.Context) string {
+	format, _ := ctx.Value(formatKey{}).(string)
+	return format
+}
+
+// withFormat rejects requests without an acceptable format before they reach the endpoint
+func withFormat(dec httptransport.DecodeRequestFunc) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		if formatFrom(ctx) == "" {
+			if r.URL.Query().Get("format") != "" {
+				return nil, ErrInvalidQuery
+			}
+			return nil, ErrNotAcceptable
+		}
+		return dec(ctx, r)
+	}
+}
+
+// encodeResponse writes resp in the negotiated format
+func encodeResponse(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
+	format := formatFrom(ctx)
+	if format == "" {
+		format = FormatJSON
+	}
+	switch format {
+	case FormatCSV, FormatTable:
+		if _, ok := resp.(tabular); !ok {
+			if _, ok := resp.(texter); !ok || format == FormatCSV {
+				return ErrNotAcceptable
+			}
+		}
+	}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	switch format {
+	case FormatCSV:
+		header, rows := resp.(tabular).table()
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	case FormatTable:
+		if t, ok := resp.(texter); ok {
+			return t.writeText(w)
+		}
+		header, rows := resp.(tabular).table()
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			// Keep multi-line plugin output on a single table row
+			fmt.Fprintln(tw, strings.Replace(strings.Join(row, "\t"), "\n", " ", -1))
+		}
+		return tw.Flush()
+	case FormatYAML:
+		// Round trip through JSON so YAML uses the same field names
+		b, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(b, &generic); err != nil {
+			return err
+		}
+		out, err := yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	default:
+		return json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+var statusHeader = []string{"hostname", "instance", "service", "state", "attempts", "last_check", "last_state_changed", "output"}
+
+func statusRow(host string, s NagiosStatusResponse) []string {
+	return []string{host, s.Instance, s.Service, s.State, s.Attempts, formatTime(s.LastCheck), formatTime(s.LastStateChanged), s.Output}
+}
+
+func (resp getParsedNagiosResponse) table() ([]string, [][]string) {
+	hosts := make([]string, 0, len(resp))
+	for host := range resp {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	rows := [][]string{}
+	for _, host := range hosts {
+		for _, status := range resp[host] {
+			rows = append(rows, statusRow(host, status))
+			for _, issue := range status.Suppressed {
+				rows = append(rows, statusRow(issue.Hostname, issue.NagiosStatusResponse))
+			}
+		}
+	}
+	return statusHeader, rows
+}
+
+func (resp listIssuesResponse) table() ([]string, [][]string) {
+	rows := [][]string{}
+	for _, issue := range resp.Issues {
+		rows = append(rows, statusRow(issue.Hostname, issue.NagiosStatusResponse))
+	}
+	return statusHeader, rows
+}
+
+func (resp getHostResponse) table() ([]string, [][]string) {
+	rows := [][]string{}
+	for _, status := range resp.HostStatuses {
+		rows = append(rows, statusRow(resp.Hostname, status))
+	}
+	for _, status := range resp.Problems {
+		if status.Service != "" {
+			rows = append(rows, statusRow(resp.Hostname, status))
+		}
+	}
+	return statusHeader, rows
+}
+
+func (resp getEventsResponse) table() ([]string, [][]string) {
+	header := []string{"id", "time", "type", "hostname", "instance", "service", "from_state", "to_state", "output"}
+	rows := [][]string{}
+	for _, e := range resp {
+		rows = append(rows, []string{
+			strconv.FormatUint(e.ID, 10), formatTime(e.Time), e.Type, e.Hostname, e.Instance, e.Service, e.FromState, e.ToState, e.Output,
+		})
+	}
+	return header, rows
+}
+
+func (resp getHostsResponse) table() ([]string, [][]string) {
+	header := []string{"hostname", "state", "problems", "instances"}
+	rows := [][]string{}
+	for _, h := range resp {
+		rows = append(rows, []string{h.Hostname, h.State, strconv.Itoa(h.Problems), strings.Join(h.Instances, ",")})
+	}
+	return header, rows
+}
+
+func (resp getAvailabilityReportResponse) table() ([]string, [][]string) {
+	header := []string{"instance", "hostname", "service", "incidents", "mttr_seconds", "longest_outage_seconds"}
+	for _, state := range reportStates {
+		header = append(header, strings.ToLower(state)+"_percent")
+	}
+	rows := [][]string{}
+	for _, entry := range resp.Entries {
+		row := []string{
+			entry.Instance,
+			entry.Hostname,
+			entry.Service,
+			strconv.Itoa(entry.Incidents),
+			strconv.FormatFloat(entry.MTTR, 'f', 0, 64),
+			strconv.FormatFloat(entry.LongestOutage, 'f', 0, 64),
+		}
+		for _, state := range reportStates {
+			row = append(row, strconv.FormatFloat(entry.TimeInState[state], 'f', 3, 64))
+		}
+		rows = append(rows, row)
+	}
+	return header, rows
+}
+
+func (resp diffSnapshotsResponse) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "# %s -> %s\n", formatTime(resp.From), formatTime(resp.To))
+	return parser.WriteDiffText(w, resp.Changes)
+}
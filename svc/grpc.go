@@ -0,0 +1,256 @@
+package svc
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/ratelimit"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/tchaudhry91/nagiosagg/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type grpcServer struct {
+	pb.UnimplementedNagiosServer
+	getIssues     grpctransport.Handler
+	refresh       grpctransport.Handler
+	listInstances grpctransport.Handler
+	stream        endpoint.Endpoint
+}
+
+// MakeGRPCServer returns a gRPC server for the endpoints, refreshes run through jobs as over HTTP
+func MakeGRPCServer(svc NagiosParserSvc, cacher *cache.Cache, jobs *RefreshJobs, broker *EventBroker) pb.NagiosServer {
+	ee := MakeServerEndpoints(svc, cacher, jobs, broker)
+	return &grpcServer{
+		getIssues: grpctransport.NewServer(
+			ee.getParsedNagios,
+			decodeGRPCGetIssuesRequest,
+			encodeGRPCGetIssuesResponse,
+		),
+		refresh: grpctransport.NewServer(
+			ee.refreshNagiosData,
+			decodeGRPCRefreshRequest,
+			encodeGRPCRefreshResponse,
+		),
+		listInstances: grpctransport.NewServer(
+			ee.listInstances,
+			decodeGRPCListInstancesRequest,
+			encodeGRPCListInstancesResponse,
+		),
+		stream: ee.stream,
+	}
+}
+
+// GetIssues returns the issues matching the filter
+func (s *grpcServer) GetIssues(ctx context.Context, req *pb.GetIssuesRequest) (*pb.GetIssuesReply, error) {
+	_, resp, err := s.getIssues.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp.(*pb.GetIssuesReply), nil
+}
+
+// Refresh refreshes the nagios data
+func (s *grpcServer) Refresh(ctx context.Context, req *pb.RefreshRequest) (*pb.RefreshReply, error) {
+	_, resp, err := s.refresh.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp.(*pb.RefreshReply), nil
+}
+
+// ListInstances returns the nagios instances
+func (s *grpcServer) ListInstances(ctx context.Context, req *pb.ListInstancesRequest) (*pb.ListInstancesReply, error) {
+	_, resp, err := s.listInstances.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp.(*pb.ListInstancesReply), nil
+}
+
+// WatchIssues streams the events of future refreshes. The go-kit gRPC transport only serves unary calls,
+// so the stream endpoint is called directly
+func (s *grpcServer) WatchIssues(req *pb.WatchIssuesRequest, stream pb.Nagios_WatchIssuesServer) error {
+	filter, err := filterFromProto(req.GetFilter())
+	if err != nil {
+		return grpcError(err)
+	}
+	resp, err := s.stream(stream.Context(), streamRequest{
+		Filter:      filter,
+		LastEventID: req.GetLastEventId(),
+		Resume:      req.LastEventId != nil,
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	sub := resp.(streamResponse)
+	defer sub.broker.Unsubscribe(sub.sub)
+	for _, e := range sub.sub.Replay {
+		if err := stream.Send(eventToProto(e)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, open := <-sub.sub.Events():
+			if !open {
+				return status.Error(codes.Aborted, "fell behind the event stream, resume with last_event_id")
+			}
+			if err := stream.Send(eventToProto(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcError maps the service errors to gRPC status codes, like codeFrom does for HTTP
+func grpcError(err error) error {
+	switch err {
+	case ErrJSONUnMarshall, ErrInvalidQuery, ErrInvalidFilter, ErrInvalidCursor:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case ErrSnapshotNotFound, ErrHostNotFound, ErrSummaryNotFound, ErrJobNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case ratelimit.ErrLimited:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func filterFromProto(f *pb.Filter) (Filter, error) {
+	filter := Filter{
+		States:        f.GetStates(),
+		Host:          f.GetHost(),
+		Service:       f.GetService(),
+		Instances:     f.GetInstances(),
+		HostGroups:    f.GetHostGroups(),
+		ServiceGroups: f.GetServiceGroups(),
+		Contacts:      f.GetContacts(),
+		Labels:        f.GetLabels(),
+		StateType:     f.GetStateType(),
+	}
+	if f != nil {
+		filter.Acknowledged = f.Acknowledged
+		filter.InDowntime = f.InDowntime
+		filter.Flapping = f.Flapping
+		filter.Suppressed = f.Suppressed
+	}
+	if d := f.GetMinDuration(); d != nil {
+		if err := d.CheckValid(); err != nil {
+			return filter, ErrInvalidFilter
+		}
+		filter.MinDuration = d.AsDuration()
+	}
+	return filter, filter.Compile()
+}
+
+// timestampProto leaves unknown times unset rather than sending the zero time
+func timestampProto(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func decodeGRPCGetIssuesRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*pb.GetIssuesRequest)
+	filter, err := filterFromProto(req.GetFilter())
+	// Issues are flat in the gRPC API
+	return getParsedNagiosRequest{Filter: filter, Flatten: true}, err
+}
+
+func encodeGRPCGetIssuesResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(getParsedNagiosResponse)
+	hosts := make([]string, 0, len(resp))
+	for host := range resp {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	reply := &pb.GetIssuesReply{Issues: []*pb.Issue{}}
+	for _, host := range hosts {
+		for _, s := range resp[host] {
+			reply.Issues = append(reply.Issues, &pb.Issue{
+				Hostname:           host,
+				Instance:           s.Instance,
+				Service:            s.Service,
+				State:              s.State,
+				Output:             s.Output,
+				Attempts:           s.Attempts,
+				LastCheck:          timestampProto(s.LastCheck),
+				NextCheck:          timestampProto(s.NextCheck),
+				LastStateChanged:   timestampProto(s.LastStateChanged),
+				Flapping:           s.Flapping,
+				FlapPercent:        s.FlapPercent,
+				NagiosFlapping:     s.NagiosFlapping,
+				PercentStateChange: s.PercentStateChange,
+				SuppressedBy:       s.SuppressedBy,
+				HostGroups:         s.HostGroups,
+				ServiceGroups:      s.ServiceGroups,
+				Contacts:           s.Contacts,
+				Alias:              s.Alias,
+				Address:            s.Address,
+				Parents:            s.Parents,
+				Labels:             s.Labels,
+			})
+		}
+	}
+	return reply, nil
+}
+
+func decodeGRPCRefreshRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return refreshNagiosDataRequest{}, nil
+}
+
+func encodeGRPCRefreshResponse(_ context.Context, response interface{}) (interface{}, error) {
+	report := response.(refreshNagiosDataResponse).report
+	return &pb.RefreshReply{
+		RefreshedAt: timestampProto(report.RefreshedAt),
+		Sources:     int32(report.Sources),
+		Hosts:       int32(report.Hosts),
+		Problems:    int32(report.Problems),
+		Events:      int32(report.NumEvents),
+	}, nil
+}
+
+func decodeGRPCListInstancesRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return listInstancesRequest{}, nil
+}
+
+func encodeGRPCListInstancesResponse(_ context.Context, response interface{}) (interface{}, error) {
+	reply := &pb.ListInstancesReply{Instances: []*pb.Instance{}}
+	for _, i := range response.(listInstancesResponse) {
+		reply.Instances = append(reply.Instances, &pb.Instance{
+			Name:     i.Name,
+			Hosts:    int32(i.Hosts),
+			Problems: int32(i.Problems),
+		})
+	}
+	return reply, nil
+}
+
+func eventToProto(e Event) *pb.IssueEvent {
+	return &pb.IssueEvent{
+		Id:            e.ID,
+		Type:          e.Type,
+		Time:          timestampProto(e.Time),
+		Instance:      e.Instance,
+		Hostname:      e.Hostname,
+		Service:       e.Service,
+		FromState:     e.FromState,
+		ToState:       e.ToState,
+		Output:        e.Output,
+		Flapping:      e.Flapping,
+		SuppressedBy:  e.SuppressedBy,
+		HostGroups:    e.HostGroups,
+		ServiceGroups: e.ServiceGroups,
+		Contacts:      e.Contacts,
+		Labels:        e.Labels,
+	}
+}
@@ -0,0 +1,28 @@
+package svc
+
+import (
+	"context"
+)
+
+// RefreshHook is called with the report of every successful refresh. service is the layer below the hooks,
+// for hooks reading more of the refreshed data than the report
+type RefreshHook func(ctx context.Context, service NagiosParserSvc, report RefreshReport)
+
+// afterRefreshMiddleware calls the hooks registered with it after every successful refresh.
+// Only refreshes are hooked, the other methods are passed through by the embedded service
+type afterRefreshMiddleware struct {
+	NagiosParserSvc
+	hooks []RefreshHook
+}
+
+// RefreshNagiosData proxies the request to the inner layer and calls the hooks in order with the report
+func (mw *afterRefreshMiddleware) RefreshNagiosData(ctx context.Context) (report RefreshReport, err error) {
+	report, err = mw.NagiosParserSvc.RefreshNagiosData(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, hook := range mw.hooks {
+		hook(ctx, mw.NagiosParserSvc, report)
+	}
+	return report, nil
+}
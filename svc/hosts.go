@@ -0,0 +1,249 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+var (
+	// ErrHostNotFound indicates a host that none of the nagios instances knows about
+	ErrHostNotFound = errors.New("host not found")
+)
+
+// Comment is a nagios host or service comment
+type Comment struct {
+	Instance   string    `json:"instance,omitempty"`
+	Service    string    `json:"service,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Text       string    `json:"text"`
+	EntryTime  time.Time `json:"entry_time"`
+	Persistent bool      `json:"persistent"`
+}
+
+// Downtime is a scheduled nagios host or service downtime
+type Downtime struct {
+	Instance  string    `json:"instance,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Fixed     bool      `json:"fixed"`
+}
+
+// HostSummary is a host known to at least one nagios instance
+type HostSummary struct {
+	Hostname  string   `json:"hostname"`
+	Instances []string `json:"instances"`
+	// State is the worst host state across the instances
+	State    string `json:"state,omitempty"`
+	Problems int    `json:"problems"`
+}
+
+// HostDetail is everything known about a single host across the nagios instances
+type HostDetail struct {
+	Hostname string `json:"hostname"`
+	// HostStatuses are the host checks of every instance, including OK ones
+	HostStatuses []parser.NagiosStatus `json:"host_statuses"`
+	// Problems are the non-OK host and service statuses
+	Problems  []parser.NagiosStatus `json:"problems"`
+	Comments  []Comment             `json:"comments"`
+	Downtimes []Downtime            `json:"downtimes"`
+}
+
+func unixValue(values map[string]string, key string) time.Time {
+	ts, err := strconv.ParseInt(values[key], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0).UTC()
+}
+
+func hostDetail(hosts map[string]*HostDetail, hostname string) *HostDetail {
+	host, found := hosts[hostname]
+	if !found {
+		host = &HostDetail{
+			Hostname:     hostname,
+			HostStatuses: []parser.NagiosStatus{},
+			Problems:     []parser.NagiosStatus{},
+			Comments:     []Comment{},
+			Downtimes:    []Downtime{},
+		}
+		hosts[hostname] = host
+	}
+	return host
+}
+
+// collectHosts gathers host statuses, comments and downtimes from the blocks of a status file
+// Problems aren't collected here, they are always read from the main nagios bucket
+func collectHosts(hosts map[string]*HostDetail, blocks []parser.NagiosStatus) {
+	for _, block := range blocks {
+		if block.Hostname == "" {
+			continue
+		}
+		switch block.StatusType {
+		case "hoststatus", "host":
+			host := hostDetail(hosts, block.Hostname)
+			host.HostStatuses = append(host.HostStatuses, block)
+		case "servicestatus", "service":
+			// Make sure hosts without a host check are known as well
+			hostDetail(hosts, block.Hostname)
+		case "hostcomment", "servicecomment":
+			host := hostDetail(hosts, block.Hostname)
+			host.Comments = append(host.Comments, Comment{
+				Instance:   block.Instance,
+				Service:    block.Values["service_description"],
+				Author:     block.Values["author"],
+				Text:       block.Values["comment_data"],
+				EntryTime:  unixValue(block.Values, "entry_time"),
+				Persistent: block.Values["persistent"] == "1",
+			})
+		case "hostdowntime", "servicedowntime":
+			host := hostDetail(hosts, block.Hostname)
+			host.Downtimes = append(host.Downtimes, Downtime{
+				Instance:  block.Instance,
+				Service:   block.Values["service_description"],
+				Author:    block.Values["author"],
+				Comment:   block.Values["comment"],
+				StartTime: unixValue(block.Values, "start_time"),
+				EndTime:   unixValue(block.Values, "end_time"),
+				Fixed:     block.Values["fixed"] == "1",
+			})
+		}
+	}
+}
+
+// storeHosts replaces the stored host details
+func storeHosts(tx *bolt.Tx, hosts map[string]*HostDetail) error {
+	if err := tx.DeleteBucket([]byte("NagiosHosts")); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	b, err := tx.CreateBucket([]byte("NagiosHosts"))
+	if err != nil {
+		return err
+	}
+	for hostname, host := range hosts {
+		hostB, err := json.Marshal(host)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(hostname), hostB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetHosts returns every host known to the nagios instances, sorted by hostname
+func (svc *nagiosParserSvc) GetHosts(ctx context.Context) ([]HostSummary, error) {
+	hosts := []HostSummary{}
+	localDB, err := openBoltDB(svc.localDB)
+	if err != nil {
+		return hosts, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("NagiosHosts"))
+		if b == nil {
+			return nil
+		}
+		problems, err := readNagiosBucket(tx)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var host HostDetail
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+			summary := HostSummary{
+				Hostname:  host.Hostname,
+				Instances: []string{},
+				Problems:  len(problems[host.Hostname]),
+			}
+			seen := make(map[string]bool)
+			for _, status := range host.HostStatuses {
+				if !seen[status.Instance] {
+					seen[status.Instance] = true
+					summary.Instances = append(summary.Instances, status.Instance)
+				}
+				if summary.State == "" || severity(status.State) > severity(summary.State) {
+					summary.State = status.State
+				}
+			}
+			for _, status := range problems[host.Hostname] {
+				if !seen[status.Instance] {
+					seen[status.Instance] = true
+					summary.Instances = append(summary.Instances, status.Instance)
+				}
+			}
+			sort.Strings(summary.Instances)
+			hosts = append(hosts, summary)
+			return nil
+		})
+	})
+	localDB.Close()
+	return hosts, err
+}
+
+// GetHost returns the host statuses, problems, comments and downtimes of a host across the instances
+func (svc *nagiosParserSvc) GetHost(ctx context.Context, hostname string) (HostDetail, error) {
+	var host HostDetail
+	localDB, err := openBoltDB(svc.localDB)
+	if err != nil {
+		return host, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("NagiosHosts"))
+		if b == nil {
+			return ErrHostNotFound
+		}
+		v := b.Get([]byte(hostname))
+		if v == nil {
+			return ErrHostNotFound
+		}
+		if err := json.Unmarshal(v, &host); err != nil {
+			return err
+		}
+		if nagiosB := tx.Bucket([]byte("NagiosDB")); nagiosB != nil {
+			if v := nagiosB.Get([]byte(hostname)); v != nil {
+				return json.Unmarshal(v, &host.Problems)
+			}
+		}
+		return nil
+	})
+	localDB.Close()
+	return host, err
+}
+
+// GetServiceProblems returns every host where the service is failing
+func (svc *nagiosParserSvc) GetServiceProblems(ctx context.Context, service string) (map[string][]parser.NagiosStatus, error) {
+	result := make(map[string][]parser.NagiosStatus)
+	localDB, err := openBoltDB(svc.localDB)
+	if err != nil {
+		return result, err
+	}
+	var all map[string][]parser.NagiosStatus
+	err = localDB.View(func(tx *bolt.Tx) error {
+		all, err = readNagiosBucket(tx)
+		return err
+	})
+	localDB.Close()
+	if err != nil {
+		return result, err
+	}
+	for host, statuses := range all {
+		for _, status := range statuses {
+			if status.Service == service {
+				result[host] = append(result[host], status)
+			}
+		}
+	}
+	return result, nil
+}
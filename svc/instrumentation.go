@@ -15,11 +15,12 @@ type instrumentingMiddleware struct {
 	requests        metrics.Counter
 	requestDuration metrics.Histogram
 	numHosts        metrics.Histogram
+	flapping        metrics.Gauge
 	next            NagiosParserSvc
 }
 
 // GetParsedNagios instruments the underlying nagiosParseSvc endpoint
-func (mw *instrumentingMiddleware) GetParsedNagios(ctx context.Context) (output map[string][]parser.NagiosStatus, err error) {
+func (mw *instrumentingMiddleware) GetParsedNagios(ctx context.Context, filter Filter) (output map[string][]parser.NagiosStatus, err error) {
 	defer func(begin time.Time) {
 		lvs := []string{
 			"method", "/nagios",
@@ -29,11 +30,11 @@ func (mw *instrumentingMiddleware) GetParsedNagios(ctx context.Context) (output
 		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
 		mw.numHosts.With(lvs...).Observe(float64(len(output)))
 	}(time.Now())
-	output, err = mw.next.GetParsedNagios(ctx)
+	output, err = mw.next.GetParsedNagios(ctx, filter)
 	return output, err
 }
 
-func (mw *instrumentingMiddleware) RefreshNagiosData(ctx context.Context) (err error) {
+func (mw *instrumentingMiddleware) RefreshNagiosData(ctx context.Context) (report RefreshReport, err error) {
 	defer func(begin time.Time) {
 		lvs := []string{
 			"method", "/refresh",
@@ -41,7 +42,108 @@ func (mw *instrumentingMiddleware) RefreshNagiosData(ctx context.Context) (err e
 		}
 		mw.requests.With(lvs...).Add(1)
 		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+		if err == nil {
+			mw.flapping.Set(float64(report.Flapping))
+		}
+	}(time.Now())
+	report, err = mw.next.RefreshNagiosData(ctx)
+	return report, err
+}
+
+// GetEvents instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) GetEvents(ctx context.Context, since time.Time) (events []Event, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/events",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	events, err = mw.next.GetEvents(ctx, since)
+	return events, err
+}
+
+// DiffSnapshots instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) DiffSnapshots(ctx context.Context, from, to time.Time) (diff SnapshotDiff, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/diff",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	diff, err = mw.next.DiffSnapshots(ctx, from, to)
+	return diff, err
+}
+
+// GetAvailabilityReport instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) GetAvailabilityReport(ctx context.Context, from, to time.Time) (report AvailabilityReport, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/reports/availability",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	report, err = mw.next.GetAvailabilityReport(ctx, from, to)
+	return report, err
+}
+
+// GetHosts instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) GetHosts(ctx context.Context) (hosts []HostSummary, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/hosts",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	hosts, err = mw.next.GetHosts(ctx)
+	return hosts, err
+}
+
+// GetHost instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) GetHost(ctx context.Context, hostname string) (host HostDetail, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/hosts/{host}",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	host, err = mw.next.GetHost(ctx, hostname)
+	return host, err
+}
+
+// GetServiceProblems instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) GetServiceProblems(ctx context.Context, service string) (output map[string][]parser.NagiosStatus, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/services/{service}",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	output, err = mw.next.GetServiceProblems(ctx, service)
+	return output, err
+}
+
+// GetSummary instruments the underlying nagiosParseSvc endpoint
+func (mw *instrumentingMiddleware) GetSummary(ctx context.Context, top int) (summary Summary, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{
+			"method", "/summary",
+			"err", fmt.Sprint(err != nil),
+		}
+		mw.requests.With(lvs...).Add(1)
+		mw.requestDuration.With(lvs...).Observe(time.Since(begin).Seconds())
 	}(time.Now())
-	err = mw.next.RefreshNagiosData(ctx)
-	return err
+	summary, err = mw.next.GetSummary(ctx, top)
+	return summary, err
 }
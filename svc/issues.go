@@ -0,0 +1,208 @@
+package svc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+// Sort orders supported by the issue listing
+const (
+	SortSeverity        = "severity"
+	SortLastStateChange = "last_state_change"
+	SortHost            = "host"
+	SortDuration        = "duration"
+)
+
+// Listing limits
+const (
+	defaultIssueLimit = 100
+	maxIssueLimit     = 1000
+)
+
+var (
+	// ErrInvalidCursor indicates a pagination cursor that is malformed or belongs to another sort order
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Issue is a single nagios problem in the flat issue listing
+type Issue struct {
+	Hostname string `json:"hostname"`
+	NagiosStatusResponse
+}
+
+// IssueQuery selects, orders and pages the flat issue listing
+type IssueQuery struct {
+	Filter Filter
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+// IssuePage is one page of the flat issue listing
+type IssuePage struct {
+	Total      int     `json:"total"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	Issues     []Issue `json:"issues"`
+}
+
+// issuePosition locates an issue within an ordering. Cursors are positions rather than offsets,
+// so pages stay stable when issues appear or disappear between refreshes
+type issuePosition struct {
+	Sort     string `json:"s"`
+	Desc     bool   `json:"d"`
+	Num      int64  `json:"n,omitempty"`
+	Hostname string `json:"h"`
+	Instance string `json:"i,omitempty"`
+	Service  string `json:"v,omitempty"`
+}
+
+func positionOf(issue Issue, sortBy string, desc bool) issuePosition {
+	pos := issuePosition{
+		Sort:     sortBy,
+		Desc:     desc,
+		Hostname: issue.Hostname,
+		Instance: issue.Instance,
+		Service:  issue.Service,
+	}
+	switch sortBy {
+	case SortSeverity:
+		pos.Num = int64(severity(issue.State))
+	case SortLastStateChange:
+		pos.Num = issue.LastStateChanged.Unix()
+	case SortDuration:
+		// The longer an issue has been in its state, the earlier it changed
+		pos.Num = -issue.LastStateChanged.Unix()
+	}
+	return pos
+}
+
+// compare orders two positions of the same sort, ties are broken by host, instance and service
+func (a issuePosition) compare(b issuePosition) int {
+	primary := 0
+	switch {
+	case a.Sort == SortHost:
+		primary = strings.Compare(a.Hostname, b.Hostname)
+	case a.Num < b.Num:
+		primary = -1
+	case a.Num > b.Num:
+		primary = 1
+	}
+	if a.Desc {
+		primary = -primary
+	}
+	if primary != 0 {
+		return primary
+	}
+	if c := strings.Compare(a.Hostname, b.Hostname); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Instance, b.Instance); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Service, b.Service)
+}
+
+func encodeCursor(pos issuePosition) string {
+	b, _ := json.Marshal(pos)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (issuePosition, error) {
+	var pos issuePosition
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pos, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &pos); err != nil {
+		return pos, ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+// NewIssue returns the issue of a nagios status. Unparseable timestamps are left zero rather than dropping the issue
+func NewIssue(status parser.NagiosStatus) Issue {
+	resp, _ := newNagiosStatusResponse(status)
+	return Issue{Hostname: status.Hostname, NagiosStatusResponse: resp}
+}
+
+// FlattenIssues turns the hostname mapped data into a list of issues, as returned by /v2/issues
+func FlattenIssues(data map[string][]parser.NagiosStatus) []Issue {
+	issues := []Issue{}
+	for host, statuses := range data {
+		for _, status := range statuses {
+			issue := NewIssue(status)
+			issue.Hostname = host
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// pageIssues sorts the issues and returns the page following the query cursor
+func pageIssues(issues []Issue, query IssueQuery) (IssuePage, error) {
+	page := IssuePage{Total: len(issues), Issues: []Issue{}}
+	sortBy := query.Sort
+	switch sortBy {
+	case "":
+		sortBy = SortSeverity
+	case SortSeverity, SortLastStateChange, SortHost, SortDuration:
+	default:
+		return page, ErrInvalidQuery
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultIssueLimit
+	}
+	if limit > maxIssueLimit {
+		limit = maxIssueLimit
+	}
+
+	positions := make([]issuePosition, len(issues))
+	for i, issue := range issues {
+		positions[i] = positionOf(issue, sortBy, query.Desc)
+	}
+	sort.Sort(issuesByPosition{issues: issues, positions: positions})
+
+	start := 0
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if after.Sort != sortBy || after.Desc != query.Desc {
+			return page, ErrInvalidCursor
+		}
+		start = sort.Search(len(positions), func(i int) bool {
+			return positions[i].compare(after) > 0
+		})
+	}
+	end := start + limit
+	if end > len(issues) {
+		end = len(issues)
+	}
+	page.Issues = append(page.Issues, issues[start:end]...)
+	if end < len(issues) {
+		page.NextCursor = encodeCursor(positions[end-1])
+	}
+	return page, nil
+}
+
+type issuesByPosition struct {
+	issues    []Issue
+	positions []issuePosition
+}
+
+func (s issuesByPosition) Len() int { return len(s.issues) }
+func (s issuesByPosition) Less(i, j int) bool {
+	return s.positions[i].compare(s.positions[j]) < 0
+}
+func (s issuesByPosition) Swap(i, j int) {
+	s.issues[i], s.issues[j] = s.issues[j], s.issues[i]
+	s.positions[i], s.positions[j] = s.positions[j], s.positions[i]
+}
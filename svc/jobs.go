@@ -0,0 +1,168 @@
+package svc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+// Refresh job statuses
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// maxRefreshJobs is the number of finished jobs kept around for status requests
+const maxRefreshJobs = 50
+
+var (
+	// ErrJobNotFound indicates an unknown or expired refresh job
+	ErrJobNotFound = errors.New("refresh job not found")
+)
+
+// RefreshJob is an asynchronous refresh of the nagios data
+type RefreshJob struct {
+	ID           string         `json:"id"`
+	Status       string         `json:"status"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   *time.Time     `json:"finished_at,omitempty"`
+	SourcesDone  int            `json:"sources_done"`
+	SourcesTotal int            `json:"sources_total"`
+	Report       *RefreshReport `json:"report,omitempty"`
+	Err          string         `json:"err,omitempty"`
+
+	// done is closed when the job finished, err is the error of the refresh
+	done chan struct{}
+	err  error
+}
+
+// RefreshJobs runs refreshes in the background, at most one at a time. The HTTP and gRPC servers share
+// a single RefreshJobs so that their refreshes are deduplicated and rate limited together
+type RefreshJobs struct {
+	svc     NagiosParserSvc
+	limiter *rate.Limiter
+
+	mu      sync.Mutex
+	jobs    map[string]*RefreshJob
+	order   []string
+	running *RefreshJob
+}
+
+// NewRefreshJobs returns a job runner for svc. Starting a job takes a token from limiter,
+// requests made while a job is running are deduplicated onto it and don't
+func NewRefreshJobs(svc NagiosParserSvc, limiter *rate.Limiter) *RefreshJobs {
+	return &RefreshJobs{
+		svc:     svc,
+		limiter: limiter,
+		jobs:    make(map[string]*RefreshJob),
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start starts a refresh job, or returns the running one. It fails with ratelimit.ErrLimited
+// when the previous job was started too recently
+func (j *RefreshJobs) Start() (RefreshJob, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, err := j.start()
+	if err != nil {
+		return RefreshJob{}, err
+	}
+	return *job, nil
+}
+
+// Run starts a refresh job, or joins the running one, and waits for it to finish.
+// It returns the report and error of the refresh
+func (j *RefreshJobs) Run(ctx context.Context) (RefreshReport, error) {
+	j.mu.Lock()
+	job, err := j.start()
+	j.mu.Unlock()
+	if err != nil {
+		return RefreshReport{}, err
+	}
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return RefreshReport{}, ctx.Err()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job.err != nil {
+		return RefreshReport{}, job.err
+	}
+	return *job.Report, nil
+}
+
+// start returns the running job, or starts one. j.mu must be held
+func (j *RefreshJobs) start() (*RefreshJob, error) {
+	if j.running != nil {
+		return j.running, nil
+	}
+	if !j.limiter.Allow() {
+		return nil, ratelimit.ErrLimited
+	}
+	job := &RefreshJob{
+		ID:        newJobID(),
+		Status:    JobRunning,
+		StartedAt: time.Now().UTC(),
+		done:      make(chan struct{}),
+	}
+	j.jobs[job.ID] = job
+	j.order = append(j.order, job.ID)
+	if len(j.order) > maxRefreshJobs {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+	j.running = job
+	go j.run(job)
+	return job, nil
+}
+
+func (j *RefreshJobs) run(job *RefreshJob) {
+	// The job outlives the request that started it
+	ctx := WithRefreshProgress(context.Background(), func(done, total int) {
+		j.mu.Lock()
+		job.SourcesDone = done
+		job.SourcesTotal = total
+		j.mu.Unlock()
+	})
+	report, err := j.svc.RefreshNagiosData(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	if err != nil {
+		job.Status = JobFailed
+		job.Err = err.Error()
+		job.err = err
+	} else {
+		job.Status = JobSucceeded
+		job.Report = &report
+	}
+	j.running = nil
+	close(job.done)
+}
+
+// Get returns the current state of a job
+func (j *RefreshJobs) Get(id string) (RefreshJob, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, found := j.jobs[id]
+	if !found {
+		return RefreshJob{}, ErrJobNotFound
+	}
+	return *job, nil
+}
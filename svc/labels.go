@@ -0,0 +1,98 @@
+package svc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tchaudhry91/nagiosagg/parser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LabelRule splits a custom variable holding a delimited list into one label per item. Items are
+// labeled Prefix+item with the value "true", or Prefix+key with the value for key/value items
+type LabelRule struct {
+	// Var is the custom variable, e.g. TAGS for _TAGS
+	Var string `yaml:"var"`
+	// Separator splits the items, any whitespace by default
+	Separator string `yaml:"separator"`
+	// KeyValue splits key/value items, e.g. ":" for os:linux. Items are keys only without it
+	KeyValue string `yaml:"key_value"`
+	Prefix   string `yaml:"prefix"`
+}
+
+// WithLabelRules sets the rules applied to the custom variables of every refresh, e.g. a rule with Var TAGS
+// and Prefix "tag/" splits check_mk tags into labels like tag/prod. Without rules, only the variables are labels
+func WithLabelRules(rules []LabelRule) Option {
+	return func(svc *nagiosParserSvc) {
+		svc.labelRules = rules
+	}
+}
+
+// labelRulesConfig is the label rules config file
+type labelRulesConfig struct {
+	Rules []LabelRule `yaml:"rules"`
+}
+
+// LoadLabelRules reads the rules of a YAML label rules file. Unknown fields are rejected to catch typos
+func LoadLabelRules(path string) ([]LabelRule, error) {
+	var config labelRulesConfig
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, rule := range config.Rules {
+		if rule.Var == "" {
+			return nil, fmt.Errorf("%s: rule %d needs a var", path, i)
+		}
+		config.Rules[i].Var = strings.ToUpper(strings.TrimPrefix(rule.Var, "_"))
+	}
+	return config.Rules, nil
+}
+
+// labelName turns a custom variable name into a label name, _TAGS is labeled tags
+func labelName(name string) string {
+	return strings.ToLower(name)
+}
+
+// applyLabels sets the labels of the statuses from their custom variables. Every variable is a label,
+// the variables of the rules also get a label per item
+func applyLabels(blocks []parser.NagiosStatus, rules []LabelRule) {
+	for i := range blocks {
+		block := &blocks[i]
+		if len(block.CustomVars) == 0 {
+			continue
+		}
+		block.Labels = make(map[string]string)
+		for name, value := range block.CustomVars {
+			block.Labels[labelName(name)] = value
+		}
+		for _, rule := range rules {
+			value, found := block.CustomVars[rule.Var]
+			if !found {
+				continue
+			}
+			var items []string
+			if rule.Separator == "" {
+				items = strings.Fields(value)
+			} else {
+				items = strings.Split(value, rule.Separator)
+			}
+			for _, item := range items {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				key, itemValue := item, "true"
+				if rule.KeyValue != "" {
+					if kv := strings.SplitN(item, rule.KeyValue, 2); len(kv) == 2 {
+						key, itemValue = kv[0], kv[1]
+					}
+				}
+				block.Labels[rule.Prefix+key] = itemValue
+			}
+		}
+	}
+}
@@ -15,28 +15,136 @@ type loggingMiddleware struct {
 }
 
 // GetParsedNagios logs the values and proxies the request to the inner layer
-func (mw *loggingMiddleware) GetParsedNagios(ctx context.Context) (output map[string][]parser.NagiosStatus, err error) {
+func (mw *loggingMiddleware) GetParsedNagios(ctx context.Context, filter Filter) (output map[string][]parser.NagiosStatus, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "/nagios",
+			"filter", filter.Key(),
 			"numhosts", len(output),
 			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	output, err = mw.next.GetParsedNagios(ctx)
+	output, err = mw.next.GetParsedNagios(ctx, filter)
 	return output, err
 }
 
 // RefreshNagiosData logs the values and proxies the request to the inner layer
-func (mw *loggingMiddleware) RefreshNagiosData(ctx context.Context) (err error) {
+func (mw *loggingMiddleware) RefreshNagiosData(ctx context.Context) (report RefreshReport, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "/refresh",
+			"sources", report.Sources,
+			"numevents", report.NumEvents,
 			"err", err,
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	err = mw.next.RefreshNagiosData(ctx)
-	return err
+	report, err = mw.next.RefreshNagiosData(ctx)
+	return report, err
+}
+
+// GetEvents logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) GetEvents(ctx context.Context, since time.Time) (events []Event, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/events",
+			"since", since,
+			"numevents", len(events),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	events, err = mw.next.GetEvents(ctx, since)
+	return events, err
+}
+
+// DiffSnapshots logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) DiffSnapshots(ctx context.Context, from, to time.Time) (diff SnapshotDiff, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/diff",
+			"from", from,
+			"to", to,
+			"numchanges", len(diff.Changes),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	diff, err = mw.next.DiffSnapshots(ctx, from, to)
+	return diff, err
+}
+
+// GetAvailabilityReport logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) GetAvailabilityReport(ctx context.Context, from, to time.Time) (report AvailabilityReport, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/reports/availability",
+			"from", from,
+			"to", to,
+			"numentries", len(report.Entries),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	report, err = mw.next.GetAvailabilityReport(ctx, from, to)
+	return report, err
+}
+
+// GetHosts logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) GetHosts(ctx context.Context) (hosts []HostSummary, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/hosts",
+			"numhosts", len(hosts),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	hosts, err = mw.next.GetHosts(ctx)
+	return hosts, err
+}
+
+// GetHost logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) GetHost(ctx context.Context, hostname string) (host HostDetail, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/hosts/{host}",
+			"host", hostname,
+			"numproblems", len(host.Problems),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	host, err = mw.next.GetHost(ctx, hostname)
+	return host, err
+}
+
+// GetServiceProblems logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) GetServiceProblems(ctx context.Context, service string) (output map[string][]parser.NagiosStatus, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/services/{service}",
+			"service", service,
+			"numhosts", len(output),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	output, err = mw.next.GetServiceProblems(ctx, service)
+	return output, err
+}
+
+// GetSummary logs the values and proxies the request to the inner layer
+func (mw *loggingMiddleware) GetSummary(ctx context.Context, top int) (summary Summary, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "/summary",
+			"top", top,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	summary, err = mw.next.GetSummary(ctx, top)
+	return summary, err
 }
@@ -30,13 +30,26 @@ func CachingMiddleware(cacher *cache.Cache) Middleware {
 }
 
 // InstrumentingMiddleware produces an instrumenting middleware builder. This is a service middleware
-func InstrumentingMiddleware(requests metrics.Counter, requestDuration metrics.Histogram, numHosts metrics.Histogram) Middleware {
+// flapping is set to the number of flapping problems after every refresh
+func InstrumentingMiddleware(requests metrics.Counter, requestDuration metrics.Histogram, numHosts metrics.Histogram, flapping metrics.Gauge) Middleware {
 	return func(next NagiosParserSvc) NagiosParserSvc {
 		return &instrumentingMiddleware{
 			next:            next,
 			requests:        requests,
 			requestDuration: requestDuration,
 			numHosts:        numHosts,
+			flapping:        flapping,
+		}
+	}
+}
+
+// AfterRefreshMiddleware produces a middleware builder calling hooks after every successful refresh,
+// e.g. to broadcast, notify or publish its events. This is a service middleware
+func AfterRefreshMiddleware(hooks ...RefreshHook) Middleware {
+	return func(next NagiosParserSvc) NagiosParserSvc {
+		return &afterRefreshMiddleware{
+			NagiosParserSvc: next,
+			hooks:           hooks,
 		}
 	}
 }
@@ -2,30 +2,86 @@ package svc
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/tchaudhry91/nagiosagg/parser"
 )
 
+// maxEvents is the number of state transitions kept in the event log
+const maxEvents = 100000
+
 // NagiosParserSvc is a service that returns aggregated data from various nagios sources
 type NagiosParserSvc interface {
-	GetParsedNagios(ctx context.Context) (map[string][]parser.NagiosStatus, error)
-	RefreshNagiosData(ctx context.Context) error
+	GetParsedNagios(ctx context.Context, filter Filter) (map[string][]parser.NagiosStatus, error)
+	RefreshNagiosData(ctx context.Context) (RefreshReport, error)
+	GetEvents(ctx context.Context, since time.Time) ([]Event, error)
+	DiffSnapshots(ctx context.Context, from, to time.Time) (SnapshotDiff, error)
+	GetAvailabilityReport(ctx context.Context, from, to time.Time) (AvailabilityReport, error)
+	GetHosts(ctx context.Context) ([]HostSummary, error)
+	GetHost(ctx context.Context, hostname string) (HostDetail, error)
+	GetServiceProblems(ctx context.Context, service string) (map[string][]parser.NagiosStatus, error)
+	GetSummary(ctx context.Context, top int) (Summary, error)
+}
+
+// RefreshReport describes the outcome of a refresh
+type RefreshReport struct {
+	RefreshedAt time.Time `json:"refreshed_at"`
+	Sources     int       `json:"sources"`
+	Hosts       int       `json:"hosts"`
+	Problems    int       `json:"problems"`
+	NumEvents   int       `json:"events"`
+	// Flapping is the number of problems flapping, as detected by the aggregator or nagios
+	Flapping int `json:"flapping"`
+	// Suppressed is the number of problems caused by a DOWN or UNREACHABLE host
+	Suppressed int `json:"suppressed"`
+	// Events are the transitions recorded by the refresh, see GET /events
+	Events []Event `json:"-"`
+}
+
+type refreshProgressKey struct{}
+
+// WithRefreshProgress returns a context that makes RefreshNagiosData report the number of parsed sources
+func WithRefreshProgress(ctx context.Context, progress func(done, total int)) context.Context {
+	return context.WithValue(ctx, refreshProgressKey{}, progress)
+}
+
+func refreshProgressFrom(ctx context.Context) func(done, total int) {
+	if progress, ok := ctx.Value(refreshProgressKey{}).(func(done, total int)); ok {
+		return progress
+	}
+	return func(done, total int) {}
 }
 
 type nagiosParserSvc struct {
-	statusDir string
-	localDB   string
+	statusDir  string
+	localDB    string
+	flap       FlapDetection
+	labelRules []LabelRule
 }
 
+// Option configures the nagios parser service
+type Option func(*nagiosParserSvc)
+
 // NewNagiosParserSvc returns a boltdb backed nagios parser service
-func NewNagiosParserSvc(statusDir, localDB string) (NagiosParserSvc, error) {
-	svc := nagiosParserSvc{statusDir: statusDir, localDB: localDB}
+func NewNagiosParserSvc(statusDir, localDB string, options ...Option) (NagiosParserSvc, error) {
+	svc := nagiosParserSvc{
+		statusDir: statusDir,
+		localDB:   localDB,
+		flap:      FlapDetection{Window: DefaultFlapWindow, StartThreshold: DefaultFlapStartThreshold, StopThreshold: DefaultFlapStopThreshold},
+	}
+	for _, option := range options {
+		option(&svc)
+	}
 	if _, err := os.Stat(statusDir); err != nil {
 		return &svc, err
 	}
@@ -40,9 +96,12 @@ func openBoltDB(localDB string) (*bolt.DB, error) {
 	return db, nil
 }
 
-// GetParsedNagios returns a parsed list of nagios issues per host
-func (svc *nagiosParserSvc) GetParsedNagios(ctx context.Context) (map[string][]parser.NagiosStatus, error) {
+// GetParsedNagios returns a parsed list of nagios issues per host that pass the filter
+func (svc *nagiosParserSvc) GetParsedNagios(ctx context.Context, filter Filter) (map[string][]parser.NagiosStatus, error) {
 	result := make(map[string][]parser.NagiosStatus)
+	if err := filter.Compile(); err != nil {
+		return result, err
+	}
 	localDB, err := openBoltDB(svc.localDB)
 	if err != nil {
 		return result, err
@@ -52,7 +111,7 @@ func (svc *nagiosParserSvc) GetParsedNagios(ctx context.Context) (map[string][]p
 		if b == nil {
 			return fmt.Errorf("Empty Status Bucket")
 		}
-		err = b.ForEach(func(k, v []byte) error {
+		return b.ForEach(func(k, v []byte) error {
 			var statuses []parser.NagiosStatus
 			err := json.Unmarshal(v, &statuses)
 			if err != nil {
@@ -61,53 +120,106 @@ func (svc *nagiosParserSvc) GetParsedNagios(ctx context.Context) (map[string][]p
 			result[string(k)] = statuses
 			return nil
 		})
-		return nil
 	})
 	localDB.Close()
-	return result, err
+	if err != nil {
+		return result, err
+	}
+	return filter.Apply(result, time.Now()), nil
 }
 
-//RefreshNagiosData returns a parsed map of hostname to issues from various nagios status files
-func (svc *nagiosParserSvc) RefreshNagiosData(ctx context.Context) error {
+// RefreshNagiosData parses the nagios status files into the local DB and reports on the outcome
+func (svc *nagiosParserSvc) RefreshNagiosData(ctx context.Context) (RefreshReport, error) {
 	result := make(map[string][]parser.NagiosStatus)
+	report := RefreshReport{}
 	files, err := filepath.Glob(filepath.Join(svc.statusDir, "*.dat"))
 	if err != nil {
-		return err
+		return report, err
 	}
 	gatherers := len(files)
+	report.Sources = gatherers
+	progress := refreshProgressFrom(ctx)
+	progress(0, gatherers)
+	var done int32
 	var wg sync.WaitGroup
-	resultChan := make(chan map[string][]parser.NagiosStatus, gatherers)
+	resultChan := make(chan []parser.NagiosStatus, gatherers)
 	errChan := make(chan error, gatherers)
 
 	for _, f := range files {
 		wg.Add(1)
 		go func(filename string) {
 			defer wg.Done()
-			resultsLocal, errLocal := parser.ParseStatusFromFile(filename)
+			// Every gatherer sends at most one error, errChan would fill up otherwise
+			blocksLocal, errLocal := parser.ParseBlocksFromFile(filename)
 			if errLocal != nil {
 				errChan <- errLocal
+				return
 			}
-			resultChan <- resultsLocal
+			instance := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+			for i := range blocksLocal {
+				blocksLocal[i].Instance = instance
+			}
+			if errLocal := EnrichStatuses(filename, blocksLocal, svc.labelRules); errLocal != nil {
+				errChan <- errLocal
+				return
+			}
+			resultChan <- blocksLocal
+			progress(int(atomic.AddInt32(&done, 1)), gatherers)
 		}(f)
 	}
 	wg.Wait()
 	close(resultChan)
 	close(errChan)
 	if len(errChan) > 0 {
-		return fmt.Errorf("Failed to parse nagios data: %v ", <-errChan)
+		return report, fmt.Errorf("Failed to parse nagios data: %v ", <-errChan)
 	}
-	for resultChunk := range resultChan {
-		for hostname, values := range resultChunk {
-			result[hostname] = values
+	now := time.Now().UTC()
+	hosts := make(map[string]*HostDetail)
+	summary := newSummary(now)
+	for blocks := range resultChan {
+		collectHosts(hosts, blocks)
+		summary.add(blocks)
+		for hostname, values := range parser.Problems(blocks) {
+			// The same host may be monitored by more than one instance
+			result[hostname] = append(result[hostname], values...)
 		}
 	}
+	summary.rankHosts(result)
+	report.Suppressed = correlateHostDown(result)
 	// Marshall and Store results in localDB
 	localDB, err := openBoltDB(svc.localDB)
 	if err != nil {
-		return err
+		return report, err
 	}
 	err = localDB.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket([]byte("NagiosDB"))
+		previous, err := readNagiosBucket(tx)
+		if err != nil {
+			return err
+		}
+		// Flapping is tracked first, so that the events carry it
+		flapping, err := trackFlapping(tx, result, svc.flap)
+		if err != nil {
+			return err
+		}
+		report.Events = computeEvents(previous, result, now)
+		markResolvedFlapping(report.Events, flapping)
+		err = appendEvents(tx, report.Events)
+		if err != nil {
+			return err
+		}
+		err = storeSnapshot(tx, result, now)
+		if err != nil {
+			return err
+		}
+		err = storeHosts(tx, hosts)
+		if err != nil {
+			return err
+		}
+		err = storeSummary(tx, summary)
+		if err != nil {
+			return err
+		}
+		err = tx.DeleteBucket([]byte("NagiosDB"))
 		if err != nil {
 			// Ignore for now, because bucket may not exist
 		}
@@ -129,8 +241,190 @@ func (svc *nagiosParserSvc) RefreshNagiosData(ctx context.Context) error {
 	})
 	if err != nil {
 		localDB.Close()
-		return err
+		return report, err
 	}
 	localDB.Close()
+	report.RefreshedAt = now
+	report.Hosts = len(hosts)
+	for _, statuses := range result {
+		report.Problems += len(statuses)
+		for _, status := range statuses {
+			if status.IsFlapping() {
+				report.Flapping++
+			}
+		}
+	}
+	report.NumEvents = len(report.Events)
+	return report, nil
+}
+
+// ObjectsSuffix names the optional objects.cache of an instance, next to its status file: <instance>.objects.cache
+const ObjectsSuffix = ".objects.cache"
+
+// joinObjects sets the metadata of the statuses of an instance from its objects.cache, if it has one
+func joinObjects(statusFile string, blocks []parser.NagiosStatus) error {
+	objects, err := parser.ParseObjectsFromFile(strings.TrimSuffix(statusFile, filepath.Ext(statusFile)) + ObjectsSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	objects.Join(blocks)
+	return nil
+}
+
+// EnrichStatuses adds the metadata of the objects.cache next to the status file the statuses were parsed from,
+// when there is one, and their labels, like a refresh does. Statuses that weren't read from a file, e.g. from stdin,
+// are only labeled when statusFile is empty
+func EnrichStatuses(statusFile string, statuses []parser.NagiosStatus, rules []LabelRule) error {
+	if statusFile != "" {
+		if err := joinObjects(statusFile, statuses); err != nil {
+			return err
+		}
+	}
+	applyLabels(statuses, rules)
+	return nil
+}
+
+// readNagiosBucket returns the currently stored nagios data, or an empty map if there is none yet
+func readNagiosBucket(tx *bolt.Tx) (map[string][]parser.NagiosStatus, error) {
+	result := make(map[string][]parser.NagiosStatus)
+	b := tx.Bucket([]byte("NagiosDB"))
+	if b == nil {
+		return result, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		var statuses []parser.NagiosStatus
+		if err := json.Unmarshal(v, &statuses); err != nil {
+			return err
+		}
+		result[string(k)] = statuses
+		return nil
+	})
+	return result, err
+}
+
+// eventTimes returns the time index of the event log, building it for events stored before it existed
+func eventTimes(tx *bolt.Tx, b *bolt.Bucket) (*bolt.Bucket, error) {
+	if index := tx.Bucket([]byte("NagiosEventTimes")); index != nil {
+		return index, nil
+	}
+	index, err := tx.CreateBucket([]byte("NagiosEventTimes"))
+	if err != nil {
+		return nil, err
+	}
+	err = b.ForEach(func(k, v []byte) error {
+		var e Event
+		if err := json.Unmarshal(v, &e); err != nil {
+			return err
+		}
+		return index.Put(timeKey(e.Time, e.ID), k)
+	})
+	return index, err
+}
+
+// appendEvents adds events to the event log and drops the oldest events beyond maxEvents
+func appendEvents(tx *bolt.Tx, events []Event) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("NagiosEvents"))
+	if err != nil {
+		return err
+	}
+	index, err := eventTimes(tx, b)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		// IDs are set in place so the refresh report carries them as well
+		events[i].ID, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		eventB, err := json.Marshal(events[i])
+		if err != nil {
+			return err
+		}
+		err = b.Put(itob(events[i].ID), eventB)
+		if err != nil {
+			return err
+		}
+		err = index.Put(timeKey(events[i].Time, events[i].ID), itob(events[i].ID))
+		if err != nil {
+			return err
+		}
+	}
+	last := b.Sequence()
+	if last <= maxEvents {
+		return nil
+	}
+	// Event IDs are sequential, so everything up to this one is beyond the retention
+	oldest := last - maxEvents
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	// The index is in time order, which needn't be the order of the IDs if the clock went back.
+	// Expired events recorded after a newer one are dropped from the index once they reach its start
+	c = index.Cursor()
+	for k, v := c.First(); k != nil && binary.BigEndian.Uint64(v) <= oldest; k, v = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// GetEvents returns the state transitions recorded after the given time
+func (svc *nagiosParserSvc) GetEvents(ctx context.Context, since time.Time) ([]Event, error) {
+	events := []Event{}
+	localDB, err := openBoltDB(svc.localDB)
+	if err != nil {
+		return events, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("NagiosEvents"))
+		if b == nil {
+			// No refresh has happened yet
+			return nil
+		}
+		index := tx.Bucket([]byte("NagiosEventTimes"))
+		if index == nil {
+			// Events stored before the index existed, it is built by the next refresh
+			return b.ForEach(func(k, v []byte) error {
+				var e Event
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				if e.Time.After(since) {
+					events = append(events, e)
+				}
+				return nil
+			})
+		}
+		c := index.Cursor()
+		k, id := c.Seek(timeKey(since, math.MaxUint64))
+		if !since.After(time.Unix(0, 0)) {
+			// Events before 1970 share the first key
+			k, id = c.First()
+		}
+		for ; k != nil; k, id = c.Next() {
+			v := b.Get(id)
+			if v == nil {
+				// Expired, waiting to be dropped from the index
+				continue
+			}
+			var e Event
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Time.After(since) {
+				events = append(events, e)
+			}
+		}
+		return nil
+	})
+	localDB.Close()
+	return events, err
+}
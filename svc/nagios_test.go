@@ -2,10 +2,21 @@ package svc
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/tchaudhry91/nagiosagg/internal/testutil"
+	"github.com/tchaudhry91/nagiosagg/parser"
 )
 
 var statusDir = flag.String("statusDir", "../samples/public", "Directory containing nagios .dat files")
@@ -19,14 +30,14 @@ func init() {
 func TestNagiosData(t *testing.T) {
 	ctx := context.TODO()
 	t.Run("Populate", func(t *testing.T) {
-		err := svc.RefreshNagiosData(ctx)
+		_, err := svc.RefreshNagiosData(ctx)
 		if err != nil {
 			t.Errorf("Population failed with: %v", err)
 			t.FailNow()
 		}
 	})
 	t.Run("Fetch", func(t *testing.T) {
-		result, err := svc.GetParsedNagios(ctx)
+		result, err := svc.GetParsedNagios(ctx, Filter{})
 		if err != nil {
 			t.Errorf("Fetch of data failed with: %v", err)
 			t.FailNow()
@@ -36,5 +47,597 @@ func TestNagiosData(t *testing.T) {
 			t.FailNow()
 		}
 	})
+	t.Run("Filter", func(t *testing.T) {
+		soft := false
+		filter := Filter{States: []string{"critical"}, Host: "/^[a-m]/", StateType: "hard", Acknowledged: &soft, MinDuration: time.Hour}
+		result, err := svc.GetParsedNagios(ctx, filter)
+		if err != nil {
+			t.Errorf("Filtered fetch failed with: %v", err)
+			t.FailNow()
+		}
+		if len(result) < 1 {
+			t.Errorf("Filter matched no hosts")
+		}
+		for host, statuses := range result {
+			for _, status := range statuses {
+				if status.State != "CRITICAL" || host[0] > 'm' || status.Values["state_type"] != "1" || status.Acknowledged() {
+					t.Errorf("Status passed the filter incorrectly: %s/%s %s", host, status.Service, status.State)
+				}
+			}
+		}
+		if _, err := svc.GetParsedNagios(ctx, Filter{Service: "/(/"}); err != ErrInvalidFilter {
+			t.Errorf("Expected ErrInvalidFilter, got %v", err)
+		}
+	})
+	t.Run("Hosts", func(t *testing.T) {
+		hosts, err := svc.GetHosts(ctx)
+		if err != nil {
+			t.Errorf("Fetch of hosts failed with: %v", err)
+			t.FailNow()
+		}
+		problems, _ := svc.GetParsedNagios(ctx, Filter{})
+		if len(hosts) < len(problems) {
+			t.Errorf("Fewer known hosts (%d) than hosts with problems (%d)", len(hosts), len(problems))
+		}
+		host, err := svc.GetHost(ctx, "frodo")
+		if err != nil {
+			t.Errorf("Fetch of host failed with: %v", err)
+			t.FailNow()
+		}
+		if len(host.HostStatuses) < 1 || len(host.Comments) < 1 || len(host.Downtimes) < 1 {
+			t.Errorf("Incomplete host: %d statuses, %d comments, %d downtimes", len(host.HostStatuses), len(host.Comments), len(host.Downtimes))
+		}
+		if _, err := svc.GetHost(ctx, "no-such-host"); err != ErrHostNotFound {
+			t.Errorf("Expected ErrHostNotFound, got %v", err)
+		}
+		for _, p := range host.Problems {
+			failing, err := svc.GetServiceProblems(ctx, p.Service)
+			if err != nil || len(failing["frodo"]) < 1 {
+				t.Errorf("Service %s of frodo not found failing: %v", p.Service, err)
+			}
+		}
+	})
+	t.Run("Summary", func(t *testing.T) {
+		summary, err := svc.GetSummary(ctx, 3)
+		if err != nil {
+			t.Errorf("Fetch of summary failed with: %v", err)
+			t.FailNow()
+		}
+		if len(summary.NoisiestHosts) != 3 {
+			t.Errorf("Expected the 3 noisiest hosts, have %d", len(summary.NoisiestHosts))
+		}
+		if summary.Totals.Hosts["OK"] < 1 || summary.Totals.Services["CRITICAL"] < 1 {
+			t.Errorf("Unexpected totals: %+v", summary.Totals)
+		}
+		problems, _ := svc.GetParsedNagios(ctx, Filter{StateType: "hard"})
+		var hard int
+		for _, counts := range []map[string]int{summary.ByStateType["hard"].Hosts, summary.ByStateType["hard"].Services} {
+			for _, n := range counts {
+				hard += n
+			}
+		}
+		var want int
+		for _, statuses := range problems {
+			for _, status := range statuses {
+				if status.State != "" {
+					want++
+				}
+			}
+		}
+		if hard != want {
+			t.Errorf("want %d hard problems, have %d", want, hard)
+		}
+		if oldest := summary.OldestUnacknowledgedCritical; oldest == nil || oldest.Age <= 0 {
+			t.Errorf("Missing oldest unacknowledged critical: %+v", oldest)
+		}
+		// Criticals without a valid state change time aren't taken as the oldest
+		critical := func(service, lastStateChange string) parser.NagiosStatus {
+			return parser.NagiosStatus{StatusType: "servicestatus", Hostname: "host1", Service: service, State: "CRITICAL",
+				Values: map[string]string{"last_state_change": lastStateChange}}
+		}
+		s := newSummary(time.Now())
+		s.add([]parser.NagiosStatus{critical("garbled", "yesterday"), critical("never", "0"), critical("disk", "1537942541")})
+		if oldest := s.OldestUnacknowledgedCritical; oldest == nil || oldest.Service != "disk" {
+			t.Errorf("Expected disk as the oldest critical, have %+v", oldest)
+		}
+	})
+	t.Run("Events", func(t *testing.T) {
+		events, err := svc.GetEvents(ctx, time.Time{})
+		if err != nil {
+			t.Errorf("Fetch of events failed with: %v", err)
+			t.FailNow()
+		}
+		if len(events) < 1 {
+			t.Errorf("No events recorded on first refresh")
+			t.FailNow()
+		}
+		for _, e := range events {
+			if e.Type != EventOpened {
+				t.Errorf("Unexpected event on first refresh: %s", e.Type)
+			}
+		}
+		latest := events[len(events)-1].Time
+		events, err = svc.GetEvents(ctx, latest)
+		if err != nil || len(events) != 0 {
+			t.Errorf("Expected no events after %v, got %d (%v)", latest, len(events), err)
+		}
+	})
+	t.Run("Diff", func(t *testing.T) {
+		if _, err := svc.DiffSnapshots(ctx, time.Time{}, time.Time{}); err != ErrSnapshotNotFound {
+			t.Errorf("Expected ErrSnapshotNotFound without a previous snapshot, got %v", err)
+		}
+		if _, err := svc.RefreshNagiosData(ctx); err != nil {
+			t.Fatalf("Second refresh failed with: %v", err)
+		}
+		diff, err := svc.DiffSnapshots(ctx, time.Time{}, time.Time{})
+		if err != nil {
+			t.Errorf("Diff of snapshots failed with: %v", err)
+			t.FailNow()
+		}
+		if !diff.From.Before(diff.To) {
+			t.Errorf("Expected the previous snapshot to be compared to the latest, got %v and %v", diff.From, diff.To)
+		}
+		if len(diff.Changes) != 0 {
+			t.Errorf("Expected no changes between refreshes of the same data, found %d", len(diff.Changes))
+		}
+		diff, err = svc.DiffSnapshots(ctx, diff.To, time.Time{})
+		if err != nil || !diff.From.Equal(diff.To) {
+			t.Errorf("Expected the latest snapshot to be compared to itself, got %v and %v (%v)", diff.From, diff.To, err)
+		}
+		_, err = svc.DiffSnapshots(ctx, time.Unix(0, 0), time.Time{})
+		if err != ErrSnapshotNotFound {
+			t.Errorf("Expected ErrSnapshotNotFound, got %v", err)
+		}
+	})
 	os.Remove(filepath.Join(os.TempDir(), "tmp-test.boltdb"))
 }
+
+func TestEventLog(t *testing.T) {
+	dir := testutil.TempDir(t)
+	service, _ := NewNagiosParserSvc(dir, filepath.Join(dir, "nagios.db"))
+	localDB := service.(*nagiosParserSvc).localDB
+	at := func(hour int) Event {
+		return Event{Type: EventOpened, Time: time.Date(2018, 9, 26, hour, 0, 0, 0, time.UTC), Hostname: "host" + strconv.Itoa(hour)}
+	}
+	appendTo := func(events ...Event) {
+		db, err := openBoltDB(localDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Update(func(tx *bolt.Tx) error { return appendEvents(tx, events) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hosts := func(events []Event) []string {
+		hosts := []string{}
+		for _, e := range events {
+			hosts = append(hosts, e.Hostname)
+		}
+		return hosts
+	}
+
+	appendTo(at(1), at(2))
+	// Logs stored before the time index existed are indexed by the next append
+	db, _ := openBoltDB(localDB)
+	db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("NagiosEventTimes")) })
+	db.Close()
+	// The clock went back
+	appendTo(at(4), at(3))
+	events, err := service.GetEvents(context.Background(), time.Time{})
+	if have := hosts(events); err != nil || !reflect.DeepEqual(have, []string{"host1", "host2", "host3", "host4"}) {
+		t.Errorf("Want all events in time order, have %v (%v)", have, err)
+	}
+	events, err = service.GetEvents(context.Background(), at(2).Time)
+	if have := hosts(events); err != nil || !reflect.DeepEqual(have, []string{"host3", "host4"}) {
+		t.Errorf("Want the events after 2:00, have %v (%v)", have, err)
+	}
+
+	if testing.Short() {
+		return
+	}
+	// The oldest events are dropped beyond maxEvents
+	many := make([]Event, maxEvents)
+	for i := range many {
+		many[i] = at(5)
+	}
+	appendTo(many...)
+	events, err = service.GetEvents(context.Background(), time.Time{})
+	if err != nil || len(events) != maxEvents || events[0].ID != 5 {
+		t.Errorf("Want the latest %d events from ID 5, have %d (%v)", maxEvents, len(events), err)
+	}
+}
+
+func TestComputeEvents(t *testing.T) {
+	status := func(service, state, ack string) parser.NagiosStatus {
+		return parser.NagiosStatus{
+			StatusType: "servicestatus",
+			Instance:   "nagios1",
+			Hostname:   "host1",
+			Service:    service,
+			State:      state,
+			Values:     map[string]string{"problem_has_been_acknowledged": ack},
+		}
+	}
+	prev := map[string][]parser.NagiosStatus{
+		"host1": {
+			status("disk", "WARNING", "0"),
+			status("load", "CRITICAL", "0"),
+			status("ssh", "CRITICAL", "0"),
+			status("ntp", "WARNING", "0"),
+		},
+	}
+	cur := map[string][]parser.NagiosStatus{
+		"host1": {
+			status("disk", "CRITICAL", "0"),
+			status("load", "WARNING", "0"),
+			status("ntp", "WARNING", "1"),
+			status("http", "UNKNOWN", "0"),
+		},
+	}
+	want := map[string]string{
+		"disk": EventEscalated,
+		"load": EventDeEscalated,
+		"ntp":  EventAcknowledged,
+		"http": EventOpened,
+		"ssh":  EventResolved,
+	}
+	events := computeEvents(prev, cur, time.Now())
+	if len(events) != len(want) {
+		t.Errorf("Incorrect number of events: %d", len(events))
+		t.FailNow()
+	}
+	for _, e := range events {
+		if want[e.Service] != e.Type {
+			t.Errorf("%s: want %s, have %s", e.Service, want[e.Service], e.Type)
+		}
+	}
+}
+
+func TestTrackFlapping(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "tmp-flapping.boltdb")
+	defer os.Remove(path)
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	critical := map[string][]parser.NagiosStatus{
+		"host1": {{StatusType: "servicestatus", Instance: "nagios1", Hostname: "host1", Service: "ssh", State: "CRITICAL"}},
+	}
+	refresh := func(result map[string][]parser.NagiosStatus) (flapping bool) {
+		err := db.Update(func(tx *bolt.Tx) error {
+			states, err := trackFlapping(tx, result, FlapDetection{Window: 10, StartThreshold: 50, StopThreshold: 25})
+			flapping = states[flapKey("nagios1", "host1", "ssh")]
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statuses := result["host1"]; len(statuses) > 0 && statuses[0].Flapping != flapping {
+			t.Errorf("Status and tracked flapping state differ")
+		}
+		return flapping
+	}
+	// Five state changes within the window of ten refreshes reach the start threshold
+	for i := 1; i <= 7; i++ {
+		result := critical
+		if i%2 == 0 {
+			result = map[string][]parser.NagiosStatus{}
+		}
+		if flapping := refresh(result); flapping != (i >= 6) {
+			t.Errorf("Refresh %d: want flapping %v", i, i >= 6)
+		}
+	}
+	if percent := critical["host1"][0].FlapPercent; int(percent) != 66 {
+		t.Errorf("Want a flap percent of 66, have %v", percent)
+	}
+	// The issue flaps until the changes drop below the stop threshold
+	for i := 8; i <= 14; i++ {
+		if flapping := refresh(critical); flapping != (i < 14) {
+			t.Errorf("Refresh %d: want flapping %v", i, i < 14)
+		}
+	}
+}
+
+func TestCorrelateHostDown(t *testing.T) {
+	status := func(host, service, state string) parser.NagiosStatus {
+		statusType := "servicestatus"
+		if service == "" {
+			statusType = "hoststatus"
+		}
+		return parser.NagiosStatus{StatusType: statusType, Instance: "nagios1", Hostname: host, Service: service, State: state}
+	}
+	web1 := status("web1", "", "UNREACHABLE")
+	web1.Parents = []string{"switch1", "router1"}
+	result := map[string][]parser.NagiosStatus{
+		"router1": {status("router1", "", "DOWN")},
+		"web1":    {web1, status("web1", "http", "CRITICAL")},
+		"db1":     {status("db1", "", "DOWN"), status("db1", "mysql", "CRITICAL"), status("db1", "disk", "WARNING")},
+		"app1":    {status("app1", "load", "WARNING")},
+	}
+	if suppressed := correlateHostDown(result); suppressed != 4 {
+		t.Errorf("Want 4 suppressed problems, have %d", suppressed)
+	}
+	want := map[string]string{"router1/": "", "web1/": "router1", "web1/http": "router1", "db1/": "", "db1/mysql": "db1", "db1/disk": "db1", "app1/load": ""}
+	for _, statuses := range result {
+		for _, status := range statuses {
+			if by := want[status.Hostname+"/"+status.Service]; status.SuppressedBy != by {
+				t.Errorf("%s/%s: want suppressed by %q, have %q", status.Hostname, status.Service, by, status.SuppressedBy)
+			}
+		}
+	}
+
+	grouped := groupSuppressed(result)
+	if _, found := grouped["web1"]; found || len(grouped) != 3 {
+		t.Errorf("Want the hosts behind router1 grouped under it, have %v", grouped)
+	}
+	router := grouped["router1"][0].Suppressed
+	if len(router) != 2 || router[0].Hostname != "web1" || router[0].Service != "" || router[1].Service != "http" {
+		t.Errorf("Unexpected problems under router1 %+v", router)
+	}
+	if db := grouped["db1"]; len(db) != 1 || len(db[0].Suppressed) != 2 || db[0].Suppressed[0].Service != "disk" {
+		t.Errorf("Want the services of db1 under its host problem, have %+v", db)
+	}
+	// Without their host problem, suppressed problems stay at the top level
+	if grouped := groupSuppressed(map[string][]parser.NagiosStatus{"db1": result["db1"][1:]}); len(grouped["db1"]) != 2 {
+		t.Errorf("Want the suppressed problems at the top level, have %+v", grouped)
+	}
+}
+
+func TestRefreshFailures(t *testing.T) {
+	// A status file and an objects.cache that both fail to read used to block the refresh forever
+	dir := testutil.TempDir(t)
+	os.Mkdir(filepath.Join(dir, "nagios.dat"), 0755)
+	os.Mkdir(filepath.Join(dir, "nagios"+ObjectsSuffix), 0755)
+	service, _ := NewNagiosParserSvc(dir, filepath.Join(dir, "nagios.db"))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := service.RefreshNagiosData(context.Background())
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Want the parse error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Refresh blocked on its errors")
+	}
+}
+
+func TestObjectsCache(t *testing.T) {
+	dir := testutil.TempDir(t)
+	testutil.CopyStatusFile(t, filepath.Join(*statusDir, "random3.dat"), filepath.Join(dir, "nagios.dat"))
+	objects := `define host {
+	host_name	localhost
+	alias	Local host
+	address	127.0.0.1
+	hostgroups	linux
+	contacts	alice
+	}
+
+define service {
+	host_name	localhost
+	service_description	SSH
+	contacts	alice
+	_RUNBOOK	https://wiki/ssh
+	}
+
+define host {
+	host_name	tama
+	contacts	bob
+	}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "nagios"+ObjectsSuffix), []byte(objects), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service, _ := NewNagiosParserSvc(dir, filepath.Join(dir, "nagios.db"))
+	ctx := context.Background()
+	if _, err := service.RefreshNagiosData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	result, err := service.GetParsedNagios(ctx, Filter{HostGroups: []string{"linux"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh := result["localhost"]; len(result) != 1 || len(ssh) != 1 || ssh[0].Alias != "Local host" || ssh[0].CustomVars["RUNBOOK"] != "https://wiki/ssh" {
+		t.Errorf("Want the metadata joined to the SSH problem of localhost, have %+v", result)
+	}
+	result, _ = service.GetParsedNagios(ctx, Filter{Contacts: []string{"bob"}})
+	if _, found := result["localhost"]; found {
+		t.Errorf("Want the problems of bob only, have %+v", result)
+	}
+}
+
+func TestApplyLabels(t *testing.T) {
+	blocks := []parser.NagiosStatus{
+		{Hostname: "web1", State: "DOWN", Metadata: parser.Metadata{CustomVars: map[string]string{"TAGS": "cmk-agent prod site:berlin", "FILENAME": "/wato/hosts.mk"}}},
+		{Hostname: "web2", State: "DOWN"},
+	}
+	applyLabels(blocks, []LabelRule{{Var: "TAGS", Prefix: "tag/", KeyValue: ":"}})
+	want := map[string]string{"tags": "cmk-agent prod site:berlin", "filename": "/wato/hosts.mk", "tag/cmk-agent": "true", "tag/prod": "true", "tag/site": "berlin"}
+	if !reflect.DeepEqual(blocks[0].Labels, want) {
+		t.Errorf("want labels %v, have %v", want, blocks[0].Labels)
+	}
+	if blocks[1].Labels != nil {
+		t.Errorf("Want no labels without custom variables, have %v", blocks[1].Labels)
+	}
+	for selectors, match := range map[string]bool{"tag/prod": true, "tag/site=berlin,tag/prod": true, "tag/site=paris": false, "tag/dev": false} {
+		filter := Filter{Labels: strings.Split(selectors, ",")}
+		if err := filter.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		if filter.Match(blocks[0], time.Now()) != match {
+			t.Errorf("%s: want match %v", selectors, match)
+		}
+	}
+	if err := (&Filter{Labels: []string{"=prod"}}).Compile(); err != ErrInvalidFilter {
+		t.Errorf("Want an invalid filter for a selector without key, have %v", err)
+	}
+
+	path := filepath.Join(os.TempDir(), "tmp-labels.yaml")
+	defer os.Remove(path)
+	ioutil.WriteFile(path, []byte("rules:\n  - var: _tags\n    prefix: tag/\n"), 0644)
+	if rules, err := LoadLabelRules(path); err != nil || len(rules) != 1 || rules[0].Var != "TAGS" {
+		t.Errorf("Unexpected rules %+v: %v", rules, err)
+	}
+	ioutil.WriteFile(path, []byte("rules:\n  - variable: TAGS\n"), 0644)
+	if _, err := LoadLabelRules(path); err == nil {
+		t.Errorf("Want an error for an unknown field")
+	}
+}
+
+func TestComputeAvailability(t *testing.T) {
+	start := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time { return start.Add(time.Duration(hours) * time.Hour) }
+	event := func(hours int, eventType, to string) Event {
+		return Event{Type: eventType, Time: at(hours), Instance: "nagios1", Hostname: "host1", Service: "ssh", ToState: to}
+	}
+	events := []Event{
+		event(0, EventOpened, "WARNING"),
+		event(2, EventEscalated, "CRITICAL"),
+		event(4, EventResolved, "OK"),
+		event(6, EventOpened, "CRITICAL"),
+		event(7, EventAcknowledged, "CRITICAL"),
+		event(8, EventResolved, "OK"),
+		event(9, EventOpened, "WARNING"),
+	}
+	report := computeAvailability(events, at(-5), at(10))
+	if !report.From.Equal(at(0)) {
+		t.Errorf("Report should start with the recorded history, starts at %v", report.From)
+	}
+	if len(report.Entries) != 1 {
+		t.Errorf("Incorrect number of entries: %d", len(report.Entries))
+		t.FailNow()
+	}
+	entry := report.Entries[0]
+	if entry.Incidents != 3 {
+		t.Errorf("want 3 incidents, have %d", entry.Incidents)
+	}
+	if want := (3 * time.Hour).Seconds(); entry.MTTR != want {
+		t.Errorf("want mttr %v, have %v", want, entry.MTTR)
+	}
+	if want := (4 * time.Hour).Seconds(); entry.LongestOutage != want {
+		t.Errorf("want longest outage %v, have %v", want, entry.LongestOutage)
+	}
+	if want := 30.0; entry.TimeInState["OK"] != want {
+		t.Errorf("want %v%% OK, have %v%%", want, entry.TimeInState["OK"])
+	}
+	if want := 40.0; entry.TimeInState["CRITICAL"] != want {
+		t.Errorf("want %v%% CRITICAL, have %v%%", want, entry.TimeInState["CRITICAL"])
+	}
+
+	// Issues open at the start of the range count as one incident
+	report = computeAvailability(events, at(3), at(5))
+	if report.Entries[0].Incidents != 1 || report.Entries[0].TimeInState["OK"] != 50 {
+		t.Errorf("Unexpected report for partial range: %+v", report.Entries[0])
+	}
+}
+
+func TestPageIssues(t *testing.T) {
+	base := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	issue := func(host, service, state string, hours int) Issue {
+		return Issue{
+			Hostname: host,
+			NagiosStatusResponse: NagiosStatusResponse{
+				State:            state,
+				Service:          service,
+				LastStateChanged: base.Add(time.Duration(hours) * time.Hour),
+			},
+		}
+	}
+	all := []Issue{
+		issue("host1", "ssh", "WARNING", 1),
+		issue("host1", "disk", "CRITICAL", 2),
+		issue("host2", "ssh", "CRITICAL", 3),
+		issue("host2", "load", "UNKNOWN", 4),
+		issue("host3", "", "DOWN", 5),
+	}
+	for _, sortBy := range []string{SortSeverity, SortLastStateChange, SortHost, SortDuration} {
+		seen := map[string]bool{}
+		query := IssueQuery{Sort: sortBy, Desc: true, Limit: 2}
+		for {
+			issues := append([]Issue{}, all...)
+			page, err := pageIssues(issues, query)
+			if err != nil {
+				t.Errorf("%s: paging failed with: %v", sortBy, err)
+				t.FailNow()
+			}
+			if page.Total != len(all) {
+				t.Errorf("%s: want total %d, have %d", sortBy, len(all), page.Total)
+			}
+			for _, i := range page.Issues {
+				key := i.Hostname + "/" + i.Service
+				if seen[key] {
+					t.Errorf("%s: %s returned twice", sortBy, key)
+				}
+				seen[key] = true
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		if len(seen) != len(all) {
+			t.Errorf("%s: want %d issues, have %d", sortBy, len(all), len(seen))
+		}
+	}
+
+	// Resolving an issue of the first page doesn't shift the following pages
+	page, _ := pageIssues(append([]Issue{}, all...), IssueQuery{Sort: SortSeverity, Desc: true, Limit: 2})
+	if page.Issues[0].State != "DOWN" {
+		t.Errorf("Expected the most severe issue first, have %s", page.Issues[0].State)
+	}
+	page, _ = pageIssues(append([]Issue{}, all[:4]...), IssueQuery{Sort: SortSeverity, Desc: true, Limit: 2, Cursor: page.NextCursor})
+	if page.Issues[0].Hostname != "host2" || page.Issues[0].Service != "ssh" {
+		t.Errorf("Unexpected first issue of second page: %s/%s", page.Issues[0].Hostname, page.Issues[0].Service)
+	}
+	if _, err := pageIssues(all, IssueQuery{Sort: SortHost, Cursor: page.NextCursor}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor for a cursor of another sort order, got %v", err)
+	}
+}
+
+// countingSvc counts the GetParsedNagios calls reaching it
+type countingSvc struct {
+	NagiosParserSvc
+	calls int
+	err   error
+}
+
+func (s *countingSvc) GetParsedNagios(ctx context.Context, filter Filter) (map[string][]parser.NagiosStatus, error) {
+	s.calls++
+	return map[string][]parser.NagiosStatus{}, s.err
+}
+
+func TestCachingMiddleware(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingSvc{}
+	cached := CachingMiddleware(cache.New(time.Minute, time.Minute))(inner)
+
+	cached.GetParsedNagios(ctx, Filter{States: []string{"CRITICAL", "WARNING"}})
+	cached.GetParsedNagios(ctx, Filter{States: []string{"WARNING", "CRITICAL"}})
+	if inner.calls != 1 {
+		t.Errorf("Expected filters differing in order to share a cache entry, have %d calls", inner.calls)
+	}
+	inner.calls = 0
+	cached.GetParsedNagios(ctx, Filter{MinDuration: time.Hour})
+	cached.GetParsedNagios(ctx, Filter{MinDuration: time.Hour})
+	if inner.calls != 2 {
+		t.Errorf("Expected min_duration filters to skip the cache, have %d calls", inner.calls)
+	}
+	inner.calls, inner.err = 0, errors.New("no data")
+	cached.GetParsedNagios(ctx, Filter{Host: "web*"})
+	inner.err = nil
+	if _, err := cached.GetParsedNagios(ctx, Filter{Host: "web*"}); err != nil || inner.calls != 2 {
+		t.Errorf("Expected errors not to be cached, have %d calls (%v)", inner.calls, err)
+	}
+	for i := 0; i < 2*maxCachedFilters; i++ {
+		cached.GetParsedNagios(ctx, Filter{Host: strconv.Itoa(i)})
+	}
+	inner.calls = 0
+	cached.GetParsedNagios(ctx, Filter{Host: strconv.Itoa(2*maxCachedFilters - 1)})
+	if inner.calls != 1 {
+		t.Errorf("Expected the cache to stop at %d filters", maxCachedFilters)
+	}
+}
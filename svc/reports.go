@@ -0,0 +1,175 @@
+package svc
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// reportStates are the states reported as time-in-state, in column order
+var reportStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN", "DOWN", "UNREACHABLE"}
+
+// Availability summarises how a single host/service behaved over a report range
+type Availability struct {
+	Instance string `json:"instance,omitempty"`
+	Hostname string `json:"hostname"`
+	Service  string `json:"service,omitempty"`
+	// TimeInState is the percentage of the range spent in each state
+	TimeInState map[string]float64 `json:"time_in_state"`
+	Incidents   int                `json:"incidents"`
+	// MTTR is the mean time to recover in seconds of the incidents resolved within the range
+	MTTR float64 `json:"mttr_seconds"`
+	// LongestOutage is the longest time in seconds spent in a non-OK state within the range
+	LongestOutage float64 `json:"longest_outage_seconds"`
+}
+
+// AvailabilityReport is the availability of every host/service that had issues up to the end of the range
+// From is moved forward to the start of the recorded history when the range begins before it
+type AvailabilityReport struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Entries []Availability `json:"entries"`
+}
+
+type availabilityTracker struct {
+	entry         Availability
+	state         string
+	stateSince    time.Time
+	incidentStart time.Time
+	started       bool
+	recovered     []time.Duration
+	longest       time.Duration
+	durations     map[string]time.Duration
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// start counts an issue that is already open when the range begins as an incident within it
+func (tr *availabilityTracker) start() {
+	if tr.started {
+		return
+	}
+	tr.started = true
+	if tr.state != "OK" {
+		tr.entry.Incidents++
+	}
+}
+
+// observe applies a transition, only time within the range is accounted for
+func (tr *availabilityTracker) observe(e Event, from time.Time) {
+	newState := e.ToState
+	if e.Type == EventAcknowledged || newState == "" {
+		return
+	}
+	if e.Time.After(from) {
+		tr.start()
+		tr.durations[tr.state] += e.Time.Sub(maxTime(tr.stateSince, from))
+	}
+	if tr.state == "OK" && newState != "OK" {
+		tr.incidentStart = e.Time
+		if e.Time.After(from) {
+			tr.entry.Incidents++
+		}
+	}
+	if tr.state != "OK" && newState == "OK" && e.Time.After(from) {
+		tr.recovered = append(tr.recovered, e.Time.Sub(tr.incidentStart))
+		if outage := e.Time.Sub(maxTime(tr.incidentStart, from)); outage > tr.longest {
+			tr.longest = outage
+		}
+	}
+	tr.state = newState
+	tr.stateSince = e.Time
+}
+
+// finish closes the range and computes the summary values
+func (tr *availabilityTracker) finish(from, to time.Time) Availability {
+	tr.start()
+	tr.durations[tr.state] += to.Sub(maxTime(tr.stateSince, from))
+	if tr.state != "OK" {
+		if outage := to.Sub(maxTime(tr.incidentStart, from)); outage > tr.longest {
+			tr.longest = outage
+		}
+	}
+	tr.entry.LongestOutage = tr.longest.Seconds()
+	total := to.Sub(from)
+	for state, d := range tr.durations {
+		if d > 0 && total > 0 {
+			tr.entry.TimeInState[state] = float64(d) / float64(total) * 100
+		}
+	}
+	if len(tr.recovered) > 0 {
+		var sum time.Duration
+		for _, d := range tr.recovered {
+			sum += d
+		}
+		tr.entry.MTTR = (sum / time.Duration(len(tr.recovered))).Seconds()
+	}
+	return tr.entry
+}
+
+// computeAvailability replays an ordered event log and reports availability over [from, to]
+func computeAvailability(events []Event, from, to time.Time) AvailabilityReport {
+	report := AvailabilityReport{From: from, To: to, Entries: []Availability{}}
+	if len(events) == 0 {
+		return report
+	}
+	if events[0].Time.After(from) {
+		// Nothing is known before the first refresh
+		from = events[0].Time
+		report.From = from
+	}
+	if !to.After(from) {
+		return report
+	}
+	trackers := make(map[string]*availabilityTracker)
+	for _, e := range events {
+		if e.Time.After(to) {
+			break
+		}
+		key := e.Instance + "\x00" + e.Hostname + "\x00" + e.Service
+		tr, found := trackers[key]
+		if !found {
+			tr = &availabilityTracker{
+				entry: Availability{
+					Instance:    e.Instance,
+					Hostname:    e.Hostname,
+					Service:     e.Service,
+					TimeInState: make(map[string]float64),
+				},
+				state:      "OK",
+				stateSince: from,
+				durations:  make(map[string]time.Duration),
+			}
+			trackers[key] = tr
+		}
+		tr.observe(e, from)
+	}
+	for _, tr := range trackers {
+		report.Entries = append(report.Entries, tr.finish(from, to))
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		a, b := report.Entries[i], report.Entries[j]
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		return a.Service < b.Service
+	})
+	return report
+}
+
+// GetAvailabilityReport computes availability per host/service/instance from the event log
+func (svc *nagiosParserSvc) GetAvailabilityReport(ctx context.Context, from, to time.Time) (AvailabilityReport, error) {
+	events, err := svc.GetEvents(ctx, time.Time{})
+	if err != nil {
+		return AvailabilityReport{From: from, To: to, Entries: []Availability{}}, err
+	}
+	return computeAvailability(events, from, to), nil
+}
@@ -0,0 +1,186 @@
+package svc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+// maxSnapshots is the number of refreshes kept around for diffing
+const maxSnapshots = 500
+
+var (
+	// ErrSnapshotNotFound indicates that no snapshot was stored at or before the requested time
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+type snapshot struct {
+	ID   uint64                           `json:"id"`
+	Time time.Time                        `json:"time"`
+	Data map[string][]parser.NagiosStatus `json:"data"`
+}
+
+// SnapshotDiff is the comparison of the two snapshots closest to the requested times
+type SnapshotDiff struct {
+	From    time.Time             `json:"from"`
+	To      time.Time             `json:"to"`
+	Changes []parser.StatusChange `json:"changes"`
+}
+
+// timeKey is the key of a snapshot or an event in a time index, its time followed by its ID so that
+// entries of the same instant stay apart. Times before 1970 sort first
+func timeKey(t time.Time, id uint64) []byte {
+	var nanos int64
+	if t.After(time.Unix(0, 0)) {
+		nanos = t.UnixNano()
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+	binary.BigEndian.PutUint64(key[8:], id)
+	return key
+}
+
+// snapshotTimes returns the time index of the snapshots, building it for snapshots stored before it existed
+func snapshotTimes(tx *bolt.Tx, b *bolt.Bucket) (*bolt.Bucket, error) {
+	if index := tx.Bucket([]byte("NagiosSnapshotTimes")); index != nil {
+		return index, nil
+	}
+	index, err := tx.CreateBucket([]byte("NagiosSnapshotTimes"))
+	if err != nil {
+		return nil, err
+	}
+	err = b.ForEach(func(k, v []byte) error {
+		var snap snapshot
+		if err := json.Unmarshal(v, &snap); err != nil {
+			return err
+		}
+		return index.Put(timeKey(snap.Time, snap.ID), k)
+	})
+	return index, err
+}
+
+// storeSnapshot keeps a copy of the refreshed data and drops the oldest snapshots beyond maxSnapshots
+func storeSnapshot(tx *bolt.Tx, data map[string][]parser.NagiosStatus, now time.Time) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("NagiosSnapshots"))
+	if err != nil {
+		return err
+	}
+	index, err := snapshotTimes(tx, b)
+	if err != nil {
+		return err
+	}
+	snap := snapshot{Time: now, Data: data}
+	snap.ID, err = b.NextSequence()
+	if err != nil {
+		return err
+	}
+	snapB, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	err = b.Put(itob(snap.ID), snapB)
+	if err != nil {
+		return err
+	}
+	err = index.Put(timeKey(snap.Time, snap.ID), itob(snap.ID))
+	if err != nil {
+		return err
+	}
+	if snap.ID <= maxSnapshots {
+		return nil
+	}
+	// Snapshot IDs are sequential, so everything up to this one is beyond the retention
+	oldest := snap.ID - maxSnapshots
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= oldest; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	// The index is in time order, which needn't be the order of the IDs if the clock went back
+	expired := [][]byte{}
+	err = index.ForEach(func(k, v []byte) error {
+		if binary.BigEndian.Uint64(v) <= oldest {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := index.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findSnapshot returns the latest snapshot taken at or before t, a zero t selects the latest snapshot.
+// It goes back another previous snapshots from there
+func findSnapshot(tx *bolt.Tx, t time.Time, previous int) (snapshot, error) {
+	var snap snapshot
+	b := tx.Bucket([]byte("NagiosSnapshots"))
+	index := tx.Bucket([]byte("NagiosSnapshotTimes"))
+	if b == nil || index == nil {
+		return snap, ErrSnapshotNotFound
+	}
+	c := index.Cursor()
+	var id []byte
+	if t.IsZero() {
+		_, id = c.Last()
+	} else if k, _ := c.Seek(timeKey(t, math.MaxUint64)); k == nil {
+		_, id = c.Last()
+	} else {
+		_, id = c.Prev()
+	}
+	for ; previous > 0 && id != nil; previous-- {
+		_, id = c.Prev()
+	}
+	if id == nil {
+		return snap, ErrSnapshotNotFound
+	}
+	v := b.Get(id)
+	if v == nil {
+		return snap, ErrSnapshotNotFound
+	}
+	err := json.Unmarshal(v, &snap)
+	return snap, err
+}
+
+// DiffSnapshots compares the stored snapshots closest to from and to. A zero to compares against the latest refresh,
+// a zero from compares against the snapshot before the one of to
+func (svc *nagiosParserSvc) DiffSnapshots(ctx context.Context, from, to time.Time) (SnapshotDiff, error) {
+	diff := SnapshotDiff{Changes: []parser.StatusChange{}}
+	localDB, err := openBoltDB(svc.localDB)
+	if err != nil {
+		return diff, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		toSnap, err := findSnapshot(tx, to, 0)
+		if err != nil {
+			return err
+		}
+		var fromSnap snapshot
+		if from.IsZero() {
+			fromSnap, err = findSnapshot(tx, to, 1)
+		} else {
+			fromSnap, err = findSnapshot(tx, from, 0)
+		}
+		if err != nil {
+			return err
+		}
+		diff.From = fromSnap.Time
+		diff.To = toSnap.Time
+		diff.Changes = parser.Diff(fromSnap.Data, toSnap.Data)
+		return nil
+	})
+	localDB.Close()
+	return diff, err
+}
@@ -0,0 +1,139 @@
+package svc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Stream defaults
+const (
+	// DefaultReplaySize is the number of recent events kept for clients resuming a stream
+	DefaultReplaySize = 1000
+	// subscriptionBuffer is the number of events a subscriber may lag behind before it is dropped
+	subscriptionBuffer = 256
+)
+
+// EventBroker fans the events of every refresh out to the stream subscribers
+// and keeps the most recent ones so that reconnecting clients can catch up
+type EventBroker struct {
+	mu          sync.Mutex
+	replaySize  int
+	replay      []Event
+	subscribers map[*Subscription]struct{}
+	watchers    map[chan struct{}]struct{}
+}
+
+// Subscription receives the events matching its filter until it is unsubscribed or dropped
+type Subscription struct {
+	filter Filter
+	events chan Event
+	// Replay holds the buffered events the subscriber missed since the event it resumed from
+	Replay []Event
+}
+
+// NewEventBroker returns a broker keeping the latest replaySize events for resuming clients
+func NewEventBroker(replaySize int) *EventBroker {
+	if replaySize <= 0 {
+		replaySize = DefaultReplaySize
+	}
+	return &EventBroker{
+		replaySize:  replaySize,
+		subscribers: make(map[*Subscription]struct{}),
+		watchers:    make(map[chan struct{}]struct{}),
+	}
+}
+
+// AfterRefresh is the RefreshHook of the broker, it publishes the events of the refresh
+func (b *EventBroker) AfterRefresh(ctx context.Context, service NagiosParserSvc, report RefreshReport) {
+	b.Publish(report.Events)
+}
+
+// Publish is called after every refresh. It signals the watchers, appends the events to the replay buffer
+// and sends them to the matching subscribers. Subscribers that can't keep up are dropped,
+// they are expected to resume with the last event ID they got
+func (b *EventBroker) Publish(events []Event) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for watcher := range b.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+			// A signal is already pending
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	b.replay = append(b.replay, events...)
+	if excess := len(b.replay) - b.replaySize; excess > 0 {
+		b.replay = append([]Event(nil), b.replay[excess:]...)
+	}
+	for sub := range b.subscribers {
+		for _, e := range events {
+			if !sub.filter.MatchEvent(e, now) {
+				continue
+			}
+			select {
+			case sub.events <- e:
+				continue
+			default:
+			}
+			delete(b.subscribers, sub)
+			close(sub.events)
+			break
+		}
+	}
+}
+
+// Subscribe registers a subscriber for the events matching filter. When resume is set,
+// the buffered events after lastEventID are returned in the subscription's Replay
+func (b *EventBroker) Subscribe(filter Filter, lastEventID uint64, resume bool) *Subscription {
+	sub := &Subscription{
+		filter: filter,
+		events: make(chan Event, subscriptionBuffer),
+		Replay: []Event{},
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if resume {
+		for _, e := range b.replay {
+			if e.ID > lastEventID && filter.MatchEvent(e, now) {
+				sub.Replay = append(sub.Replay, e)
+			}
+		}
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stops sending events to sub
+func (b *EventBroker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, found := b.subscribers[sub]; found {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Events returns the channel of live events, it is closed when the subscriber is dropped
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Watch returns a channel signalled after every refresh, and a function to stop watching.
+// Signals are coalesced, a watcher busy while several refreshes happen sees a single signal
+func (b *EventBroker) Watch() (<-chan struct{}, func()) {
+	watcher := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.watchers[watcher] = struct{}{}
+	b.mu.Unlock()
+	return watcher, func() {
+		b.mu.Lock()
+		delete(b.watchers, watcher)
+		b.mu.Unlock()
+	}
+}
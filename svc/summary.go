@@ -0,0 +1,179 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/tchaudhry91/nagiosagg/parser"
+)
+
+var (
+	// ErrSummaryNotFound indicates that no refresh has stored a summary yet
+	ErrSummaryNotFound = errors.New("summary not available before the first refresh")
+)
+
+// StateCounts are the number of hosts and services per state
+type StateCounts struct {
+	Hosts    map[string]int `json:"hosts"`
+	Services map[string]int `json:"services"`
+}
+
+// HostProblems is the number of problems of a single host
+type HostProblems struct {
+	Hostname string `json:"hostname"`
+	Problems int    `json:"problems"`
+}
+
+// OldestIssue is the issue that has been in its state for the longest time
+type OldestIssue struct {
+	Instance string    `json:"instance,omitempty"`
+	Hostname string    `json:"hostname"`
+	Service  string    `json:"service,omitempty"`
+	Since    time.Time `json:"since"`
+	// Age is the number of seconds since the state changed, as of the request
+	Age float64 `json:"age_seconds"`
+}
+
+// Summary holds the counts of the latest refresh. Totals include OK hosts and services,
+// the other breakdowns only count problems
+type Summary struct {
+	RefreshedAt  time.Time              `json:"refreshed_at"`
+	Totals       StateCounts            `json:"totals"`
+	ByInstance   map[string]StateCounts `json:"by_instance"`
+	ByStateType  map[string]StateCounts `json:"by_state_type"`
+	Acknowledged StateCounts            `json:"acknowledged"`
+	InDowntime   StateCounts            `json:"in_downtime"`
+	// NoisiestHosts are the hosts with the most problems, most first
+	NoisiestHosts []HostProblems `json:"noisiest_hosts"`
+	// OldestUnacknowledgedCritical is absent when there is no unacknowledged CRITICAL service
+	OldestUnacknowledgedCritical *OldestIssue `json:"oldest_unacknowledged_critical,omitempty"`
+}
+
+func newStateCounts() StateCounts {
+	return StateCounts{Hosts: map[string]int{}, Services: map[string]int{}}
+}
+
+func (c StateCounts) add(status parser.NagiosStatus) {
+	if status.StatusType == "hoststatus" {
+		c.Hosts[status.State]++
+		return
+	}
+	c.Services[status.State]++
+}
+
+func newSummary(now time.Time) *Summary {
+	return &Summary{
+		RefreshedAt:   now,
+		Totals:        newStateCounts(),
+		ByInstance:    map[string]StateCounts{},
+		ByStateType:   map[string]StateCounts{"hard": newStateCounts(), "soft": newStateCounts()},
+		Acknowledged:  newStateCounts(),
+		InDowntime:    newStateCounts(),
+		NoisiestHosts: []HostProblems{},
+	}
+}
+
+// add counts the host and service statuses among the blocks of a status file
+func (s *Summary) add(blocks []parser.NagiosStatus) {
+	for _, status := range blocks {
+		if status.State == "" {
+			// Not a host or service status
+			continue
+		}
+		s.Totals.add(status)
+		if status.State == "OK" {
+			continue
+		}
+		if _, found := s.ByInstance[status.Instance]; !found {
+			s.ByInstance[status.Instance] = newStateCounts()
+		}
+		s.ByInstance[status.Instance].add(status)
+		if status.Values["state_type"] == "1" {
+			s.ByStateType["hard"].add(status)
+		} else {
+			s.ByStateType["soft"].add(status)
+		}
+		if status.Acknowledged() {
+			s.Acknowledged.add(status)
+		}
+		if depth, _ := strconv.Atoi(status.Values["scheduled_downtime_depth"]); depth > 0 {
+			s.InDowntime.add(status)
+		}
+		if status.StatusType == "servicestatus" && status.State == "CRITICAL" && !status.Acknowledged() {
+			since := unixValue(status.Values, "last_state_change")
+			if !since.After(time.Unix(0, 0)) {
+				// Without a valid time of the state change, the age of the issue is unknown
+				continue
+			}
+			if s.OldestUnacknowledgedCritical == nil || since.Before(s.OldestUnacknowledgedCritical.Since) {
+				s.OldestUnacknowledgedCritical = &OldestIssue{
+					Instance: status.Instance,
+					Hostname: status.Hostname,
+					Service:  status.Service,
+					Since:    since,
+				}
+			}
+		}
+	}
+}
+
+// rankHosts orders every host with problems by its number of problems
+func (s *Summary) rankHosts(problems map[string][]parser.NagiosStatus) {
+	for host, statuses := range problems {
+		s.NoisiestHosts = append(s.NoisiestHosts, HostProblems{Hostname: host, Problems: len(statuses)})
+	}
+	sort.Slice(s.NoisiestHosts, func(i, j int) bool {
+		if s.NoisiestHosts[i].Problems != s.NoisiestHosts[j].Problems {
+			return s.NoisiestHosts[i].Problems > s.NoisiestHosts[j].Problems
+		}
+		return s.NoisiestHosts[i].Hostname < s.NoisiestHosts[j].Hostname
+	})
+}
+
+func storeSummary(tx *bolt.Tx, summary *Summary) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("NagiosSummary"))
+	if err != nil {
+		return err
+	}
+	summaryB, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("summary"), summaryB)
+}
+
+// GetSummary returns the summary stored by the latest refresh with the top noisiest hosts
+func (svc *nagiosParserSvc) GetSummary(ctx context.Context, top int) (Summary, error) {
+	var summary Summary
+	localDB, err := openBoltDB(svc.localDB)
+	if err != nil {
+		return summary, err
+	}
+	err = localDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("NagiosSummary"))
+		if b == nil {
+			return ErrSummaryNotFound
+		}
+		v := b.Get([]byte("summary"))
+		if v == nil {
+			return ErrSummaryNotFound
+		}
+		return json.Unmarshal(v, &summary)
+	})
+	localDB.Close()
+	if err != nil {
+		return summary, err
+	}
+	if top >= 0 && len(summary.NoisiestHosts) > top {
+		summary.NoisiestHosts = summary.NoisiestHosts[:top]
+	}
+	if oldest := summary.OldestUnacknowledgedCritical; oldest != nil {
+		oldest.Age = time.Since(oldest.Since).Seconds()
+	}
+	return summary, nil
+}
@@ -4,43 +4,152 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/ratelimit"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	cache "github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/time/rate"
 )
 
+// StreamHeartbeat is the interval of the comments keeping idle event streams open through proxies
+var StreamHeartbeat = 15 * time.Second
+
 var (
 	//ErrJSONUnMarshall indicates a bad request where json unmarshalling failed
 	ErrJSONUnMarshall = errors.New("failed to parse json")
+	//ErrInvalidQuery indicates a bad request where a query parameter could not be parsed
+	ErrInvalidQuery = errors.New("invalid query parameter")
 )
 
 // MakeHTTPHandler returns an http handler for the endpoints
-func MakeHTTPHandler(svc NagiosParserSvc, cacher *cache.Cache, limiter *rate.Limiter) http.Handler {
-	r := mux.NewRouter()
-	ee := MakeServerEndpoints(svc, cacher, limiter)
+// broker feeds the event stream, legacyRefresh keeps serving the synchronous GET /refresh next to the asynchronous POST /refresh
+func MakeHTTPHandler(svc NagiosParserSvc, cacher *cache.Cache, jobs *RefreshJobs, broker *EventBroker, legacyRefresh bool) http.Handler {
+	// Service names often contain slashes (Disk /var), keep them encoded until decoding the request
+	r := mux.NewRouter().UseEncodedPath()
+	ee := MakeServerEndpoints(svc, cacher, jobs, broker)
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorEncoder(encodeError),
 	}
+	// Listings are rendered in the format picked from ?format= or the Accept header
+	negotiated := make([]httptransport.ServerOption, len(options), len(options)+1)
+	copy(negotiated, options)
+	negotiated = append(negotiated, httptransport.ServerBefore(negotiateFormat))
 	getParsedNagiosHandler := httptransport.NewServer(
 		ee.getParsedNagios,
-		decodeGetParsedNagiosRequest,
-		encodeGetParsedNagiosResponse,
-		options...,
+		withFormat(decodeGetParsedNagiosRequest),
+		encodeResponse,
+		negotiated...,
 	)
 	r.Methods("GET").Path("/nagios").Handler(getParsedNagiosHandler)
 
-	refreshNagiosDataHandler := httptransport.NewServer(
-		ee.refreshNagiosData,
-		decodeRefreshNagiosDataRequest,
-		encodeRefreshNagiosDataResponse,
+	if legacyRefresh {
+		refreshNagiosDataHandler := httptransport.NewServer(
+			ee.refreshNagiosData,
+			decodeRefreshNagiosDataRequest,
+			encodeRefreshNagiosDataResponse,
+			options...,
+		)
+		r.Methods("GET").Path("/refresh").Handler(refreshNagiosDataHandler)
+	}
+
+	startRefreshHandler := httptransport.NewServer(
+		ee.startRefresh,
+		decodeStartRefreshRequest,
+		encodeStartRefreshResponse,
+		options...,
+	)
+	r.Methods("POST").Path("/refresh").Handler(startRefreshHandler)
+
+	getRefreshJobHandler := httptransport.NewServer(
+		ee.getRefreshJob,
+		decodeGetRefreshJobRequest,
+		encodeJSONResponse,
+		options...,
+	)
+	r.Methods("GET").Path("/refresh/{id}").Handler(getRefreshJobHandler)
+
+	getEventsHandler := httptransport.NewServer(
+		ee.getEvents,
+		withFormat(decodeGetEventsRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/events").Handler(getEventsHandler)
+
+	diffSnapshotsHandler := httptransport.NewServer(
+		ee.diffSnapshots,
+		withFormat(decodeDiffSnapshotsRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/diff").Handler(diffSnapshotsHandler)
+
+	availabilityHandler := httptransport.NewServer(
+		ee.availability,
+		withFormat(decodeGetAvailabilityReportRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/reports/availability").Handler(availabilityHandler)
+
+	listIssuesHandler := httptransport.NewServer(
+		ee.listIssues,
+		withFormat(decodeListIssuesRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/v2/issues").Handler(listIssuesHandler)
+
+	getHostsHandler := httptransport.NewServer(
+		ee.getHosts,
+		withFormat(decodeGetHostsRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/hosts").Handler(getHostsHandler)
+
+	getHostHandler := httptransport.NewServer(
+		ee.getHost,
+		withFormat(decodeGetHostRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/hosts/{host}").Handler(getHostHandler)
+
+	getServiceHandler := httptransport.NewServer(
+		ee.getService,
+		withFormat(decodeGetServiceRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/services/{service}").Handler(getServiceHandler)
+
+	getSummaryHandler := httptransport.NewServer(
+		ee.getSummary,
+		withFormat(decodeGetSummaryRequest),
+		encodeResponse,
+		negotiated...,
+	)
+	r.Methods("GET").Path("/summary").Handler(getSummaryHandler)
+
+	streamHandler := httptransport.NewServer(
+		ee.stream,
+		decodeStreamRequest,
+		encodeStreamResponse,
 		options...,
 	)
-	r.Methods("GET").Path("/refresh").Handler(refreshNagiosDataHandler)
+	r.Methods("GET").Path("/stream").Handler(streamHandler)
+
+	// WebSocket sessions outlive a single request and response, so they are served outside of go-kit
+	r.Methods("GET").Path("/ws").Handler(MakeWebSocketHandler(svc, broker))
 	r.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
 	return r
 }
@@ -53,15 +162,305 @@ func encodeRefreshNagiosDataResponse(_ context.Context, w http.ResponseWriter, r
 	return json.NewEncoder(w).Encode(resp)
 }
 
+func decodeStartRefreshRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return startRefreshRequest{}, nil
+}
+
+func encodeStartRefreshResponse(_ context.Context, w http.ResponseWriter, resp interface{}) error {
+	job := resp.(refreshJobResponse)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/refresh/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(job)
+}
+
+func decodeGetRefreshJobRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return getRefreshJobRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
 func decodeGetParsedNagiosRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	// We return a blank request holder because no data must be taken in yet
-	return getParsedNagiosRequest{}, nil
+	filter, err := decodeFilter(r)
+	if err != nil {
+		return getParsedNagiosRequest{}, err
+	}
+	flatten, err := boolValue(r.URL.Query(), "flatten")
+	return getParsedNagiosRequest{Filter: filter, Flatten: flatten != nil && *flatten}, err
+}
+
+// multiValue collects a query parameter given several times or as a comma separated list
+func multiValue(query url.Values, key string) []string {
+	var values []string
+	for _, value := range query[key] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+func boolValue(query url.Values, key string) (*bool, error) {
+	value := query.Get(key)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, ErrInvalidQuery
+	}
+	return &b, nil
+}
+
+// decodeFilter reads the issue filter shared by the listing endpoints from the query string
+func decodeFilter(r *http.Request) (Filter, error) {
+	query := r.URL.Query()
+	filter := Filter{
+		States:        multiValue(query, "state"),
+		Host:          query.Get("host"),
+		Service:       query.Get("service"),
+		Instances:     multiValue(query, "instance"),
+		HostGroups:    multiValue(query, "hostgroup"),
+		ServiceGroups: multiValue(query, "servicegroup"),
+		Contacts:      multiValue(query, "contact"),
+		Labels:        multiValue(query, "label"),
+		StateType:     query.Get("state_type"),
+	}
+	var err error
+	if filter.Acknowledged, err = boolValue(query, "acknowledged"); err != nil {
+		return filter, err
+	}
+	if filter.InDowntime, err = boolValue(query, "in_downtime"); err != nil {
+		return filter, err
+	}
+	if filter.Flapping, err = boolValue(query, "flapping"); err != nil {
+		return filter, err
+	}
+	if filter.Suppressed, err = boolValue(query, "suppressed"); err != nil {
+		return filter, err
+	}
+	if minDuration := query.Get("min_duration"); minDuration != "" {
+		if filter.MinDuration, err = parseDuration(minDuration); err != nil {
+			return filter, err
+		}
+	}
+	if err := filter.Compile(); err != nil {
+		return filter, err
+	}
+	return filter, nil
 }
 
-func encodeGetParsedNagiosResponse(_ context.Context, w http.ResponseWriter, resp interface{}) error {
+func decodeGetEventsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := getEventsRequest{}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return req, nil
+	}
+	var err error
+	req.Since, err = parseTime(since)
+	if err != nil {
+		return req, ErrInvalidQuery
+	}
+	return req, nil
+}
+
+func decodeDiffSnapshotsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := diffSnapshotsRequest{}
+	query := r.URL.Query()
+	var err error
+	if from := query.Get("from"); from != "" {
+		if req.From, err = parseTime(from); err != nil {
+			return req, ErrInvalidQuery
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if req.To, err = parseTime(to); err != nil {
+			return req, ErrInvalidQuery
+		}
+	}
+	return req, nil
+}
+
+func decodeGetAvailabilityReportRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := getAvailabilityReportRequest{To: time.Now().UTC()}
+	query := r.URL.Query()
+	var err error
+	if to := query.Get("to"); to != "" {
+		if req.To, err = parseTime(to); err != nil {
+			return req, ErrInvalidQuery
+		}
+	}
+	// Reports default to the last 30 days
+	req.From = req.To.AddDate(0, 0, -30)
+	if from := query.Get("from"); from != "" {
+		if req.From, err = parseTime(from); err != nil {
+			return req, ErrInvalidQuery
+		}
+	}
+	if !req.To.After(req.From) {
+		return req, ErrInvalidQuery
+	}
+	return req, nil
+}
+
+func decodeListIssuesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := listIssuesRequest{}
+	filter, err := decodeFilter(r)
+	if err != nil {
+		return req, err
+	}
+	query := r.URL.Query()
+	req.Query = IssueQuery{
+		Filter: filter,
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+	}
+	switch query.Get("order") {
+	case "":
+		// Hosts read best alphabetically, everything else worst or newest first
+		req.Query.Desc = req.Query.Sort != SortHost
+	case "asc":
+	case "desc":
+		req.Query.Desc = true
+	default:
+		return req, ErrInvalidQuery
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if req.Query.Limit, err = strconv.Atoi(limit); err != nil || req.Query.Limit < 1 {
+			return req, ErrInvalidQuery
+		}
+	}
+	return req, nil
+}
+
+func decodeGetHostsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return getHostsRequest{}, nil
+}
+
+func decodeGetHostRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	host, err := url.PathUnescape(mux.Vars(r)["host"])
+	if err != nil {
+		return getHostRequest{}, ErrInvalidQuery
+	}
+	return getHostRequest{Hostname: host}, nil
+}
+
+func decodeGetServiceRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	service, err := url.PathUnescape(mux.Vars(r)["service"])
+	if err != nil {
+		return getServiceRequest{}, ErrInvalidQuery
+	}
+	return getServiceRequest{Service: service}, nil
+}
+
+func decodeGetSummaryRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := getSummaryRequest{Top: 10}
+	if top := r.URL.Query().Get("top"); top != "" {
+		var err error
+		if req.Top, err = strconv.Atoi(top); err != nil || req.Top < 0 {
+			return req, ErrInvalidQuery
+		}
+	}
+	return req, nil
+}
+
+func decodeStreamRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := streamRequest{}
+	filter, err := decodeFilter(r)
+	if err != nil {
+		return req, err
+	}
+	req.Filter = filter
+	// Browsers send the header when reconnecting, other clients may pass the query parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		if req.LastEventID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			return req, ErrInvalidQuery
+		}
+		req.Resume = true
+	}
+	return req, nil
+}
+
+// encodeStreamResponse writes the events of the subscription as server-sent events until the client disconnects
+func encodeStreamResponse(ctx context.Context, w http.ResponseWriter, resp interface{}) error {
+	stream := resp.(streamResponse)
+	defer stream.broker.Unsubscribe(stream.sub)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming unsupported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": stream opened\n\n")
+	for _, e := range stream.sub.Replay {
+		if err := writeServerSentEvent(w, e); err != nil {
+			return err
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, open := <-stream.sub.Events():
+			if !open {
+				// Dropped for lagging behind, the client resumes from its last event ID
+				return nil
+			}
+			if err := writeServerSentEvent(w, e); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w io.Writer, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+func encodeJSONResponse(_ context.Context, w http.ResponseWriter, resp interface{}) error {
 	return json.NewEncoder(w).Encode(resp)
 }
 
+// parseDuration accepts either a go duration (90s, 2h) or plain seconds
+func parseDuration(value string) (time.Duration, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidQuery
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// parseTime accepts either RFC3339 timestamps or unix seconds
+func parseTime(value string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
@@ -75,8 +474,12 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 
 func codeFrom(err error) int {
 	switch err {
-	case ErrJSONUnMarshall:
+	case ErrJSONUnMarshall, ErrInvalidQuery, ErrInvalidFilter, ErrInvalidCursor:
 		return http.StatusBadRequest
+	case ErrSnapshotNotFound, ErrHostNotFound, ErrSummaryNotFound, ErrJobNotFound:
+		return http.StatusNotFound
+	case ErrNotAcceptable:
+		return http.StatusNotAcceptable
 	case ratelimit.ErrLimited:
 		return http.StatusTooManyRequests
 	default:
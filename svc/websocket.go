@@ -0,0 +1,329 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket message types
+const (
+	WSTypeSubscribe   = "subscribe"
+	WSTypeUnsubscribe = "unsubscribe"
+	WSTypeSnapshot    = "snapshot"
+	WSTypePatch       = "patch"
+	WSTypePing        = "ping"
+	WSTypePong        = "pong"
+	WSTypeError       = "error"
+)
+
+const (
+	// wsSendQueue is the number of messages queued for a client before patches are held back
+	wsSendQueue = 64
+	// wsWriteWait is how long a client may take to accept a message before it is disconnected
+	wsWriteWait = 10 * time.Second
+	// wsMaxMessage limits the size of client messages
+	wsMaxMessage = 64 << 10
+)
+
+// IssueKey identifies an issue across refreshes
+type IssueKey struct {
+	Hostname string `json:"hostname"`
+	Instance string `json:"instance,omitempty"`
+	Service  string `json:"service,omitempty"`
+}
+
+// WSFilter is the issue filter of a subscription, named like the query parameters of /nagios
+type WSFilter struct {
+	States        []string `json:"state,omitempty"`
+	Host          string   `json:"host,omitempty"`
+	Service       string   `json:"service,omitempty"`
+	Instances     []string `json:"instance,omitempty"`
+	HostGroups    []string `json:"hostgroup,omitempty"`
+	ServiceGroups []string `json:"servicegroup,omitempty"`
+	Contacts      []string `json:"contact,omitempty"`
+	Labels        []string `json:"label,omitempty"`
+	Acknowledged  *bool    `json:"acknowledged,omitempty"`
+	InDowntime    *bool    `json:"in_downtime,omitempty"`
+	Flapping      *bool    `json:"flapping,omitempty"`
+	Suppressed    *bool    `json:"suppressed,omitempty"`
+	StateType     string   `json:"state_type,omitempty"`
+	MinDuration   string   `json:"min_duration,omitempty"`
+}
+
+// WSRequest is a message sent by a client. Subscriptions are named by the client, subscribing
+// again with the same ID replaces the filter of that subscription
+type WSRequest struct {
+	Type   string    `json:"type"`
+	ID     string    `json:"id,omitempty"`
+	Filter *WSFilter `json:"filter,omitempty"`
+}
+
+// WSSnapshot is the full view of a subscription, sent when subscribing
+type WSSnapshot struct {
+	Type   string  `json:"type"`
+	ID     string  `json:"id"`
+	Issues []Issue `json:"issues"`
+}
+
+// WSPatch holds the changes to the view of a subscription since the previous snapshot or patch
+type WSPatch struct {
+	Type    string     `json:"type"`
+	ID      string     `json:"id"`
+	Added   []Issue    `json:"added"`
+	Updated []Issue    `json:"updated"`
+	Removed []IssueKey `json:"removed"`
+}
+
+// WSReply answers pings and reports errors
+type WSReply struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (f WSFilter) compile() (Filter, error) {
+	filter := Filter{
+		States:        f.States,
+		Host:          f.Host,
+		Service:       f.Service,
+		Instances:     f.Instances,
+		HostGroups:    f.HostGroups,
+		ServiceGroups: f.ServiceGroups,
+		Contacts:      f.Contacts,
+		Labels:        f.Labels,
+		Acknowledged:  f.Acknowledged,
+		InDowntime:    f.InDowntime,
+		Flapping:      f.Flapping,
+		Suppressed:    f.Suppressed,
+		StateType:     f.StateType,
+	}
+	if f.MinDuration != "" {
+		var err error
+		if filter.MinDuration, err = parseDuration(f.MinDuration); err != nil {
+			return filter, err
+		}
+	}
+	return filter, filter.Compile()
+}
+
+func keyOf(issue Issue) IssueKey {
+	return IssueKey{Hostname: issue.Hostname, Instance: issue.Instance, Service: issue.Service}
+}
+
+// changed reports whether an issue changed in a way worth patching, check times change on every refresh
+func changed(before, after Issue) bool {
+	return before.State != after.State ||
+		before.Output != after.Output ||
+		before.Attempts != after.Attempts ||
+		!before.LastStateChanged.Equal(after.LastStateChanged) ||
+		before.Flapping != after.Flapping ||
+		before.FlapPercent != after.FlapPercent ||
+		before.NagiosFlapping != after.NagiosFlapping ||
+		before.PercentStateChange != after.PercentStateChange ||
+		before.SuppressedBy != after.SuppressedBy
+}
+
+// wsView is the view of a subscription as last sent to the client
+type wsView struct {
+	filter Filter
+	issues map[IssueKey]Issue
+}
+
+type wsSession struct {
+	svc    NagiosParserSvc
+	conn   *websocket.Conn
+	views  map[string]*wsView
+	send   chan interface{}
+	done   chan struct{}
+	failed chan struct{}
+}
+
+// MakeWebSocketHandler returns the handler of the /ws live view API, updated after every refresh published to broker
+func MakeWebSocketHandler(svc NagiosParserSvc, broker *EventBroker) http.Handler {
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has replied already
+			return
+		}
+		session := &wsSession{
+			svc:    svc,
+			conn:   conn,
+			views:  make(map[string]*wsView),
+			send:   make(chan interface{}, wsSendQueue),
+			done:   make(chan struct{}),
+			failed: make(chan struct{}),
+		}
+		refreshes, stop := broker.Watch()
+		defer stop()
+		session.run(refreshes)
+	})
+}
+
+// run handles the requests of the client and pushes patches after refreshes until the connection is closed
+func (s *wsSession) run(refreshes <-chan struct{}) {
+	requests := make(chan WSRequest)
+	go s.writeLoop()
+	go s.readLoop(requests)
+	defer close(s.send)
+	defer close(s.done)
+	for {
+		select {
+		case req, open := <-requests:
+			if !open {
+				return
+			}
+			s.handle(req)
+		case <-refreshes:
+			for id, view := range s.views {
+				s.patch(id, view)
+			}
+		case <-s.failed:
+			return
+		}
+	}
+}
+
+func (s *wsSession) readLoop(requests chan<- WSRequest) {
+	defer close(requests)
+	s.conn.SetReadLimit(wsMaxMessage)
+	for {
+		var req WSRequest
+		if err := s.conn.ReadJSON(&req); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				// The connection is fine, the client is told by the unknown message type
+				req = WSRequest{}
+			default:
+				return
+			}
+		}
+		select {
+		case requests <- req:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *wsSession) writeLoop() {
+	defer s.conn.Close()
+	for msg := range s.send {
+		s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := s.conn.WriteJSON(msg); err != nil {
+			close(s.failed)
+			// Drain until the session notices
+			for range s.send {
+			}
+			return
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// reply queues a message the client asked for, waiting for room in the queue
+func (s *wsSession) reply(msg interface{}) {
+	select {
+	case s.send <- msg:
+	case <-s.failed:
+	}
+}
+
+func (s *wsSession) handle(req WSRequest) {
+	switch req.Type {
+	case WSTypePing:
+		s.reply(WSReply{Type: WSTypePong, ID: req.ID})
+	case WSTypeSubscribe:
+		var wsFilter WSFilter
+		if req.Filter != nil {
+			wsFilter = *req.Filter
+		}
+		filter, err := wsFilter.compile()
+		if err != nil {
+			s.reply(WSReply{Type: WSTypeError, ID: req.ID, Error: err.Error()})
+			return
+		}
+		issues, err := s.view(filter)
+		if err != nil {
+			s.reply(WSReply{Type: WSTypeError, ID: req.ID, Error: err.Error()})
+			return
+		}
+		view := &wsView{filter: filter, issues: make(map[IssueKey]Issue, len(issues))}
+		for _, issue := range issues {
+			view.issues[keyOf(issue)] = issue
+		}
+		s.views[req.ID] = view
+		s.reply(WSSnapshot{Type: WSTypeSnapshot, ID: req.ID, Issues: issues})
+	case WSTypeUnsubscribe:
+		delete(s.views, req.ID)
+	default:
+		s.reply(WSReply{Type: WSTypeError, ID: req.ID, Error: "unknown message type"})
+	}
+}
+
+// view returns the current issues matching filter, worst first
+func (s *wsSession) view(filter Filter) ([]Issue, error) {
+	data, err := s.svc.GetParsedNagios(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	issues := FlattenIssues(data)
+	positions := make([]issuePosition, len(issues))
+	for i, issue := range issues {
+		positions[i] = positionOf(issue, SortSeverity, true)
+	}
+	sort.Sort(issuesByPosition{issues: issues, positions: positions})
+	// Views are patched by key, status files repeating a block only show its worst copy
+	seen := make(map[IssueKey]bool, len(issues))
+	unique := issues[:0]
+	for _, issue := range issues {
+		if key := keyOf(issue); !seen[key] {
+			seen[key] = true
+			unique = append(unique, issue)
+		}
+	}
+	return unique, nil
+}
+
+// patch sends the changes of a view since it was last sent. When the client is lagging behind
+// the patch is held back and the changes are folded into the patch of a later refresh
+func (s *wsSession) patch(id string, view *wsView) {
+	issues, err := s.view(view.filter)
+	if err != nil {
+		return
+	}
+	patch := WSPatch{Type: WSTypePatch, ID: id, Added: []Issue{}, Updated: []Issue{}, Removed: []IssueKey{}}
+	current := make(map[IssueKey]Issue, len(issues))
+	for _, issue := range issues {
+		key := keyOf(issue)
+		current[key] = issue
+		before, found := view.issues[key]
+		switch {
+		case !found:
+			patch.Added = append(patch.Added, issue)
+		case changed(before, issue):
+			patch.Updated = append(patch.Updated, issue)
+		}
+	}
+	for key := range view.issues {
+		if _, found := current[key]; !found {
+			patch.Removed = append(patch.Removed, key)
+		}
+	}
+	if len(patch.Added)+len(patch.Updated)+len(patch.Removed) == 0 {
+		return
+	}
+	select {
+	case s.send <- patch:
+		view.issues = current
+	default:
+		// The queue is full, the view stays as the client last saw it
+	}
+}
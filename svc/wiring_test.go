@@ -1,18 +1,32 @@
 package svc
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	kitprom "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/gorilla/websocket"
 	cache "github.com/patrickmn/go-cache"
 	stdprom "github.com/prometheus/client_golang/prometheus"
+	"github.com/tchaudhry91/nagiosagg/internal/testutil"
+	"github.com/tchaudhry91/nagiosagg/parser"
+	"github.com/tchaudhry91/nagiosagg/pb"
 	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var nagiosStatusDir = statusDir
@@ -23,6 +37,8 @@ const limitInterval time.Duration = 20
 var requests *kitprom.Counter
 var requestDuration *kitprom.Summary
 var numHosts *kitprom.Summary
+var flapping *kitprom.Gauge
+var testBroker *EventBroker
 
 func init() {
 	fieldKeys := []string{"method", "err"}
@@ -50,22 +66,36 @@ func init() {
 		},
 		fieldKeys,
 	)
+	flapping = kitprom.NewGaugeFrom(
+		stdprom.GaugeOpts{
+			Namespace: "nagios_svc",
+			Name:      "flapping_issues",
+			Help:      "Number of flapping issues after the last refresh",
+		},
+		[]string{},
+	)
 }
 
 func initService() *httptest.Server {
+	return initServiceWith(true)
+}
+
+func initServiceWith(legacyRefresh bool) *httptest.Server {
 	cleanUp()
 	// Middleware inits
 	logger := log.NewNopLogger()
 	cacher := cache.New(3*time.Minute, 3*time.Minute)
 	limit := rate.Every(time.Second * limitInterval)
 	limiter := rate.NewLimiter(limit, 1)
+	testBroker = NewEventBroker(DefaultReplaySize)
 
 	// Service inits
 	service, _ := NewNagiosParserSvc(*nagiosStatusDir, tempDBWire)
 	service = CachingMiddleware(cacher)(service)
-	service = InstrumentingMiddleware(requests, requestDuration, numHosts)(service)
+	service = AfterRefreshMiddleware(testBroker.AfterRefresh)(service)
+	service = InstrumentingMiddleware(requests, requestDuration, numHosts, flapping)(service)
 	service = LoggingMiddleware(logger)(service)
-	router := MakeHTTPHandler(service, cacher, limiter)
+	router := MakeHTTPHandler(service, cacher, NewRefreshJobs(service, limiter), testBroker, legacyRefresh)
 
 	return httptest.NewServer(router)
 }
@@ -82,8 +112,37 @@ func TestNagiosEndpoints(t *testing.T) {
 		want   int
 	}{
 		{method: "GET", url: "/nagios", want: 500},
+		{method: "GET", url: "/diff", want: 404},
+		{method: "GET", url: "/summary", want: 404},
 		{method: "GET", url: "/refresh", want: 200},
 		{method: "GET", url: "/nagios", want: 200},
+		{method: "GET", url: "/nagios?state=CRITICAL,WARNING&host=*&service=/(?i)ssh/&acknowledged=false&min_duration=1h", want: 200},
+		{method: "GET", url: "/nagios?host=/(/", want: 400},
+		{method: "GET", url: "/nagios?in_downtime=maybe", want: 400},
+		{method: "GET", url: "/nagios?state_type=firm", want: 400},
+		{method: "GET", url: "/nagios?flatten=true&suppressed=false", want: 200},
+		{method: "GET", url: "/nagios?flatten=maybe", want: 400},
+		{method: "GET", url: "/nagios?label=tag/prod&label=site=berlin", want: 200},
+		{method: "GET", url: "/nagios?label==berlin", want: 400},
+		{method: "GET", url: "/v2/issues?sort=duration&limit=10&state=CRITICAL", want: 200},
+		{method: "GET", url: "/v2/issues?sort=name", want: 400},
+		{method: "GET", url: "/v2/issues?cursor=bm90IGpzb24", want: 400},
+		{method: "GET", url: "/summary?top=5", want: 200},
+		{method: "GET", url: "/summary?top=-1", want: 400},
+		{method: "GET", url: "/hosts", want: 200},
+		{method: "GET", url: "/hosts/frodo", want: 200},
+		{method: "GET", url: "/hosts/no-such-host", want: 404},
+		{method: "GET", url: "/services/Production:%20Backend%20State", want: 200},
+		{method: "GET", url: "/services/Disk%20%2Fvar", want: 200},
+		{method: "GET", url: "/events", want: 200},
+		{method: "GET", url: "/events?since=2018-09-26T06:15:41Z", want: 200},
+		{method: "GET", url: "/events?since=yesterday", want: 400},
+		{method: "GET", url: "/diff", want: 404},
+		{method: "GET", url: "/diff?to=1&format=text", want: 404},
+		{method: "GET", url: "/diff?format=xml", want: 400},
+		{method: "GET", url: "/reports/availability", want: 200},
+		{method: "GET", url: "/reports/availability?from=1535760000&to=2018-10-01T00:00:00Z&format=csv", want: 200},
+		{method: "GET", url: "/reports/availability?from=2018-10-01T00:00:00Z&to=1535760000", want: 400},
 		{method: "GET", url: "/nagios2", want: 404},
 	} {
 		req, _ := http.NewRequest(testcase.method, srv.URL+testcase.url, nil)
@@ -95,6 +154,366 @@ func TestNagiosEndpoints(t *testing.T) {
 	cleanUp()
 }
 
+func TestContentNegotiation(t *testing.T) {
+	srv := initService()
+	http.Get(srv.URL + "/refresh")
+	// A second snapshot to diff against, refreshing past the rate limit
+	service, _ := NewNagiosParserSvc(*nagiosStatusDir, tempDBWire)
+	service.RefreshNagiosData(context.Background())
+	for _, testcase := range []struct {
+		url         string
+		accept      string
+		want        int
+		contentType string
+	}{
+		{url: "/nagios", want: 200, contentType: "application/json"},
+		{url: "/nagios", accept: "*/*", want: 200, contentType: "application/json"},
+		{url: "/nagios", accept: "text/plain", want: 200, contentType: "text/plain"},
+		{url: "/nagios", accept: "text/csv;q=0.5, application/yaml", want: 200, contentType: "application/yaml"},
+		{url: "/nagios?format=csv", accept: "application/json", want: 200, contentType: "text/csv"},
+		{url: "/nagios", accept: "application/xml", want: 406},
+		{url: "/nagios?format=xml", want: 400},
+		{url: "/v2/issues?format=table", want: 200, contentType: "text/plain"},
+		{url: "/events?format=csv", want: 200, contentType: "text/csv"},
+		{url: "/hosts?format=yaml", want: 200, contentType: "application/yaml"},
+		{url: "/hosts/frodo?format=table", want: 200, contentType: "text/plain"},
+		{url: "/services/Disk%20%2Fvar?format=csv", want: 200, contentType: "text/csv"},
+		{url: "/diff?format=text", want: 200, contentType: "text/plain"},
+		{url: "/reports/availability", accept: "text/csv", want: 200, contentType: "text/csv"},
+		{url: "/summary?format=yaml", want: 200, contentType: "application/yaml"},
+		{url: "/summary?format=csv", want: 406},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+testcase.url, nil)
+		if testcase.accept != "" {
+			req.Header.Set("Accept", testcase.accept)
+		}
+		resp, _ := http.DefaultClient.Do(req)
+		resp.Body.Close()
+		if want, have := testcase.want, resp.StatusCode; want != have {
+			t.Errorf("%s (Accept %q): want %d, have %d", testcase.url, testcase.accept, want, have)
+			continue
+		}
+		if have := resp.Header.Get("Content-Type"); testcase.contentType != "" && !strings.HasPrefix(have, testcase.contentType) {
+			t.Errorf("%s (Accept %q): want content type %s, have %s", testcase.url, testcase.accept, testcase.contentType, have)
+		}
+	}
+	cleanUp()
+}
+
+// readServerSentEvent returns the next event of an SSE stream, or the comment when it reads one first
+func readServerSentEvent(r *bufio.Reader) (id, event, comment string, err error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return id, event, comment, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if id != "" || comment != "" {
+				return id, event, comment, nil
+			}
+		case strings.HasPrefix(line, ":"):
+			comment = strings.TrimSpace(line[1:])
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	StreamHeartbeat = 50 * time.Millisecond
+	srv := initService()
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(srv.URL + "/stream")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stream failed: %v %v", resp, err)
+	}
+	if want, have := "text/event-stream", resp.Header.Get("Content-Type"); want != have {
+		t.Errorf("Content-Type: want %s, have %s", want, have)
+	}
+	stream := bufio.NewReader(resp.Body)
+	if _, _, comment, err := readServerSentEvent(stream); err != nil || comment != "stream opened" {
+		t.Fatalf("Stream wasn't opened: %q %v", comment, err)
+	}
+
+	http.Get(srv.URL + "/refresh")
+	var first string
+	for first == "" {
+		id, event, _, err := readServerSentEvent(stream)
+		if err != nil {
+			t.Fatalf("Failed to read the stream: %v", err)
+		}
+		if id != "" {
+			if event != EventOpened {
+				t.Errorf("First refresh should only open issues, got %s", event)
+			}
+			first = id
+		}
+	}
+	resp.Body.Close()
+
+	// Resuming replays the events after the last one received
+	req, _ := http.NewRequest("GET", srv.URL+"/stream", nil)
+	req.Header.Set("Last-Event-ID", first)
+	resp, err = client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Resuming /stream failed: %v %v", resp, err)
+	}
+	stream = bufio.NewReader(resp.Body)
+	readServerSentEvent(stream)
+	id, _, _, err := readServerSentEvent(stream)
+	firstID, _ := strconv.ParseUint(first, 10, 64)
+	if want, have := strconv.FormatUint(firstID+1, 10), id; err != nil || want != have {
+		t.Errorf("Resume: want event %s, have %s (%v)", want, have, err)
+	}
+	resp.Body.Close()
+
+	// Filters apply to replayed events, idle streams get heartbeats
+	resp, err = client.Get(srv.URL + "/stream?host=no-such-host&last_event_id=0")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Filtered /stream failed: %v %v", resp, err)
+	}
+	stream = bufio.NewReader(resp.Body)
+	readServerSentEvent(stream)
+	if id, _, comment, err := readServerSentEvent(stream); err != nil || id != "" || comment != "heartbeat" {
+		t.Errorf("Filtered stream: want a heartbeat, have event %q comment %q (%v)", id, comment, err)
+	}
+	resp.Body.Close()
+
+	resp, _ = client.Get(srv.URL + "/stream?last_event_id=latest")
+	if want, have := http.StatusBadRequest, resp.StatusCode; want != have {
+		t.Errorf("Invalid last_event_id: want %d, have %d", want, have)
+	}
+	cleanUp()
+}
+
+func TestWebSocket(t *testing.T) {
+	dir := testutil.TempDir(t)
+	statusFile := filepath.Join(dir, "nagios.dat")
+	testutil.CopyStatusFile(t, filepath.Join(*nagiosStatusDir, "random2.dat"), statusFile)
+
+	cleanUp()
+	broker := NewEventBroker(DefaultReplaySize)
+	service, _ := NewNagiosParserSvc(dir, tempDBWire)
+	service = CachingMiddleware(cache.New(time.Minute, time.Minute))(service)
+	service = AfterRefreshMiddleware(broker.AfterRefresh)(service)
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	srv := httptest.NewServer(MakeHTTPHandler(service, cache.New(time.Minute, time.Minute), NewRefreshJobs(service, limiter), broker, false))
+	defer srv.Close()
+	if _, err := service.RefreshNagiosData(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	conn.WriteJSON(WSRequest{Type: WSTypePing, ID: "p1"})
+	var reply WSReply
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != WSTypePong || reply.ID != "p1" {
+		t.Errorf("Ping: want pong, have %+v (%v)", reply, err)
+	}
+
+	conn.WriteJSON(WSRequest{Type: WSTypeSubscribe, ID: "bad", Filter: &WSFilter{StateType: "firm"}})
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != WSTypeError || reply.ID != "bad" {
+		t.Errorf("Invalid filter: want error, have %+v (%v)", reply, err)
+	}
+
+	conn.WriteJSON(WSRequest{Type: WSTypeSubscribe, ID: "all"})
+	var snapshot WSSnapshot
+	if err := conn.ReadJSON(&snapshot); err != nil || snapshot.Type != WSTypeSnapshot || len(snapshot.Issues) == 0 {
+		t.Fatalf("Subscribe: want a snapshot, have %+v (%v)", snapshot, err)
+	}
+	view := make(map[IssueKey]Issue)
+	for _, issue := range snapshot.Issues {
+		view[keyOf(issue)] = issue
+	}
+
+	// The patch of the next refresh brings the view up to date
+	testutil.CopyStatusFile(t, filepath.Join(*nagiosStatusDir, "random3.dat"), statusFile)
+	if _, err := service.RefreshNagiosData(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	var patch WSPatch
+	if err := conn.ReadJSON(&patch); err != nil || patch.Type != WSTypePatch || patch.ID != "all" {
+		t.Fatalf("Refresh: want a patch, have %+v (%v)", patch, err)
+	}
+	for _, issue := range append(patch.Added, patch.Updated...) {
+		view[keyOf(issue)] = issue
+	}
+	for _, key := range patch.Removed {
+		delete(view, key)
+	}
+	conn.WriteJSON(WSRequest{Type: WSTypeSubscribe, ID: "all"})
+	snapshot = WSSnapshot{}
+	if err := conn.ReadJSON(&snapshot); err != nil || snapshot.Type != WSTypeSnapshot {
+		t.Fatalf("Resubscribe: want a snapshot, have %+v (%v)", snapshot, err)
+	}
+	if want, have := len(snapshot.Issues), len(view); want != have {
+		t.Errorf("Patched view: want %d issues, have %d", want, have)
+	}
+	for _, issue := range snapshot.Issues {
+		if patched, found := view[keyOf(issue)]; !found || changed(patched, issue) {
+			t.Errorf("Patched view is missing %+v", keyOf(issue))
+		}
+	}
+	cleanUp()
+}
+
+func TestWebSocketBackpressure(t *testing.T) {
+	srv := initService()
+	defer srv.Close()
+	http.Get(srv.URL + "/refresh")
+	service, _ := NewNagiosParserSvc(*nagiosStatusDir, tempDBWire)
+
+	// Nobody reads the queue, the patch is held back without blocking
+	session := &wsSession{svc: service, send: make(chan interface{})}
+	view := &wsView{issues: map[IssueKey]Issue{}}
+	session.patch("all", view)
+	if len(view.issues) != 0 {
+		t.Errorf("A patch that wasn't queued advanced the view")
+	}
+
+	session.send = make(chan interface{}, 1)
+	session.patch("all", view)
+	patch, queued := (<-session.send).(WSPatch)
+	if !queued || len(view.issues) == 0 || len(patch.Added) != len(view.issues) {
+		t.Errorf("The held back changes weren't patched: %+v", patch)
+	}
+	cleanUp()
+}
+
+func TestGRPC(t *testing.T) {
+	cleanUp()
+	broker := NewEventBroker(DefaultReplaySize)
+	service, _ := NewNagiosParserSvc(*nagiosStatusDir, tempDBWire)
+	service = AfterRefreshMiddleware(broker.AfterRefresh)(service)
+	limiter := rate.NewLimiter(rate.Every(time.Second*limitInterval), 1)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	jobs := NewRefreshJobs(service, limiter)
+	pb.RegisterNagiosServer(server, MakeGRPCServer(service, cache.New(time.Minute, time.Minute), jobs, broker))
+	go server.Serve(lis)
+	defer server.Stop()
+	srv := httptest.NewServer(MakeHTTPHandler(service, cache.New(time.Minute, time.Minute), jobs, broker, false))
+	defer srv.Close()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewNagiosClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	watch, err := client.WatchIssues(ctx, &pb.WatchIssuesRequest{Filter: &pb.Filter{States: []string{"critical"}}})
+	if err != nil {
+		t.Fatalf("WatchIssues failed: %v", err)
+	}
+	refresh, err := client.Refresh(ctx, &pb.RefreshRequest{})
+	if err != nil || refresh.Problems == 0 || refresh.Events == 0 {
+		t.Fatalf("Refresh: %+v (%v)", refresh, err)
+	}
+	if _, err := client.Refresh(ctx, &pb.RefreshRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Second refresh: want ResourceExhausted, have %v", err)
+	}
+	// Refreshes over HTTP are limited together with those over gRPC
+	if resp, err := http.Post(srv.URL+"/refresh", "", nil); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("POST /refresh after a gRPC refresh: want 429, have %v (%v)", resp, err)
+	}
+	event, err := watch.Recv()
+	if err != nil || event.Type != EventOpened || event.ToState != "CRITICAL" || event.Id == 0 {
+		t.Errorf("WatchIssues: want an opened CRITICAL issue, have %+v (%v)", event, err)
+	}
+
+	issues, err := client.GetIssues(ctx, &pb.GetIssuesRequest{Filter: &pb.Filter{States: []string{"WARNING"}}})
+	if err != nil || len(issues.Issues) == 0 {
+		t.Fatalf("GetIssues: %+v (%v)", issues, err)
+	}
+	for _, issue := range issues.Issues {
+		if issue.State != "WARNING" || issue.Hostname == "" || issue.LastCheck == nil {
+			t.Errorf("GetIssues: unexpected issue %+v", issue)
+		}
+	}
+	if _, err := client.GetIssues(ctx, &pb.GetIssuesRequest{Filter: &pb.Filter{Host: "/(/"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Invalid filter: want InvalidArgument, have %v", err)
+	}
+	stable := false
+	issues, err = client.GetIssues(ctx, &pb.GetIssuesRequest{Filter: &pb.Filter{Flapping: &stable}})
+	if err != nil || len(issues.Issues) == 0 {
+		t.Fatalf("GetIssues of stable issues: %+v (%v)", issues, err)
+	}
+	for _, issue := range issues.Issues {
+		if issue.Flapping {
+			t.Errorf("GetIssues of stable issues: unexpected flapping issue %+v", issue)
+		}
+	}
+	suppressed := true
+	issues, err = client.GetIssues(ctx, &pb.GetIssuesRequest{Filter: &pb.Filter{Suppressed: &suppressed}})
+	if err != nil || len(issues.Issues) != 0 {
+		t.Errorf("GetIssues of suppressed issues: want none in the samples, have %+v (%v)", issues, err)
+	}
+	issues, err = client.GetIssues(ctx, &pb.GetIssuesRequest{Filter: &pb.Filter{HostGroups: []string{"web"}, ServiceGroups: []string{"http"}, Contacts: []string{"ops"}}})
+	if err != nil || len(issues.Issues) != 0 {
+		t.Errorf("GetIssues of a group: want none without objects.cache, have %+v (%v)", issues, err)
+	}
+	if _, err := client.GetIssues(ctx, &pb.GetIssuesRequest{Filter: &pb.Filter{Labels: []string{"=prod"}}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Invalid label selector: want InvalidArgument, have %v", err)
+	}
+	// The samples have none of these, map them directly
+	flapping := NagiosStatusResponse{State: "CRITICAL", Flapping: true, FlapPercent: 40, NagiosFlapping: true, PercentStateChange: 25.5, SuppressedBy: "router1"}
+	flapping.Metadata = parser.Metadata{Alias: "Web 1", Address: "10.0.0.1", Parents: []string{"router1"}, HostGroups: []string{"web"}, ServiceGroups: []string{"http"}, Contacts: []string{"ops"}}
+	flapping.Labels = map[string]string{"env": "prod"}
+	reply, _ := encodeGRPCGetIssuesResponse(ctx, getParsedNagiosResponse{"web1": {flapping}})
+	issue := reply.(*pb.GetIssuesReply).Issues[0]
+	if !issue.Flapping || issue.FlapPercent != 40 || !issue.NagiosFlapping || issue.PercentStateChange != 25.5 {
+		t.Errorf("GetIssues: want the flap detection of the issue, have %+v", issue)
+	}
+	if issue.SuppressedBy != "router1" {
+		t.Errorf("GetIssues: want the issue suppressed by router1, have %+v", issue)
+	}
+	if issue.Alias != "Web 1" || issue.Address != "10.0.0.1" || !reflect.DeepEqual(issue.Parents, []string{"router1"}) ||
+		!reflect.DeepEqual(issue.HostGroups, []string{"web"}) || !reflect.DeepEqual(issue.ServiceGroups, []string{"http"}) || !reflect.DeepEqual(issue.Contacts, []string{"ops"}) {
+		t.Errorf("GetIssues: want the metadata of the issue, have %+v", issue)
+	}
+	if issue.Labels["env"] != "prod" {
+		t.Errorf("GetIssues: want the labels of the issue, have %+v", issue)
+	}
+	event = eventToProto(Event{Type: EventOpened, Hostname: "web1", Flapping: true, SuppressedBy: "router1", HostGroups: []string{"web"}, ServiceGroups: []string{"http"}, Contacts: []string{"ops"}, Labels: map[string]string{"env": "prod"}})
+	if !event.Flapping || event.SuppressedBy != "router1" {
+		t.Errorf("WatchIssues: want the flapping and suppression of events, have %+v", event)
+	}
+	if !reflect.DeepEqual(event.HostGroups, []string{"web"}) || !reflect.DeepEqual(event.ServiceGroups, []string{"http"}) || !reflect.DeepEqual(event.Contacts, []string{"ops"}) {
+		t.Errorf("WatchIssues: want the groups and contacts of events, have %+v", event)
+	}
+	if event.Labels["env"] != "prod" {
+		t.Errorf("WatchIssues: want the labels of events, have %+v", event)
+	}
+
+	instances, err := client.ListInstances(ctx, &pb.ListInstancesRequest{})
+	if err != nil || len(instances.Instances) == 0 {
+		t.Fatalf("ListInstances: %+v (%v)", instances, err)
+	}
+	problems := 0
+	for _, instance := range instances.Instances {
+		problems += int(instance.Problems)
+	}
+	if want, have := int(refresh.Problems), problems; want != have {
+		t.Errorf("ListInstances: want %d problems, have %d", want, have)
+	}
+	cleanUp()
+}
+
 func TestEndpointTiming(t *testing.T) {
 	srv := initService()
 	for _, testcase := range []struct {
@@ -118,6 +537,50 @@ func TestEndpointTiming(t *testing.T) {
 	cleanUp()
 }
 
+func TestRefreshJobs(t *testing.T) {
+	srv := initServiceWith(false)
+	// Whether the router answers 404 or 405 depends on the mux version, the refresh must not run either way
+	resp, _ := http.Get(srv.URL + "/refresh")
+	if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /refresh without legacy_refresh: want 404 or 405, have %d", resp.StatusCode)
+	}
+
+	var first, second RefreshJob
+	for _, job := range []*RefreshJob{&first, &second} {
+		resp, err := http.Post(srv.URL+"/refresh", "", nil)
+		if err != nil || resp.StatusCode != http.StatusAccepted {
+			t.Errorf("POST /refresh failed: %v %v", resp, err)
+			t.FailNow()
+		}
+		json.NewDecoder(resp.Body).Decode(job)
+		resp.Body.Close()
+	}
+	if first.ID == "" || (second.Status == JobRunning && second.ID != first.ID) {
+		t.Errorf("Concurrent refresh requests weren't deduplicated: %s, %s", first.ID, second.ID)
+	}
+
+	var job RefreshJob
+	testutil.WaitFor(t, "the refresh job", func() bool {
+		resp, _ := http.Get(srv.URL + "/refresh/" + first.ID)
+		json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		return job.Status != JobRunning
+	})
+	if job.Status != JobSucceeded || job.Report == nil || job.SourcesDone != job.SourcesTotal {
+		t.Errorf("Unexpected finished job: %+v", job)
+	}
+
+	resp, _ = http.Post(srv.URL+"/refresh", "", nil)
+	if want, have := http.StatusTooManyRequests, resp.StatusCode; want != have {
+		t.Errorf("POST /refresh after a finished job: want %d, have %d", want, have)
+	}
+	resp, _ = http.Get(srv.URL + "/refresh/unknown")
+	if want, have := http.StatusNotFound, resp.StatusCode; want != have {
+		t.Errorf("GET /refresh/unknown: want %d, have %d", want, have)
+	}
+	cleanUp()
+}
+
 func TestRateLimiter(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping test in short mode")